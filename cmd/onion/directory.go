@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/onion"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/urfave/cli/v3"
+)
+
+var directoryCommand = &cli.Command{
+	Name:  "directory",
+	Usage: "Browse the public directory of hidden services anonymously",
+	Commands: []*cli.Command{
+		{
+			Name:      "search",
+			Usage:     "Lists the hidden services matching the query. Lists every service when empty",
+			ArgsUsage: "[QUERY]",
+			Action:    directorySearch,
+		},
+		{
+			Name:      "show",
+			Usage:     "Shows the listing of a hidden address",
+			ArgsUsage: "ADDRESS",
+			Action:    directoryShow,
+		},
+	},
+}
+
+func directorySearch(ctx context.Context, cmd *cli.Command) (err error) {
+	node, err := newNode(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	listings, err := node.Service.SearchDirectory(ctx, strings.Join(cmd.Args().Slice(), " "))
+	if err != nil {
+		return err
+	}
+
+	for index := range listings {
+		if index > 0 {
+			fmt.Println()
+		}
+		printListing(&listings[index])
+	}
+	return nil
+}
+
+func directoryShow(ctx context.Context, cmd *cli.Command) (err error) {
+	if cmd.Args().Len() != 1 {
+		return errors.New("expecting a hidden address")
+	}
+
+	address, err := onion.ParseAddress(cmd.Args().First())
+	if err != nil {
+		return err
+	}
+
+	node, err := newNode(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	listing, err := node.Service.LookupListing(ctx, address)
+	if err != nil {
+		return err
+	}
+
+	printListing(listing)
+	return nil
+}
+
+func printListing(listing *message.Listing) {
+	fmt.Printf("Address:     %s\n", onion.FormatAddress(listing.Address))
+	fmt.Printf("Title:       %s\n", listing.Title)
+	if listing.Description != "" {
+		fmt.Printf("Description: %s\n", listing.Description)
+	}
+	if len(listing.Tags) > 0 {
+		fmt.Printf("Tags:        %s\n", strings.Join(listing.Tags, ", "))
+	}
+	if listing.Contact != "" {
+		fmt.Printf("Contact:     %s\n", listing.Contact)
+	}
+	fmt.Printf("Published:   %s\n", time.Unix(listing.Published, 0).Format(time.RFC3339))
+	fmt.Printf("Expiry:      %s\n", time.Unix(listing.Expiry, 0).Format(time.RFC3339))
+}
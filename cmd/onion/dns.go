@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/RogueTeam/onion/net/dnsproxy"
+	"github.com/RogueTeam/onion/p2p/onion"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	DNSAddressFlag        = "address"
+	DNSVirtualNetworkFlag = "virtual-network"
+)
+
+var dnsCommand = &cli.Command{
+	Name:  "dns",
+	Usage: "Runs a DNS resolver answering through exit nodes. Hidden addresses and names get virtual addresses",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  DNSAddressFlag,
+			Usage: "UDP and TCP listen address of the resolver",
+			Value: "127.0.0.1:5353",
+		},
+		&cli.StringFlag{
+			Name:  DNSVirtualNetworkFlag,
+			Usage: "IPv4 network of the virtual addresses",
+			Value: dnsproxy.DefaultVirtualNetwork,
+		},
+	},
+	Action: dnsAction,
+}
+
+func dnsAction(ctx context.Context, cmd *cli.Command) (err error) {
+	node, err := newNode(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	virtual, err := dnsproxy.NewVirtualNetwork(cmd.String(DNSVirtualNetworkFlag))
+	if err != nil {
+		return err
+	}
+
+	server, closeServer := newDNSServer(node, virtual)
+	defer closeServer()
+
+	log.Printf("[*] DNS resolver listening at %s", cmd.String(DNSAddressFlag))
+	return server.ListenAndServe(cmd.String(DNSAddressFlag))
+}
+
+// DNS server resolving through the reused exit circuits of the node
+func newDNSServer(node *Node, virtual *dnsproxy.VirtualNetwork) (server *dnsproxy.Server, closeServer func()) {
+	resolver := &onion.ExitResolver{Service: node.Service}
+	server = &dnsproxy.Server{
+		Lookup: func(ctx context.Context, network, host string) (ips []net.IP, ttl time.Duration, err error) {
+			ips, ttl, err = resolver.Lookup(ctx, network, host)
+			if errors.Is(err, onion.ErrHostNotFound) {
+				return nil, 0, dnsproxy.ErrNotFound
+			}
+			return ips, ttl, err
+		},
+		VirtualSuffix: onion.AddressSuffix,
+		Virtual:       virtual,
+	}
+	return server, func() { resolver.Close() }
+}
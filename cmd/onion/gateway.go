@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RogueTeam/onion/net/gateway"
+	"github.com/RogueTeam/onion/p2p/onion"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/time/rate"
+)
+
+const (
+	GatewayAddressFlag = "address"
+	GatewayDomainFlag  = "domain"
+	GatewayHostFlag    = "host"
+	GatewayAllowFlag   = "allow"
+	GatewayPortFlag    = "port"
+	GatewayRateFlag    = "rate"
+	GatewayBurstFlag   = "burst"
+	GatewayTLSCertFlag = "tls-cert"
+	GatewayTLSKeyFlag  = "tls-key"
+)
+
+// Timeouts of the clients of the gateway. Slow clients can't hold connections forever
+const (
+	GatewayReadHeaderTimeout = 10 * time.Second
+	GatewayReadTimeout       = time.Minute
+	GatewayIdleTimeout       = time.Minute
+)
+
+var gatewayCommand = &cli.Command{
+	Name:  "gateway",
+	Usage: "Runs an HTTP gateway letting clients outside the network reach hidden services",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  GatewayAddressFlag,
+			Usage: "Listen address of the gateway",
+			Value: "127.0.0.1:8080",
+		},
+		&cli.StringFlag{
+			Name:  GatewayDomainFlag,
+			Usage: "Domain of the gateway. Requests for HIDDEN.DOMAIN reach HIDDEN" + onion.AddressSuffix,
+		},
+		&cli.StringSliceFlag{
+			Name:  GatewayHostFlag,
+			Usage: "Hostname mapped to a hidden address or name. In HOSTNAME=HIDDEN form",
+		},
+		&cli.StringSliceFlag{
+			Name:  GatewayAllowFlag,
+			Usage: "Hidden addresses or names allowed. Every hidden service is allowed when not set",
+		},
+		&cli.IntFlag{
+			Name:  GatewayPortFlag,
+			Usage: "Virtual port of the hidden services",
+			Value: gateway.DefaultPort,
+		},
+		&cli.FloatFlag{
+			Name:  GatewayRateFlag,
+			Usage: "Requests per second of each client IP. Zero disables the limit",
+			Value: 10,
+		},
+		&cli.IntFlag{
+			Name:  GatewayBurstFlag,
+			Usage: "Requests each client can burst above the rate",
+			Value: 20,
+		},
+		&cli.StringFlag{
+			Name:  GatewayTLSCertFlag,
+			Usage: "Certificate file. Serves HTTPS when set with the key",
+		},
+		&cli.StringFlag{
+			Name:  GatewayTLSKeyFlag,
+			Usage: "Key file of the certificate",
+		},
+	},
+	Action: gatewayAction,
+}
+
+// Completes names with the AddressSuffix
+func hiddenHost(host string) (hidden string) {
+	if onion.IsHiddenHost(host) {
+		return host
+	}
+	return host + onion.AddressSuffix
+}
+
+func gatewayAction(ctx context.Context, cmd *cli.Command) (err error) {
+	hosts := make(map[string]string)
+	for _, mapping := range cmd.StringSlice(GatewayHostFlag) {
+		hostname, hidden, found := strings.Cut(mapping, "=")
+		if !found {
+			return fmt.Errorf("invalid host mapping: %s", mapping)
+		}
+		hosts[hostname] = hidden
+	}
+
+	var allow []string
+	for _, hidden := range cmd.StringSlice(GatewayAllowFlag) {
+		allow = append(allow, hiddenHost(hidden))
+	}
+
+	certFile, keyFile := cmd.String(GatewayTLSCertFlag), cmd.String(GatewayTLSKeyFlag)
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("both the certificate and its key are required")
+	}
+
+	node, err := newNode(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	server := &gateway.Server{
+		Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			// Never reach the clearnet through the exits
+			if !onion.IsHiddenHost(host) {
+				return nil, fmt.Errorf("not a hidden host: %s", host)
+			}
+			return node.Service.DialContext(ctx, network, address)
+		},
+		Suffix:    onion.AddressSuffix,
+		Domain:    cmd.String(GatewayDomainFlag),
+		Hosts:     hosts,
+		Allow:     allow,
+		Port:      uint16(cmd.Int(GatewayPortFlag)),
+		RateLimit: rate.Limit(cmd.Float(GatewayRateFlag)),
+		Burst:     int(cmd.Int(GatewayBurstFlag)),
+	}
+
+	httpServer := http.Server{
+		Addr:              cmd.String(GatewayAddressFlag),
+		Handler:           server,
+		ReadHeaderTimeout: GatewayReadHeaderTimeout,
+		ReadTimeout:       GatewayReadTimeout,
+		IdleTimeout:       GatewayIdleTimeout,
+	}
+	log.Printf("[*] Gateway listening at %s", httpServer.Addr)
+	if certFile != "" {
+		return httpServer.ListenAndServeTLS(certFile, keyFile)
+	}
+	return httpServer.ListenAndServe()
+}
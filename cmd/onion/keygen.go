@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/identity"
+	"github.com/RogueTeam/onion/p2p/onion"
+	"github.com/RogueTeam/onion/p2p/vanity"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	KeygenPrefixFlag  = "prefix"
+	KeygenOutputFlag  = "output"
+	KeygenWorkersFlag = "workers"
+	KeygenForceFlag   = "force"
+)
+
+var keygenCommand = &cli.Command{
+	Name:  "keygen",
+	Usage: "Generates a hidden service key. Optionally searching an address starting with a prefix",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  KeygenPrefixFlag,
+			Usage: "Prefix of the encoded hidden address. Characters: " + vanity.Alphabet,
+		},
+		&cli.StringFlag{
+			Name:  KeygenOutputFlag,
+			Usage: "File the key is written to",
+			Value: "hidden.key",
+		},
+		&cli.IntFlag{
+			Name:  KeygenWorkersFlag,
+			Usage: "Number of goroutines searching. Zero uses every CPU",
+		},
+		&cli.BoolFlag{
+			Name:  KeygenForceFlag,
+			Usage: "Overwrite the output file if it already exists",
+		},
+	},
+	Action: keygen,
+}
+
+func keygen(ctx context.Context, cmd *cli.Command) (err error) {
+	prefix := strings.ToLower(cmd.String(KeygenPrefixFlag))
+	err = vanity.ValidatePrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	output, force := cmd.String(KeygenOutputFlag), cmd.Bool(KeygenForceFlag)
+	// Checked before searching so long searches aren't wasted. Writing the key checks again
+	if _, err := os.Stat(output); err == nil && !force {
+		return fmt.Errorf("%s already exists. Pass --%s to overwrite it", output, KeygenForceFlag)
+	}
+
+	workers := cmd.Int(KeygenWorkersFlag)
+	if prefix != "" {
+		rate := vanity.Rate(time.Second, workers)
+		log.Printf("[*] Searching prefix %q: %.0f keys/s, expected %.0f attempts, estimated time %s",
+			prefix, rate, vanity.ExpectedAttempts(prefix), vanity.Estimate(prefix, rate).Round(time.Millisecond))
+	}
+
+	result, err := vanity.Generate(ctx, vanity.Config{Prefix: prefix, Workers: workers})
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	if force {
+		err = identity.SaveIdentity(output, result.Key)
+	} else {
+		err = identity.CreateIdentity(output, result.Key)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[*] Found after %d attempts in %s", result.Attempts, result.Elapsed.Round(time.Millisecond))
+	fmt.Println(onion.FormatAddress(result.Address))
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/RogueTeam/onion/p2p/identity"
+	"github.com/RogueTeam/onion/p2p/onion"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	IdentityFlag  = "identity"
+	ListenFlag    = "listen"
+	BootstrapFlag = "bootstrap"
+	HopsFlag      = "hops"
+	RecordsFlag   = "records"
+)
+
+var app = &cli.Command{
+	Name:  "onion",
+	Usage: "Client of the onion network",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  IdentityFlag,
+			Usage: "File of the node key. Generated when missing. Ephemeral when not set",
+		},
+		&cli.StringSliceFlag{
+			Name:  ListenFlag,
+			Usage: "Listen multiaddrs of the node",
+			Value: []string{"/ip4/0.0.0.0/udp/0/quic-v1"},
+		},
+		&cli.StringSliceFlag{
+			Name:  BootstrapFlag,
+			Usage: "Multiaddrs with /p2p of the peers used to join the network",
+		},
+		&cli.IntFlag{
+			Name:  HopsFlag,
+			Usage: "Number of peers of the circuits",
+			Value: onion.DefaultHops,
+		},
+		&cli.BoolFlag{
+			Name:  RecordsFlag,
+			Usage: "Join the DHT storing names and directory listings. Only reaches networks whose nodes enabled it too",
+		},
+	},
+	Commands: []*cli.Command{
+		directoryCommand,
+		socksCommand,
+		dnsCommand,
+		gatewayCommand,
+		keygenCommand,
+	},
+}
+
+// Node running in hidden mode. Used by the commands to reach the network
+type Node struct {
+	Host    host.Host
+	DHT     *dht.IpfsDHT
+	Service *onion.Service
+}
+
+func (n *Node) Close() {
+	err := n.Service.Close()
+	if err != nil {
+		log.Printf("failed to close service: %v", err)
+	}
+	n.DHT.Close()
+	n.Host.Close()
+}
+
+// Extra options are appended to the ones of the host
+func newNode(ctx context.Context, cmd *cli.Command, hostOptions ...libp2p.Option) (node *Node, err error) {
+	var ident crypto.PrivKey
+	if location := cmd.String(IdentityFlag); location != "" {
+		ident, err = identity.LoadIdentity(location)
+	} else {
+		ident, err = identity.NewKey()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare identity: %w", err)
+	}
+
+	var bootstrap []peer.AddrInfo
+	for _, addr := range cmd.StringSlice(BootstrapFlag) {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bootstrap peer: %w", err)
+		}
+		bootstrap = append(bootstrap, *info)
+	}
+	if len(bootstrap) == 0 {
+		return nil, errors.New("no bootstrap peers provided")
+	}
+
+	node = &Node{}
+	node.Host, err = libp2p.New(
+		append(
+			[]libp2p.Option{
+				libp2p.ListenAddrStrings(cmd.StringSlice(ListenFlag)...),
+				libp2p.Identity(ident),
+			},
+			hostOptions...,
+		)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare host: %w", err)
+	}
+
+	store := datastore.NewMapDatastore()
+	options := []dht.Option{
+		dht.Mode(dht.ModeClient),
+		dht.BootstrapPeers(bootstrap...),
+		dht.Datastore(store),
+	}
+	if cmd.Bool(RecordsFlag) {
+		options = append(options, onion.DHTOptions(store)...)
+	}
+
+	node.DHT, err = dht.New(ctx, node.Host, options...)
+	if err != nil {
+		node.Host.Close()
+		return nil, fmt.Errorf("failed to prepare dht: %w", err)
+	}
+
+	node.Service, err = onion.New(onion.Config{
+		Host:       node.Host,
+		DHT:        node.DHT,
+		Bootstrap:  true,
+		HiddenMode: true,
+		Hops:       cmd.Int(HopsFlag),
+		Records:    cmd.Bool(RecordsFlag),
+	})
+	if err != nil {
+		node.DHT.Close()
+		node.Host.Close()
+		return nil, fmt.Errorf("failed to prepare service: %w", err)
+	}
+	return node, nil
+}
+
+func main() {
+	err := app.Run(context.Background(), os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/RogueTeam/onion/net/socks5"
+	"github.com/urfave/cli/v3"
+)
+
+const SocksAddressFlag = "address"
+
+var socksCommand = &cli.Command{
+	Name:  "socks",
+	Usage: "Runs a SOCKS5 proxy reaching hidden services and exit nodes through circuits",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  SocksAddressFlag,
+			Usage: "Listen address of the proxy",
+			Value: "127.0.0.1:9050",
+		},
+	},
+	Action: socks,
+}
+
+func socks(ctx context.Context, cmd *cli.Command) (err error) {
+	node, err := newNode(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	l, err := net.Listen("tcp", cmd.String(SocksAddressFlag))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer l.Close()
+
+	log.Printf("[*] SOCKS5 proxy listening at %s", l.Addr())
+	server := socks5.Server{Dial: node.Service.DialContext}
+	return server.Serve(l)
+}
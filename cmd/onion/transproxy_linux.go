@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/RogueTeam/onion/net/dnsproxy"
+	"github.com/RogueTeam/onion/net/transproxy"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	TransproxyAddressFlag        = "address"
+	TransproxyDNSFlag            = "dns"
+	TransproxyVirtualNetworkFlag = "virtual-network"
+)
+
+func init() {
+	app.Commands = append(app.Commands, transproxyCommand)
+}
+
+var transproxyCommand = &cli.Command{
+	Name:  "transproxy",
+	Usage: "Runs a transparent proxy for iptables REDIRECTed TCP connections. Also runs the DNS resolver handing out the virtual addresses",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  TransproxyAddressFlag,
+			Usage: "Listen address of the proxy",
+			Value: "127.0.0.1:9040",
+		},
+		&cli.StringFlag{
+			Name:  TransproxyDNSFlag,
+			Usage: "UDP and TCP listen address of the DNS resolver",
+			Value: "127.0.0.1:5353",
+		},
+		&cli.StringFlag{
+			Name:  TransproxyVirtualNetworkFlag,
+			Usage: "IPv4 network of the virtual addresses",
+			Value: dnsproxy.DefaultVirtualNetwork,
+		},
+	},
+	Action: transproxyAction,
+}
+
+func transproxyAction(ctx context.Context, cmd *cli.Command) (err error) {
+	node, err := newNode(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	virtual, err := dnsproxy.NewVirtualNetwork(cmd.String(TransproxyVirtualNetworkFlag))
+	if err != nil {
+		return err
+	}
+
+	dnsServer, closeDNS := newDNSServer(node, virtual)
+	defer closeDNS()
+
+	l, err := net.Listen("tcp", cmd.String(TransproxyAddressFlag))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer l.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		log.Printf("[*] DNS resolver listening at %s", cmd.String(TransproxyDNSFlag))
+		errCh <- dnsServer.ListenAndServe(cmd.String(TransproxyDNSFlag))
+	}()
+	go func() {
+		log.Printf("[*] Transparent proxy listening at %s", l.Addr())
+		server := transproxy.Server{Dial: node.Service.DialContext, Virtual: virtual}
+		errCh <- server.Serve(l)
+	}()
+	return <-errCh
+}
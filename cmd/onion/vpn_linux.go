@@ -0,0 +1,138 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/RogueTeam/onion/net/tun"
+	"github.com/RogueTeam/onion/net/vpn"
+	"github.com/libp2p/go-libp2p"
+	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	VPNDeviceFlag = "device"
+	VPNRouteFlag  = "route"
+	VPNMTUFlag    = "mtu"
+	VPNMarkFlag   = "mark"
+
+	// Firewall mark of the sockets of the node. "on" in ASCII
+	DefaultVPNMark = 0x6f6e
+)
+
+func init() {
+	app.Commands = append(app.Commands, vpnCommand)
+}
+
+var vpnCommand = &cli.Command{
+	Name:  "vpn",
+	Usage: "Routes the IP traffic of a TUN device through exit circuits. TCP and UDP flows are relayed",
+	Description: "The sockets of the node are marked so its own traffic to the relays skips the device. " +
+		"Otherwise it would be routed back into the circuits and the node would never reach the network. " +
+		"Route everything else through the device with a policy routing table, like with the default MARK:\n\n" +
+		"   ip link set DEVICE up\n" +
+		"   ip route add default dev DEVICE table 28526\n" +
+		"   ip rule add not fwmark 28526 table 28526\n" +
+		"   ip rule add table main suppress_prefixlength 0\n\n" +
+		"Repeat the routes and the rules with ip -6 for IPv6. Bootstrap peers should be IP multiaddrs, " +
+		"since the names of dns multiaddrs are resolved without the mark",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  VPNDeviceFlag,
+			Usage: "Name of the TUN device",
+			Value: "onion0",
+		},
+		&cli.StringSliceFlag{
+			Name:  VPNRouteFlag,
+			Usage: "Networks routed through the circuits. Packets to other destinations are dropped",
+			Value: []string{"0.0.0.0/0", "::/0"},
+		},
+		&cli.IntFlag{
+			Name:  VPNMTUFlag,
+			Usage: "MTU of the device",
+			Value: vpn.DefaultMTU,
+		},
+		&cli.IntFlag{
+			Name:  VPNMarkFlag,
+			Usage: "Firewall mark of the sockets of the node. Traffic with it should skip the device",
+			Value: DefaultVPNMark,
+		},
+	},
+	Action: vpnAction,
+}
+
+func vpnAction(ctx context.Context, cmd *cli.Command) (err error) {
+	var routes []*net.IPNet
+	for _, cidr := range cmd.StringSlice(VPNRouteFlag) {
+		_, route, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("failed to parse route: %w", err)
+		}
+		routes = append(routes, route)
+	}
+
+	node, err := newNode(ctx, cmd, markedTransports(int(cmd.Int(VPNMarkFlag)))...)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	dev, err := tun.Open(cmd.String(VPNDeviceFlag))
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	log.Printf("[*] Routing traffic of %s", dev.Name)
+	router := vpn.Router{
+		Device: dev,
+		Dial:   node.Service.DialContext,
+		Routes: routes,
+		MTU:    int(cmd.Int(VPNMTUFlag)),
+	}
+	return router.Serve()
+}
+
+// TCP and QUIC transports whose sockets carry the firewall mark
+func markedTransports(mark int) (options []libp2p.Option) {
+	control := func(network, address string, conn syscall.RawConn) (err error) {
+		var markErr error
+		err = conn.Control(func(fd uintptr) {
+			markErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		if markErr != nil {
+			return fmt.Errorf("failed to mark socket: %w", markErr)
+		}
+		return nil
+	}
+
+	dialer := &net.Dialer{Control: control}
+	listenUDP := func(network string, laddr *net.UDPAddr) (conn net.PacketConn, err error) {
+		config := net.ListenConfig{Control: control}
+		address := ""
+		if laddr != nil {
+			address = laddr.String()
+		}
+		return config.ListenPacket(context.Background(), network, address)
+	}
+
+	return []libp2p.Option{
+		libp2p.Transport(tcp.NewTCPTransport, tcp.WithDialerForAddr(func(raddr multiaddr.Multiaddr) (d tcp.ContextDialer, err error) {
+			return dialer, nil
+		})),
+		libp2p.Transport(libp2pquic.NewTransport),
+		libp2p.QUICReuse(quicreuse.NewConnManager, quicreuse.OverrideListenUDP(listenUDP)),
+	}
+}
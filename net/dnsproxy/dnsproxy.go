@@ -0,0 +1,212 @@
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultTimeout = 30 * time.Second
+	// TTL of the answers with virtual addresses
+	VirtualTTL = time.Minute
+	// Time hosts that don't exist are cached
+	NegativeTTL = 30 * time.Second
+	// Maximum number of cached answers
+	MaxCacheEntries = 4096
+)
+
+// Returned by LookupFunc for hosts that don't exist
+var ErrNotFound = errors.New("host not found")
+
+// Resolves the host. Network is ip4 or ip6. Returns the time the addresses can be cached
+type LookupFunc func(ctx context.Context, network, host string) (ips []net.IP, ttl time.Duration, err error)
+
+type cachedAnswer struct {
+	IPs      []net.IP
+	NotFound bool
+	Expiry   time.Time
+}
+
+// DNS server answering A and AAAA queries with Lookup. Answers are cached for their TTL.
+// Names ending with VirtualSuffix are answered with addresses of the Virtual network
+type Server struct {
+	Lookup LookupFunc
+	// Suffix of the names mapped to virtual addresses. Like .onionp2p
+	VirtualSuffix string
+	// Nil answers the names of the suffix with NXDOMAIN
+	Virtual *VirtualNetwork
+	// Maximum duration of each lookup. Zero means DefaultTimeout
+	Timeout time.Duration
+
+	mutex sync.Mutex
+	cache map[string]cachedAnswer
+}
+
+// Serves UDP and TCP queries at the address until one of the listeners fails
+func (s *Server) ListenAndServe(address string) (err error) {
+	udp := &dns.Server{Addr: address, Net: "udp", Handler: s}
+	tcp := &dns.Server{Addr: address, Net: "tcp", Handler: s}
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- udp.ListenAndServe() }()
+	go func() { errCh <- tcp.ListenAndServe() }()
+
+	err = <-errCh
+	udp.Shutdown()
+	tcp.Shutdown()
+	return fmt.Errorf("failed to serve dns: %w", err)
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	res := s.answer(req)
+	w.WriteMsg(res)
+}
+
+func (s *Server) answer(req *dns.Msg) (res *dns.Msg) {
+	res = new(dns.Msg).SetReply(req)
+	res.RecursionAvailable = true
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		res.Rcode = dns.RcodeNotImplemented
+		return res
+	}
+	question := req.Question[0]
+	if question.Qclass != dns.ClassINET {
+		res.Rcode = dns.RcodeNotImplemented
+		return res
+	}
+
+	var network string
+	switch question.Qtype {
+	case dns.TypeA:
+		network = "ip4"
+	case dns.TypeAAAA:
+		network = "ip6"
+	default:
+		res.Rcode = dns.RcodeNotImplemented
+		return res
+	}
+
+	host := normalizeName(question.Name)
+	if s.VirtualSuffix != "" && strings.HasSuffix(host, s.VirtualSuffix) {
+		return s.answerVirtual(res, question, host)
+	}
+
+	ips, ttl, err := s.resolve(network, host)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		res.Rcode = dns.RcodeNameError
+		return res
+	case err != nil:
+		res.Rcode = dns.RcodeServerFailure
+		return res
+	}
+
+	for _, ip := range ips {
+		res.Answer = append(res.Answer, newRecord(question, ip, ttl))
+	}
+	return res
+}
+
+// Virtual networks are IPv4 only. AAAA queries get no records
+func (s *Server) answerVirtual(res *dns.Msg, question dns.Question, host string) (answered *dns.Msg) {
+	if s.Virtual == nil {
+		res.Rcode = dns.RcodeNameError
+		return res
+	}
+	if question.Qtype != dns.TypeA {
+		return res
+	}
+
+	ip, err := s.Virtual.Map(host)
+	if err != nil {
+		res.Rcode = dns.RcodeServerFailure
+		return res
+	}
+	res.Answer = append(res.Answer, newRecord(question, ip, VirtualTTL))
+	return res
+}
+
+func newRecord(question dns.Question, ip net.IP, ttl time.Duration) (rr dns.RR) {
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(max(ttl/time.Second, 1)),
+	}
+	if question.Qtype == dns.TypeA {
+		return &dns.A{Hdr: header, A: ip.To4()}
+	}
+	return &dns.AAAA{Hdr: header, AAAA: ip.To16()}
+}
+
+// Resolves the host using the cache. Returns the remaining time of the answer
+func (s *Server) resolve(network, host string) (ips []net.IP, ttl time.Duration, err error) {
+	key := network + "/" + host
+
+	s.mutex.Lock()
+	entry, found := s.cache[key]
+	s.mutex.Unlock()
+	if found {
+		ttl = time.Until(entry.Expiry)
+		if ttl > 0 {
+			if entry.NotFound {
+				return nil, 0, ErrNotFound
+			}
+			return entry.IPs, ttl, nil
+		}
+	}
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ips, ttl, err = s.Lookup(ctx, network, host)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		s.store(key, cachedAnswer{NotFound: true, Expiry: time.Now().Add(NegativeTTL)})
+		return nil, 0, err
+	case err != nil:
+		return nil, 0, fmt.Errorf("failed to lookup host: %w", err)
+	}
+
+	// Exits resolving with ip may return addresses of both families
+	var filtered []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (network == "ip4") {
+			filtered = append(filtered, ip)
+		}
+	}
+	s.store(key, cachedAnswer{IPs: filtered, Expiry: time.Now().Add(ttl)})
+	return filtered, ttl, nil
+}
+
+func (s *Server) store(key string, entry cachedAnswer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cache == nil {
+		s.cache = make(map[string]cachedAnswer)
+	}
+	if len(s.cache) >= MaxCacheEntries {
+		now := time.Now()
+		for key, entry := range s.cache {
+			if now.After(entry.Expiry) {
+				delete(s.cache, key)
+			}
+		}
+	}
+	if len(s.cache) < MaxCacheEntries {
+		s.cache[key] = entry
+	}
+}
@@ -0,0 +1,123 @@
+package dnsproxy_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RogueTeam/onion/net/dnsproxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Serves the server at a random UDP port of the loopback
+func serve(t *testing.T, server *dnsproxy.Server) (address string) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	dnsServer := &dns.Server{PacketConn: packetConn, Handler: server, NotifyStartedFunc: func() { close(started) }}
+	go dnsServer.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { dnsServer.Shutdown() })
+
+	return packetConn.LocalAddr().String()
+}
+
+func query(address, name string, qtype uint16) (res *dns.Msg, err error) {
+	req := new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype)
+	return dns.Exchange(req, address)
+}
+
+func Test_Server(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		var lookups atomic.Int64
+		virtual, err := dnsproxy.NewVirtualNetwork(dnsproxy.DefaultVirtualNetwork)
+		if !assertions.Nil(err, "failed to prepare network") {
+			return
+		}
+		server := dnsproxy.Server{
+			Lookup: func(ctx context.Context, network, host string) (ips []net.IP, ttl time.Duration, err error) {
+				lookups.Add(1)
+				return []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")}, time.Hour, nil
+			},
+			VirtualSuffix: ".onionp2p",
+			Virtual:       virtual,
+		}
+		address := serve(t, &server)
+
+		for range 2 {
+			res, err := query(address, "example.com", dns.TypeA)
+			if !assertions.Nil(err, "failed to query") {
+				return
+			}
+			assertions.Equal(dns.RcodeSuccess, res.Rcode, "expecting success")
+			if !assertions.Len(res.Answer, 1, "expecting IPv4 answer") {
+				return
+			}
+			record := res.Answer[0].(*dns.A)
+			assertions.True(record.A.Equal(net.IPv4(192, 0, 2, 1)), "expecting resolved address")
+			assertions.LessOrEqual(record.Hdr.Ttl, uint32(3600), "expecting ttl of the lookup")
+		}
+		assertions.Equal(int64(1), lookups.Load(), "expecting cached answer")
+
+		res, err := query(address, "example.com", dns.TypeAAAA)
+		if !assertions.Nil(err, "failed to query") {
+			return
+		}
+		if assertions.Len(res.Answer, 1, "expecting IPv6 answer") {
+			assertions.True(res.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::1")), "expecting resolved address")
+		}
+
+		res, err = query(address, "shop.onionp2p", dns.TypeA)
+		if !assertions.Nil(err, "failed to query") {
+			return
+		}
+		if assertions.Len(res.Answer, 1, "expecting virtual answer") {
+			ip := res.Answer[0].(*dns.A).A
+			assertions.True(virtual.Contains(ip), "expecting virtual address")
+			name, found := virtual.Lookup(ip)
+			assertions.True(found, "expecting mapped address")
+			assertions.Equal("shop.onionp2p", name, "expecting name")
+		}
+		assertions.Equal(int64(2), lookups.Load(), "expecting no lookup of virtual names")
+	})
+	t.Run("Fail", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		server := dnsproxy.Server{
+			Lookup: func(ctx context.Context, network, host string) (ips []net.IP, ttl time.Duration, err error) {
+				if host == "missing.com" {
+					return nil, 0, dnsproxy.ErrNotFound
+				}
+				return nil, 0, errors.New("unreachable")
+			},
+			VirtualSuffix: ".onionp2p",
+		}
+		address := serve(t, &server)
+
+		for _, test := range []struct {
+			Name  string
+			Type  uint16
+			Rcode int
+		}{
+			{Name: "missing.com", Type: dns.TypeA, Rcode: dns.RcodeNameError},
+			{Name: "example.com", Type: dns.TypeA, Rcode: dns.RcodeServerFailure},
+			{Name: "example.com", Type: dns.TypeMX, Rcode: dns.RcodeNotImplemented},
+			{Name: "shop.onionp2p", Type: dns.TypeA, Rcode: dns.RcodeNameError},
+		} {
+			res, err := query(address, test.Name, test.Type)
+			if !assertions.Nil(err, "failed to query") {
+				return
+			}
+			assertions.Equal(test.Rcode, res.Rcode, "expecting rcode of %s", test.Name)
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Same range Tor uses for its virtual addresses
+const DefaultVirtualNetwork = "10.192.0.0/10"
+
+var ErrVirtualNetworkExhausted = errors.New("virtual network exhausted")
+
+// Maps names to synthetic IPv4 addresses of a network. Connections to those addresses
+// can later be translated back to the name. Like the ones redirected to a transparent proxy
+type VirtualNetwork struct {
+	Network *net.IPNet
+
+	mutex  sync.Mutex
+	next   uint32
+	byName map[string]net.IP
+	byIP   map[string]string
+}
+
+func NewVirtualNetwork(cidr string) (v *VirtualNetwork, err error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network: %w", err)
+	}
+	if network.IP.To4() == nil {
+		return nil, errors.New("virtual network must be IPv4")
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones < 2 {
+		return nil, errors.New("virtual network too small")
+	}
+
+	v = &VirtualNetwork{
+		Network: network,
+		next:    1,
+		byName:  make(map[string]net.IP),
+		byIP:    make(map[string]string),
+	}
+	return v, nil
+}
+
+func normalizeName(name string) (normalized string) {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Returns the address of the name. Allocating a new one on first use
+func (v *VirtualNetwork) Map(name string) (ip net.IP, err error) {
+	name = normalizeName(name)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	ip, found := v.byName[name]
+	if found {
+		return ip, nil
+	}
+
+	ones, bits := v.Network.Mask.Size()
+	// Network and broadcast addresses are never used
+	if uint64(v.next) >= uint64(1)<<(bits-ones)-1 {
+		return nil, ErrVirtualNetworkExhausted
+	}
+
+	base := binary.BigEndian.Uint32(v.Network.IP.To4())
+	ip = binary.BigEndian.AppendUint32(nil, base+v.next)
+	v.next++
+
+	v.byName[name] = ip
+	v.byIP[ip.String()] = name
+	return ip, nil
+}
+
+// Returns the name mapped to the address
+func (v *VirtualNetwork) Lookup(ip net.IP) (name string, found bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	name, found = v.byIP[ip.String()]
+	return name, found
+}
+
+func (v *VirtualNetwork) Contains(ip net.IP) (contains bool) {
+	return v.Network.Contains(ip)
+}
@@ -0,0 +1,62 @@
+package dnsproxy_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/RogueTeam/onion/net/dnsproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_VirtualNetwork(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		virtual, err := dnsproxy.NewVirtualNetwork(dnsproxy.DefaultVirtualNetwork)
+		if !assertions.Nil(err, "failed to prepare network") {
+			return
+		}
+
+		first, err := virtual.Map("shop.onionp2p")
+		assertions.Nil(err, "failed to map name")
+		assertions.True(virtual.Contains(first), "expecting address of the network")
+
+		again, err := virtual.Map("SHOP.onionp2p.")
+		assertions.Nil(err, "failed to map name")
+		assertions.Equal(first, again, "expecting same address")
+
+		second, err := virtual.Map("blog.onionp2p")
+		assertions.Nil(err, "failed to map name")
+		assertions.NotEqual(first, second, "expecting different address")
+
+		name, found := virtual.Lookup(second)
+		assertions.True(found, "expecting mapped address")
+		assertions.Equal("blog.onionp2p", name, "expecting name")
+
+		_, found = virtual.Lookup(net.IPv4(10, 200, 0, 1))
+		assertions.False(found, "expecting unmapped address")
+	})
+	t.Run("Exhausted", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		virtual, err := dnsproxy.NewVirtualNetwork("10.0.0.0/30")
+		if !assertions.Nil(err, "failed to prepare network") {
+			return
+		}
+
+		for _, name := range []string{"a", "b"} {
+			_, err = virtual.Map(name)
+			assertions.Nil(err, "failed to map name")
+		}
+		_, err = virtual.Map("c")
+		assertions.ErrorIs(err, dnsproxy.ErrVirtualNetworkExhausted, "expecting exhausted network")
+	})
+	t.Run("Fail", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		for _, cidr := range []string{"invalid", "fd00::/64", "10.0.0.0/31"} {
+			_, err := dnsproxy.NewVirtualNetwork(cidr)
+			assertions.NotNil(err, "expecting invalid network: %s", cidr)
+		}
+	})
+}
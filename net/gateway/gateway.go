@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultPort = 80
+	// Clients tracked by the rate limiter
+	MaxClients = 65536
+	// Time without requests after which the limiter of a client is forgotten
+	ClientIdleTimeout = 10 * time.Minute
+)
+
+// Same signature as net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (conn net.Conn, err error)
+
+// HTTP gateway exposing hidden services to clients outside the network. Like tor2web.
+// The hidden host of each request is taken from its Host header:
+//
+//   - Hostnames of Hosts are mapped to their hidden hosts or names
+//   - HIDDEN.Domain reaches HIDDEN plus Suffix
+//   - Hosts ending with Suffix are reached as they are
+//
+// Requests are never dialed to hosts outside the network
+type Server struct {
+	// Dials the hidden hosts in host:port form
+	Dial DialFunc
+	// Suffix of the hidden hosts. Like .onionp2p
+	Suffix string
+	// Domain of the gateway. Empty disables the subdomains
+	Domain string
+	// Hostnames mapped to hidden hosts
+	Hosts map[string]string
+	// Hidden hosts allowed. Nil allows every host
+	Allow []string
+	// Port of the hidden services. Zero means DefaultPort
+	Port uint16
+	// Requests per second of each client IP. Zero disables the limit
+	RateLimit rate.Limit
+	// Requests a client can burst above RateLimit
+	Burst int
+
+	once     sync.Once
+	proxy    *httputil.ReverseProxy
+	allowed  map[string]struct{}
+	mutex    sync.Mutex
+	limiters map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	Limiter  *rate.Limiter
+	LastSeen time.Time
+}
+
+func (s *Server) init() {
+	s.once.Do(func() {
+		if s.Allow != nil {
+			s.allowed = make(map[string]struct{}, len(s.Allow))
+			for _, host := range s.Allow {
+				s.allowed[normalizeHost(host)] = struct{}{}
+			}
+		}
+		s.limiters = make(map[string]*clientLimiter)
+
+		transport := &http.Transport{
+			DialContext:         s.Dial,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     time.Minute,
+		}
+		s.proxy = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				target := hiddenTarget(pr.In.Context())
+				pr.SetURL(&url.URL{Scheme: "http", Host: target})
+				// Default ports are omitted in the Host header
+				pr.Out.Host = strings.TrimSuffix(target, ":80")
+			},
+			Transport: transport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				http.Error(w, "hidden service unreachable", http.StatusBadGateway)
+			},
+		}
+	})
+}
+
+type targetKey struct{}
+
+func hiddenTarget(ctx context.Context) (target string) {
+	target, _ = ctx.Value(targetKey{}).(string)
+	return target
+}
+
+func normalizeHost(host string) (normalized string) {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Hidden host of the requested hostname
+func (s *Server) Resolve(hostname string) (hidden string, found bool) {
+	hostname = normalizeHost(hostname)
+
+	for name, target := range s.Hosts {
+		if normalizeHost(name) != hostname {
+			continue
+		}
+		// Registered names can be mapped without the suffix
+		target = normalizeHost(target)
+		if !strings.HasSuffix(target, s.Suffix) {
+			target += s.Suffix
+		}
+		return target, true
+	}
+
+	if s.Domain != "" {
+		label, isSubdomain := strings.CutSuffix(hostname, "."+normalizeHost(s.Domain))
+		if isSubdomain && label != "" && !strings.Contains(label, ".") {
+			return label + s.Suffix, true
+		}
+	}
+
+	if s.Suffix != "" && strings.HasSuffix(hostname, s.Suffix) && hostname != strings.TrimPrefix(s.Suffix, ".") {
+		return hostname, true
+	}
+	return "", false
+}
+
+// Checks the allowlist
+func (s *Server) Allowed(hidden string) (allowed bool) {
+	s.init()
+
+	if s.allowed == nil {
+		return true
+	}
+	_, allowed = s.allowed[normalizeHost(hidden)]
+	return allowed
+}
+
+// Consumes a request of the client. Returns false when the client exceeded its rate
+func (s *Server) take(remoteAddr string) (allowed bool) {
+	if s.RateLimit == 0 {
+		return true
+	}
+
+	client, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		client = remoteAddr
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	limiter, found := s.limiters[client]
+	if !found {
+		if len(s.limiters) >= MaxClients {
+			for key, limiter := range s.limiters {
+				if now.Sub(limiter.LastSeen) > ClientIdleTimeout {
+					delete(s.limiters, key)
+				}
+			}
+		}
+		if len(s.limiters) >= MaxClients {
+			return false
+		}
+		limiter = &clientLimiter{Limiter: rate.NewLimiter(s.RateLimit, max(s.Burst, 1))}
+		s.limiters[client] = limiter
+	}
+	limiter.LastSeen = now
+	return limiter.Limiter.AllowN(now, 1)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+
+	if !s.take(r.RemoteAddr) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	hostname, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		hostname = r.Host
+	}
+	hidden, found := s.Resolve(hostname)
+	if !found {
+		http.Error(w, "unknown hidden service", http.StatusNotFound)
+		return
+	}
+	if !s.Allowed(hidden) {
+		http.Error(w, "hidden service not allowed", http.StatusForbidden)
+		return
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	target := net.JoinHostPort(hidden, strconv.Itoa(int(port)))
+	s.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), targetKey{}, target)))
+}
@@ -0,0 +1,115 @@
+package gateway_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/RogueTeam/onion/net/gateway"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Server(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	var (
+		dialer net.Dialer
+		mutex  sync.Mutex
+		dialed []string
+	)
+	dial := func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+		mutex.Lock()
+		dialed = append(dialed, address)
+		mutex.Unlock()
+		return dialer.DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+
+	get := func(t *testing.T, server *gateway.Server, host string) (status int, body string) {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/index.html", nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		return res.Code, res.Body.String()
+	}
+
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		server := gateway.Server{
+			Dial:   dial,
+			Suffix: ".onionp2p",
+			Domain: "gateway.test",
+			Hosts: map[string]string{
+				"blog.example.com": "blog",
+			},
+		}
+
+		for _, test := range []struct {
+			Host   string
+			Hidden string
+		}{
+			{Host: "shop.gateway.test", Hidden: "shop.onionp2p"},
+			{Host: "BLOG.example.com:8080", Hidden: "blog.onionp2p"},
+			{Host: "wiki.onionp2p", Hidden: "wiki.onionp2p"},
+		} {
+			status, body := get(t, &server, test.Host)
+			assertions.Equal(http.StatusOK, status, "expecting success for %s", test.Host)
+			assertions.Equal(test.Hidden+"/index.html", body, "expecting hidden host as Host")
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		assertions.Equal([]string{"shop.onionp2p:80", "blog.onionp2p:80", "wiki.onionp2p:80"}, dialed, "expecting hidden hosts dialed")
+		dialed = nil
+	})
+	t.Run("Fail", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		server := gateway.Server{
+			Dial:   dial,
+			Suffix: ".onionp2p",
+			Domain: "gateway.test",
+			Allow:  []string{"shop.onionp2p"},
+		}
+
+		for _, test := range []struct {
+			Host   string
+			Status int
+		}{
+			{Host: "example.com", Status: http.StatusNotFound},
+			{Host: "a.b.gateway.test", Status: http.StatusNotFound},
+			{Host: "onionp2p", Status: http.StatusNotFound},
+			{Host: "blog.gateway.test", Status: http.StatusForbidden},
+		} {
+			status, _ := get(t, &server, test.Host)
+			assertions.Equal(test.Status, status, "expecting status for %s", test.Host)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		assertions.Empty(dialed, "expecting nothing dialed")
+	})
+	t.Run("Rate limit", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		server := gateway.Server{
+			Dial:      dial,
+			Suffix:    ".onionp2p",
+			RateLimit: 1,
+			Burst:     2,
+		}
+
+		var statuses []int
+		for range 3 {
+			status, _ := get(t, &server, "shop.onionp2p")
+			statuses = append(statuses, status)
+		}
+		assertions.Equal([]int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, statuses, "expecting burst then limit")
+	})
+}
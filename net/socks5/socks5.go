@@ -0,0 +1,291 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const Version = 0x05
+
+const (
+	MethodNoAuth       = 0x00
+	MethodNoAcceptable = 0xFF
+)
+
+const (
+	CommandConnect      = 0x01
+	CommandBind         = 0x02
+	CommandUDPAssociate = 0x03
+)
+
+const (
+	AddressIPv4   = 0x01
+	AddressDomain = 0x03
+	AddressIPv6   = 0x04
+)
+
+const (
+	ReplySucceeded               = 0x00
+	ReplyGeneralFailure          = 0x01
+	ReplyNotAllowed              = 0x02
+	ReplyNetworkUnreachable      = 0x03
+	ReplyHostUnreachable         = 0x04
+	ReplyConnectionRefused       = 0x05
+	ReplyTTLExpired              = 0x06
+	ReplyCommandNotSupported     = 0x07
+	ReplyAddressTypeNotSupported = 0x08
+)
+
+const DefaultHandshakeTimeout = 30 * time.Second
+
+// Same signature as net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (conn net.Conn, err error)
+
+// SOCKS5 server without authentication. Supports the CONNECT and UDP ASSOCIATE commands.
+// Domain names are passed as they are to Dial. Letting it resolve them remotely
+type Server struct {
+	// Dials the requested destinations
+	Dial DialFunc
+	// Maximum duration of the negotiation. Zero means DefaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+}
+
+// Serves the connections of the listener until it fails
+func (s *Server) Serve(l net.Listener) (err error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		go func() {
+			err := s.ServeConn(conn)
+			if err != nil {
+				log.Printf("failed to serve socks connection: %v", err)
+			}
+		}()
+	}
+}
+
+// Serves a single client. The connection is closed on return
+func (s *Server) ServeConn(conn net.Conn) (err error) {
+	defer conn.Close()
+
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	err = negotiate(conn)
+	if err != nil {
+		return err
+	}
+
+	command, address, err := ReadRequest(conn)
+	if err != nil {
+		if errors.Is(err, ErrAddressTypeNotSupported) {
+			WriteReply(conn, ReplyAddressTypeNotSupported, nil)
+		}
+		return err
+	}
+	switch command {
+	case CommandConnect:
+		return s.connect(conn, address, timeout)
+	case CommandUDPAssociate:
+		return s.udpAssociate(conn, timeout)
+	default:
+		WriteReply(conn, ReplyCommandNotSupported, nil)
+		return fmt.Errorf("unsupported command: %d", command)
+	}
+}
+
+// Pipes the connection with the dialed destination
+func (s *Server) connect(conn net.Conn, address string, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	remote, err := s.Dial(ctx, "tcp", address)
+	if err != nil {
+		WriteReply(conn, ReplyHostUnreachable, nil)
+		return fmt.Errorf("failed to dial: %s: %w", address, err)
+	}
+	defer remote.Close()
+
+	err = WriteReply(conn, ReplySucceeded, nil)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+	io.Copy(conn, remote)
+	return nil
+}
+
+// Reads the greeting and selects the no authentication method
+func negotiate(conn net.Conn) (err error) {
+	var header [2]byte
+	_, err = io.ReadFull(conn, header[:])
+	if err != nil {
+		return fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != Version {
+		return fmt.Errorf("unsupported version: %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return fmt.Errorf("failed to read methods: %w", err)
+	}
+
+	for _, method := range methods {
+		if method == MethodNoAuth {
+			_, err = conn.Write([]byte{Version, MethodNoAuth})
+			if err != nil {
+				return fmt.Errorf("failed to write method: %w", err)
+			}
+			return nil
+		}
+	}
+	conn.Write([]byte{Version, MethodNoAcceptable})
+	return errors.New("no acceptable authentication method")
+}
+
+var ErrAddressTypeNotSupported = errors.New("address type not supported")
+
+// Reads a request returning its command and its destination in host:port form
+func ReadRequest(r io.Reader) (command byte, address string, err error) {
+	var header [3]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read request: %w", err)
+	}
+	if header[0] != Version {
+		return 0, "", fmt.Errorf("unsupported version: %d", header[0])
+	}
+
+	address, err = ReadAddress(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return header[1], address, nil
+}
+
+// Reads an address in its ATYP, ADDR, PORT form. Returns it in host:port form
+func ReadAddress(r io.Reader) (address string, err error) {
+	var kind [1]byte
+	_, err = io.ReadFull(r, kind[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to read address type: %w", err)
+	}
+
+	var host string
+	switch kind[0] {
+	case AddressIPv4, AddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if kind[0] == AddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(r, ip)
+		if err != nil {
+			return "", fmt.Errorf("failed to read ip: %w", err)
+		}
+		host = ip.String()
+	case AddressDomain:
+		var length [1]byte
+		_, err = io.ReadFull(r, length[:])
+		if err != nil {
+			return "", fmt.Errorf("failed to read domain length: %w", err)
+		}
+		domain := make([]byte, length[0])
+		_, err = io.ReadFull(r, domain)
+		if err != nil {
+			return "", fmt.Errorf("failed to read domain: %w", err)
+		}
+		host = string(domain)
+	default:
+		return "", ErrAddressTypeNotSupported
+	}
+
+	var port [2]byte
+	_, err = io.ReadFull(r, port[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to read port: %w", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// Appends the address in its ATYP, ADDR, PORT form. Nil addresses are written as 0.0.0.0:0
+func AppendAddress(b []byte, addr net.Addr) (result []byte, err error) {
+	var (
+		ip   = net.IPv4zero
+		port int
+	)
+	switch addr := addr.(type) {
+	case nil:
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	default:
+		return nil, fmt.Errorf("unsupported address: %s", addr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, AddressIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, AddressIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// Appends the host:port address in its ATYP, ADDR, PORT form. Hosts other than IPs are written as domains
+func AppendHostPort(b []byte, address string) (result []byte, err error) {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split address: %w", err)
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil:
+		return AppendAddress(b, &net.UDPAddr{IP: ip, Port: int(port)})
+	case len(host) > 255:
+		return nil, fmt.Errorf("domain too long: %s", host)
+	default:
+		b = append(b, AddressDomain, byte(len(host)))
+		b = append(b, host...)
+		return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+	}
+}
+
+// Writes a reply with the bound address
+func WriteReply(w io.Writer, reply byte, bound net.Addr) (err error) {
+	b, err := AppendAddress([]byte{Version, reply, 0x00}, bound)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return fmt.Errorf("failed to write reply: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package socks5_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RogueTeam/onion/net/socks5"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/proxy"
+)
+
+func Test_Server(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		echo, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assertions.Nil(err, "failed to listen echo") {
+			return
+		}
+		defer echo.Close()
+		go func() {
+			for {
+				conn, err := echo.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		var (
+			dialer    net.Dialer
+			mutex     sync.Mutex
+			requested []string
+		)
+		server := socks5.Server{
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				mutex.Lock()
+				requested = append(requested, address)
+				mutex.Unlock()
+				_, port, _ := net.SplitHostPort(address)
+				return dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+			},
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assertions.Nil(err, "failed to listen socks") {
+			return
+		}
+		defer l.Close()
+		go server.Serve(l)
+
+		client, err := proxy.SOCKS5("tcp", l.Addr().String(), nil, proxy.Direct)
+		if !assertions.Nil(err, "failed to prepare client") {
+			return
+		}
+
+		_, port, _ := net.SplitHostPort(echo.Addr().String())
+		for _, host := range []string{"127.0.0.1", "::1", "example.onionp2p"} {
+			conn, err := client.Dial("tcp", net.JoinHostPort(host, port))
+			if !assertions.Nil(err, "failed to dial through proxy") {
+				return
+			}
+
+			payload := []byte("HELLO")
+			_, err = conn.Write(payload)
+			assertions.Nil(err, "failed to write payload")
+
+			received := make([]byte, len(payload))
+			_, err = io.ReadFull(conn, received)
+			assertions.Nil(err, "failed to read payload")
+			assertions.Equal(payload, received, "expecting echo")
+			conn.Close()
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		assertions.Equal([]string{
+			net.JoinHostPort("127.0.0.1", port),
+			net.JoinHostPort("::1", port),
+			net.JoinHostPort("example.onionp2p", port),
+		}, requested, "expecting destinations passed as they are")
+	})
+	t.Run("UDP Associate", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if !assertions.Nil(err, "failed to listen echo") {
+			return
+		}
+		defer echo.Close()
+		go func() {
+			buffer := make([]byte, socks5.MaxDatagramSize)
+			for {
+				n, source, err := echo.ReadFromUDP(buffer)
+				if err != nil {
+					return
+				}
+				echo.WriteToUDP(buffer[:n], source)
+			}
+		}()
+
+		var dialer net.Dialer
+		dialed := make(chan net.Conn, 2)
+		server := socks5.Server{
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				_, port, _ := net.SplitHostPort(address)
+				conn, err = dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+				if err == nil {
+					dialed <- conn
+				}
+				return conn, err
+			},
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assertions.Nil(err, "failed to listen socks") {
+			return
+		}
+		defer l.Close()
+		go server.Serve(l)
+
+		control, err := net.Dial("tcp", l.Addr().String())
+		if !assertions.Nil(err, "failed to dial socks") {
+			return
+		}
+		defer control.Close()
+
+		_, err = control.Write([]byte{socks5.Version, 1, socks5.MethodNoAuth})
+		assertions.Nil(err, "failed to write greeting")
+		method := make([]byte, 2)
+		_, err = io.ReadFull(control, method)
+		assertions.Nil(err, "failed to read method")
+		assertions.Equal([]byte{socks5.Version, socks5.MethodNoAuth}, method, "expecting no auth")
+
+		request, err := socks5.AppendAddress([]byte{socks5.Version, socks5.CommandUDPAssociate, 0x00}, nil)
+		assertions.Nil(err, "failed to build request")
+		_, err = control.Write(request)
+		assertions.Nil(err, "failed to write request")
+
+		reply := make([]byte, 3)
+		_, err = io.ReadFull(control, reply)
+		assertions.Nil(err, "failed to read reply")
+		assertions.Equal(byte(socks5.ReplySucceeded), reply[1], "expecting success")
+		bound, err := socks5.ReadAddress(control)
+		if !assertions.Nil(err, "failed to read bound address") {
+			return
+		}
+
+		client, err := net.Dial("udp", bound)
+		if !assertions.Nil(err, "failed to dial association") {
+			return
+		}
+		defer client.Close()
+
+		_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+		destination := net.JoinHostPort("example.onionp2p", port)
+		payload := []byte("HELLO")
+		datagram, err := socks5.AppendDatagram(nil, destination, payload)
+		assertions.Nil(err, "failed to build datagram")
+		_, err = client.Write(datagram)
+		assertions.Nil(err, "failed to write datagram")
+
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buffer := make([]byte, socks5.MaxDatagramSize)
+		n, err := client.Read(buffer)
+		if !assertions.Nil(err, "failed to read datagram") {
+			return
+		}
+		source, received, err := socks5.ParseDatagram(buffer[:n])
+		assertions.Nil(err, "failed to parse datagram")
+		assertions.Equal(destination, source, "expecting destination as source")
+		assertions.Equal(payload, received, "expecting echo")
+
+		// Failed destinations are dialed again
+		(<-dialed).Close()
+		assertions.Eventually(func() bool {
+			_, err = client.Write(datagram)
+			assertions.Nil(err, "failed to write datagram")
+			return len(dialed) > 0
+		}, 10*time.Second, 100*time.Millisecond, "expecting destination dialed again")
+
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, err = client.Read(buffer)
+		if !assertions.Nil(err, "failed to read datagram") {
+			return
+		}
+		_, received, err = socks5.ParseDatagram(buffer[:n])
+		assertions.Nil(err, "failed to parse datagram")
+		assertions.Equal(payload, received, "expecting echo from the new destination")
+
+		fragmented := append([]byte{0x00, 0x00, 0x01}, datagram[3:]...)
+		_, _, err = socks5.ParseDatagram(fragmented)
+		assertions.ErrorIs(err, socks5.ErrFragmented, "expecting fragments rejected")
+	})
+	t.Run("Fail", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		server := socks5.Server{
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				return nil, errors.New("unreachable")
+			},
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assertions.Nil(err, "failed to listen socks") {
+			return
+		}
+		defer l.Close()
+		go server.Serve(l)
+
+		client, err := proxy.SOCKS5("tcp", l.Addr().String(), nil, proxy.Direct)
+		if !assertions.Nil(err, "failed to prepare client") {
+			return
+		}
+
+		_, err = client.Dial("tcp", "example.onionp2p:80")
+		assertions.NotNil(err, "expecting dial to fail")
+	})
+}
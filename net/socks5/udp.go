@@ -0,0 +1,198 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Maximum size of the datagrams relayed by UDP associations
+const MaxDatagramSize = 65507
+
+// Associates an UDP socket to the connection. Datagrams are only accepted from the client IP
+// and the association lasts until the connection is closed
+func (s *Server) udpAssociate(conn net.Conn, timeout time.Duration) (err error) {
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if local == nil || remote == nil {
+		WriteReply(conn, ReplyGeneralFailure, nil)
+		return errors.New("udp associate requires a tcp connection")
+	}
+
+	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		WriteReply(conn, ReplyGeneralFailure, nil)
+		return fmt.Errorf("failed to listen udp: %w", err)
+	}
+	defer packetConn.Close()
+
+	err = WriteReply(conn, ReplySucceeded, packetConn.LocalAddr())
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	association := udpAssociation{
+		Server:       s,
+		PacketConn:   packetConn,
+		ClientIP:     remote.IP,
+		Timeout:      timeout,
+		Destinations: make(map[string]net.Conn),
+	}
+	defer association.Close()
+
+	// The association terminates with the control connection
+	go func() {
+		io.Copy(io.Discard, conn)
+		packetConn.Close()
+	}()
+
+	association.Serve()
+	return nil
+}
+
+type udpAssociation struct {
+	Server     *Server
+	PacketConn *net.UDPConn
+	ClientIP   net.IP
+	Timeout    time.Duration
+
+	mutex        sync.Mutex
+	client       *net.UDPAddr
+	Destinations map[string]net.Conn
+}
+
+// Relays the datagrams of the client until the socket is closed
+func (a *udpAssociation) Serve() {
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, source, err := a.PacketConn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !source.IP.Equal(a.ClientIP) {
+			continue
+		}
+
+		address, payload, err := ParseDatagram(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		a.mutex.Lock()
+		a.client = source
+		a.mutex.Unlock()
+
+		destination, err := a.destination(address)
+		if err != nil {
+			continue
+		}
+		// Datagrams are unreliable. Failed writes are dropped
+		destination.Write(payload)
+	}
+}
+
+// Returns the connection of the destination. Dialing it on first use
+func (a *udpAssociation) destination(address string) (conn net.Conn, err error) {
+	a.mutex.Lock()
+	conn, found := a.Destinations[address]
+	a.mutex.Unlock()
+	if found {
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+	defer cancel()
+
+	conn, err = a.Server.Dial(ctx, "udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %s: %w", address, err)
+	}
+
+	a.mutex.Lock()
+	a.Destinations[address] = conn
+	a.mutex.Unlock()
+
+	go a.reply(conn, address)
+	return conn, nil
+}
+
+// Forwards the datagrams of the destination to the client.
+// Once the connection fails it is forgotten so the next datagram dials the destination again
+func (a *udpAssociation) reply(conn net.Conn, address string) {
+	defer a.forget(conn, address)
+
+	header, err := AppendHostPort([]byte{0x00, 0x00, 0x00}, address)
+	if err != nil {
+		return
+	}
+
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		a.mutex.Lock()
+		client := a.client
+		a.mutex.Unlock()
+
+		a.PacketConn.WriteToUDP(append(header[:len(header):len(header)], buffer[:n]...), client)
+	}
+}
+
+// Closes the connection and removes it from the destinations if still in use
+func (a *udpAssociation) forget(conn net.Conn, address string) {
+	conn.Close()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.Destinations[address] == conn {
+		delete(a.Destinations, address)
+	}
+}
+
+func (a *udpAssociation) Close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for address, conn := range a.Destinations {
+		conn.Close()
+		delete(a.Destinations, address)
+	}
+}
+
+var ErrFragmented = errors.New("fragmented datagrams are not supported")
+
+// Parses the UDP request header. Returns the destination in host:port form and the payload
+func ParseDatagram(datagram []byte) (address string, payload []byte, err error) {
+	if len(datagram) < 3 {
+		return "", nil, errors.New("datagram too short")
+	}
+	if datagram[2] != 0x00 {
+		return "", nil, ErrFragmented
+	}
+
+	r := bytes.NewReader(datagram[3:])
+	address, err = ReadAddress(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return address, datagram[len(datagram)-r.Len():], nil
+}
+
+// Builds the UDP request header followed by the payload
+func AppendDatagram(b []byte, address string, payload []byte) (result []byte, err error) {
+	b, err = AppendHostPort(append(b, 0x00, 0x00, 0x00), address)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
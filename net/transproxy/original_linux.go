@@ -0,0 +1,68 @@
+//go:build linux
+
+package transproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Same value for IPv4 and IPv6. From linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// Destination of a connection before being redirected by netfilter
+func OriginalDestination(conn net.Conn) (addr *net.TCPAddr, err error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a tcp connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw connection: %w", err)
+	}
+
+	isIPv6 := false
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		isIPv6 = true
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if isIPv6 {
+			// sockaddr_in6 fits in the IPv6MTUInfo returned by this getsockopt
+			var info *syscall.IPv6MTUInfo
+			info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			// The port is stored in network byte order
+			port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+			addr = &net.TCPAddr{
+				IP:   net.IP(info.Addr.Addr[:]),
+				Port: int(binary.BigEndian.Uint16(port)),
+			}
+			return
+		}
+
+		// sockaddr_in fits in the IPv6Mreq returned by this getsockopt
+		var mreq *syscall.IPv6Mreq
+		mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if sockErr != nil {
+			return
+		}
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+			Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to control connection: %w", err)
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("failed to get SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return addr, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package transproxy
+
+import "net"
+
+// Only supported on Linux
+func OriginalDestination(conn net.Conn) (addr *net.TCPAddr, err error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,103 @@
+package transproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/RogueTeam/onion/net/dnsproxy"
+)
+
+const DefaultDialTimeout = 30 * time.Second
+
+var ErrUnsupported = errors.New("transparent proxy not supported on this platform")
+
+// Same signature as net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (conn net.Conn, err error)
+
+// Transparent proxy of connections redirected by the firewall. Like iptables REDIRECT.
+// Connections to addresses of the Virtual network are dialed by their name
+type Server struct {
+	// Dials the original destinations
+	Dial DialFunc
+	// Nil dials every destination by its address
+	Virtual *dnsproxy.VirtualNetwork
+	// Recovers the destination of the redirected connection. Nil means OriginalDestination
+	Destination func(conn net.Conn) (addr *net.TCPAddr, err error)
+	// Zero means DefaultDialTimeout
+	DialTimeout time.Duration
+}
+
+// Serves the connections of the listener until it fails
+func (s *Server) Serve(l net.Listener) (err error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		go func() {
+			err := s.ServeConn(conn)
+			if err != nil {
+				log.Printf("failed to serve redirected connection: %v", err)
+			}
+		}()
+	}
+}
+
+// Pipes the connection with its original destination. The connection is closed on return
+func (s *Server) ServeConn(conn net.Conn) (err error) {
+	defer conn.Close()
+
+	address, err := s.destination(conn)
+	if err != nil {
+		return err
+	}
+
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	remote, err := s.Dial(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to dial: %s: %w", address, err)
+	}
+	defer remote.Close()
+
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+	io.Copy(conn, remote)
+	return nil
+}
+
+// Original destination in host:port form. Virtual addresses are translated to their names
+func (s *Server) destination(conn net.Conn) (address string, err error) {
+	destination := s.Destination
+	if destination == nil {
+		destination = OriginalDestination
+	}
+
+	addr, err := destination(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to get original destination: %w", err)
+	}
+
+	if s.Virtual == nil || !s.Virtual.Contains(addr.IP) {
+		return addr.String(), nil
+	}
+	name, found := s.Virtual.Lookup(addr.IP)
+	if !found {
+		return "", fmt.Errorf("unknown virtual address: %s", addr.IP)
+	}
+	return net.JoinHostPort(name, strconv.Itoa(addr.Port)), nil
+}
@@ -0,0 +1,126 @@
+package transproxy_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/RogueTeam/onion/net/dnsproxy"
+	"github.com/RogueTeam/onion/net/transproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Server(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		echo, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assertions.Nil(err, "failed to listen echo") {
+			return
+		}
+		defer echo.Close()
+		go func() {
+			for {
+				conn, err := echo.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		virtual, err := dnsproxy.NewVirtualNetwork(dnsproxy.DefaultVirtualNetwork)
+		if !assertions.Nil(err, "failed to prepare network") {
+			return
+		}
+		shop, err := virtual.Map("shop.onionp2p")
+		if !assertions.Nil(err, "failed to map name") {
+			return
+		}
+
+		var (
+			dialer       net.Dialer
+			mutex        sync.Mutex
+			requested    []string
+			destinations = []*net.TCPAddr{
+				{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+				{IP: shop, Port: 80},
+			}
+		)
+		server := transproxy.Server{
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				mutex.Lock()
+				requested = append(requested, address)
+				mutex.Unlock()
+				return dialer.DialContext(ctx, network, echo.Addr().String())
+			},
+			Virtual: virtual,
+			Destination: func(conn net.Conn) (addr *net.TCPAddr, err error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				addr, destinations = destinations[0], destinations[1:]
+				return addr, nil
+			},
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assertions.Nil(err, "failed to listen proxy") {
+			return
+		}
+		defer l.Close()
+		go server.Serve(l)
+
+		for range 2 {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if !assertions.Nil(err, "failed to dial proxy") {
+				return
+			}
+
+			payload := []byte("HELLO")
+			_, err = conn.Write(payload)
+			assertions.Nil(err, "failed to write payload")
+
+			received := make([]byte, len(payload))
+			_, err = io.ReadFull(conn, received)
+			assertions.Nil(err, "failed to read payload")
+			assertions.Equal(payload, received, "expecting echo")
+			conn.Close()
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		assertions.Equal([]string{"192.0.2.1:443", "shop.onionp2p:80"}, requested, "expecting original destinations")
+	})
+	t.Run("Fail", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		virtual, err := dnsproxy.NewVirtualNetwork(dnsproxy.DefaultVirtualNetwork)
+		if !assertions.Nil(err, "failed to prepare network") {
+			return
+		}
+
+		var dialed bool
+		server := transproxy.Server{
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				dialed = true
+				return nil, errors.New("unreachable")
+			},
+			Virtual: virtual,
+			Destination: func(conn net.Conn) (addr *net.TCPAddr, err error) {
+				return &net.TCPAddr{IP: net.IPv4(10, 192, 0, 9), Port: 80}, nil
+			},
+		}
+
+		client, conn := net.Pipe()
+		defer client.Close()
+		err = server.ServeConn(conn)
+		assertions.NotNil(err, "expecting unknown virtual address")
+		assertions.False(dialed, "expecting no dial")
+	})
+}
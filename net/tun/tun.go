@@ -0,0 +1,15 @@
+package tun
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrUnsupported = errors.New("tun devices not supported on this platform")
+
+// Layer 3 virtual network device. Each Read returns an IP packet and each Write injects one
+type Device struct {
+	*os.File
+	// Name of the interface
+	Name string
+}
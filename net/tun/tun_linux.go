@@ -0,0 +1,64 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/if_tun.h
+const (
+	iffTUN    = 0x0001
+	iffNoPI   = 0x1000
+	tunSetIFF = 0x400454ca
+)
+
+type ifReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// Creates the TUN device. Empty names let the kernel choose one.
+// The interface still needs its addresses and to be set up. Like with ip-link(8)
+func Open(name string) (dev *Device, err error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name too long: %s", name)
+	}
+
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tun: %w", err)
+	}
+
+	var req = ifReq{Flags: iffTUN | iffNoPI}
+	copy(req.Name[:], name)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIFF, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to create tun device: %w", errno)
+	}
+
+	// Non blocking descriptors use the runtime poller. Allowing Close to interrupt Read
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set non blocking: %w", err)
+	}
+
+	dev = &Device{
+		File: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		Name: string(req.Name[:clen(req.Name[:])]),
+	}
+	return dev, nil
+}
+
+func clen(b []byte) (n int) {
+	for n < len(b) && b[n] != 0 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package tun
+
+// Only supported on Linux
+func Open(name string) (dev *Device, err error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,181 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+)
+
+const (
+	ipv4HeaderSize  = 20
+	ipv6HeaderSize  = 40
+	udpHeaderSize   = 8
+	defaultHopLimit = 64
+)
+
+var (
+	ErrUnsupportedPacket = errors.New("unsupported packet")
+	ErrTruncatedPacket   = errors.New("truncated packet")
+)
+
+// IP packet read from the device. Fragments and IPv6 extension headers are not supported
+type Packet struct {
+	Source      net.IP
+	Destination net.IP
+	Protocol    byte
+	// Transport segment
+	Payload []byte
+}
+
+func ParsePacket(b []byte) (p Packet, err error) {
+	if len(b) == 0 {
+		return p, ErrTruncatedPacket
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < ipv4HeaderSize {
+			return p, ErrTruncatedPacket
+		}
+		headerSize := int(b[0]&0x0f) * 4
+		totalSize := int(binary.BigEndian.Uint16(b[2:4]))
+		if headerSize < ipv4HeaderSize || totalSize < headerSize || totalSize > len(b) {
+			return p, ErrTruncatedPacket
+		}
+		// More fragments flag or fragment offset
+		if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+			return p, fmt.Errorf("%w: fragment", ErrUnsupportedPacket)
+		}
+		p.Source = net.IP(b[12:16])
+		p.Destination = net.IP(b[16:20])
+		p.Protocol = b[9]
+		p.Payload = b[headerSize:totalSize]
+	case 6:
+		if len(b) < ipv6HeaderSize {
+			return p, ErrTruncatedPacket
+		}
+		payloadSize := int(binary.BigEndian.Uint16(b[4:6]))
+		if ipv6HeaderSize+payloadSize > len(b) {
+			return p, ErrTruncatedPacket
+		}
+		p.Source = net.IP(b[8:24])
+		p.Destination = net.IP(b[24:40])
+		p.Protocol = b[6]
+		p.Payload = b[ipv6HeaderSize : ipv6HeaderSize+payloadSize]
+	default:
+		return p, fmt.Errorf("%w: version %d", ErrUnsupportedPacket, b[0]>>4)
+	}
+	return p, nil
+}
+
+type UDPHeader struct {
+	SourcePort      uint16
+	DestinationPort uint16
+}
+
+// Parses the UDP segment returning its header and payload
+func ParseUDP(segment []byte) (header UDPHeader, payload []byte, err error) {
+	if len(segment) < udpHeaderSize {
+		return header, nil, ErrTruncatedPacket
+	}
+	length := int(binary.BigEndian.Uint16(segment[4:6]))
+	if length < udpHeaderSize || length > len(segment) {
+		return header, nil, ErrTruncatedPacket
+	}
+	header.SourcePort = binary.BigEndian.Uint16(segment[0:2])
+	header.DestinationPort = binary.BigEndian.Uint16(segment[2:4])
+	return header, segment[udpHeaderSize:length], nil
+}
+
+// Builds the IP packet with the UDP datagram. Both addresses should be of the same family
+func BuildUDP(source, destination *net.UDPAddr, payload []byte) (packet []byte, err error) {
+	segment := make([]byte, udpHeaderSize, udpHeaderSize+len(payload))
+	binary.BigEndian.PutUint16(segment[0:2], uint16(source.Port))
+	binary.BigEndian.PutUint16(segment[2:4], uint16(destination.Port))
+	binary.BigEndian.PutUint16(segment[4:6], uint16(udpHeaderSize+len(payload)))
+	segment = append(segment, payload...)
+
+	packet, err = buildPacket(source.IP, destination.IP, ProtocolUDP, segment, 6)
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// Prepends the IP header and fills the transport checksum at the offset
+func buildPacket(source, destination net.IP, protocol byte, segment []byte, checksumOffset int) (packet []byte, err error) {
+	if source4, destination4 := source.To4(), destination.To4(); source4 != nil && destination4 != nil {
+		if ipv4HeaderSize+len(segment) > 0xffff {
+			return nil, fmt.Errorf("packet too large: %d", len(segment))
+		}
+		packet = make([]byte, ipv4HeaderSize, ipv4HeaderSize+len(segment))
+		packet[0] = 4<<4 | ipv4HeaderSize/4
+		binary.BigEndian.PutUint16(packet[2:4], uint16(ipv4HeaderSize+len(segment)))
+		// Don't fragment
+		packet[6] = 0x40
+		packet[8] = defaultHopLimit
+		packet[9] = protocol
+		copy(packet[12:16], source4)
+		copy(packet[16:20], destination4)
+		binary.BigEndian.PutUint16(packet[10:12], checksum(0, packet))
+
+		pseudo := sum(sum(0, source4), destination4) + uint32(protocol) + uint32(len(segment))
+		binary.BigEndian.PutUint16(segment[checksumOffset:], transportChecksum(pseudo, segment))
+		return append(packet, segment...), nil
+	}
+
+	source16, destination16 := source.To16(), destination.To16()
+	if source16 == nil || destination16 == nil || source.To4() != nil || destination.To4() != nil {
+		return nil, errors.New("mixed or invalid addresses")
+	}
+	if len(segment) > 0xffff {
+		return nil, fmt.Errorf("packet too large: %d", len(segment))
+	}
+	packet = make([]byte, ipv6HeaderSize, ipv6HeaderSize+len(segment))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(segment)))
+	packet[6] = protocol
+	packet[7] = defaultHopLimit
+	copy(packet[8:24], source16)
+	copy(packet[24:40], destination16)
+
+	pseudo := sum(sum(0, source16), destination16) + uint32(protocol) + uint32(len(segment))
+	binary.BigEndian.PutUint16(segment[checksumOffset:], transportChecksum(pseudo, segment))
+	return append(packet, segment...), nil
+}
+
+// Zero and 0xffff are the same in one's complement. UDP reserves zero for datagrams without checksum
+func transportChecksum(pseudo uint32, segment []byte) (result uint16) {
+	result = checksum(pseudo, segment)
+	if result == 0 {
+		return 0xffff
+	}
+	return result
+}
+
+// Internet checksum of RFC 1071
+func checksum(initial uint32, b []byte) (result uint16) {
+	s := sum(initial, b)
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
+
+func sum(initial uint32, b []byte) (s uint32) {
+	s = initial
+	for len(b) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
@@ -0,0 +1,152 @@
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	// Handshakes of TCP flows waiting for their dial
+	MaxPendingConnections = 1024
+	// Packets queued by the userspace stack before being written to the device
+	stackQueueSize = 512
+	stackNIC       = 1
+)
+
+// Userspace TCP/IP stack terminating the TCP flows of the device
+type tcpStack struct {
+	Stack *stack.Stack
+	Link  *channel.Endpoint
+
+	cancel context.CancelFunc
+}
+
+// Prepares the stack. It accepts connections to every address and answers from them
+func (r *Router) newTCPStack(mtu int) (s *tcpStack, err error) {
+	s = &tcpStack{
+		Stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+		}),
+		Link: channel.New(stackQueueSize, uint32(mtu), ""),
+	}
+
+	tcpErr := s.Stack.CreateNIC(stackNIC, s.Link)
+	if tcpErr != nil {
+		s.Stack.Close()
+		return nil, fmt.Errorf("failed to create nic: %s", tcpErr)
+	}
+	// Flows are addressed to the destinations, not to the stack
+	s.Stack.SetPromiscuousMode(stackNIC, true)
+	s.Stack.SetSpoofing(stackNIC, true)
+	s.Stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: stackNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: stackNIC},
+	})
+
+	forwarder := tcp.NewForwarder(s.Stack, 0, MaxPendingConnections, r.forwardTCP)
+	s.Stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go r.writeStackPackets(ctx, s.Link)
+	return s, nil
+}
+
+func (s *tcpStack) Close() {
+	s.cancel()
+	s.Stack.Close()
+	s.Link.Close()
+}
+
+// Passes the packet read from the device to the stack
+func (s *tcpStack) inject(b []byte) {
+	protocol := ipv4.ProtocolNumber
+	if b[0]>>4 == 6 {
+		protocol = ipv6.ProtocolNumber
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+	defer pkt.DecRef()
+	s.Link.InjectInbound(protocol, pkt)
+}
+
+// Writes the packets of the stack to the device
+func (r *Router) writeStackPackets(ctx context.Context, link *channel.Endpoint) {
+	for {
+		pkt := link.ReadContext(ctx)
+		if pkt == nil {
+			return
+		}
+		view := pkt.ToView()
+		pkt.DecRef()
+
+		err := r.writePacket(view.AsSlice())
+		view.Release()
+		if err != nil {
+			log.Printf("failed to write stack packet: %v", err)
+		}
+	}
+}
+
+// Dials the destination of the flow before accepting it.
+// Flows failing to dial are reset
+func (r *Router) forwardTCP(req *tcp.ForwarderRequest) {
+	id := req.ID()
+	destination := net.JoinHostPort(net.IP(id.LocalAddress.AsSlice()).String(), strconv.Itoa(int(id.LocalPort)))
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), r.dialTimeout())
+		defer cancel()
+
+		remote, err := r.Dial(ctx, "tcp", destination)
+		if err != nil {
+			log.Printf("failed to dial flow: %s: %v", destination, err)
+			req.Complete(true)
+			return
+		}
+		defer remote.Close()
+
+		var queue waiter.Queue
+		ep, tcpErr := req.CreateEndpoint(&queue)
+		if tcpErr != nil {
+			req.Complete(true)
+			return
+		}
+		req.Complete(false)
+
+		local := gonet.NewTCPConn(&queue, ep)
+		defer local.Close()
+
+		go func() {
+			io.Copy(remote, local)
+			closeWrite(remote)
+		}()
+		io.Copy(local, remote)
+		local.CloseWrite()
+	}()
+}
+
+// Half closes the connection when supported. Otherwise it is fully closed
+func closeWrite(conn net.Conn) {
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,271 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMTU         = 1500
+	DefaultIdleTimeout = 2 * time.Minute
+	DefaultDialTimeout = 30 * time.Second
+	// Datagrams queued while the flow is being dialed
+	MaxPendingDatagrams = 64
+)
+
+// Same signature as net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (conn net.Conn, err error)
+
+// Routes the IP packets of a TUN device through Dial.
+//
+// Flows are terminated here and each one is dialed through Dial.
+// UDP datagrams are relayed directly. TCP flows are terminated by an userspace TCP/IP stack.
+// Packets are never forwarded outside Dial. Flows failing to dial, like when no circuit is available,
+// are dropped or reset. Acting as a kill switch
+type Router struct {
+	// Device the packets are read from and written to
+	Device io.ReadWriter
+	// Dials the destinations of the flows
+	Dial DialFunc
+	// Destinations routed through Dial. Nil routes every destination. Packets to other destinations are dropped
+	Routes []*net.IPNet
+	// Zero means DefaultMTU
+	MTU int
+	// Idle time after which UDP flows are closed. Zero means DefaultIdleTimeout
+	IdleTimeout time.Duration
+	// Zero means DefaultDialTimeout
+	DialTimeout time.Duration
+
+	writeMutex sync.Mutex
+	flowsMutex sync.Mutex
+	flows      map[flowKey]*udpFlow
+	tcp        *tcpStack
+}
+
+type flowKey struct {
+	Source      string
+	Destination string
+}
+
+type udpFlow struct {
+	Source      *net.UDPAddr
+	Destination *net.UDPAddr
+	Pending     chan []byte
+
+	lastActivity atomic.Int64
+}
+
+// Routes the packets of the device until reading it fails
+func (r *Router) Serve() (err error) {
+	mtu := r.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	defer r.closeFlows()
+
+	r.tcp, err = r.newTCPStack(mtu)
+	if err != nil {
+		return fmt.Errorf("failed to prepare tcp stack: %w", err)
+	}
+	defer r.tcp.Close()
+
+	buffer := make([]byte, mtu)
+	for {
+		n, err := r.Device.Read(buffer)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read packet: %w", err)
+		}
+
+		err = r.route(buffer[:n])
+		if err != nil && !errors.Is(err, ErrUnsupportedPacket) {
+			log.Printf("failed to route packet: %v", err)
+		}
+	}
+}
+
+// Checks if the destination is routed through Dial
+func (r *Router) Routed(ip net.IP) (routed bool) {
+	if r.Routes == nil {
+		return true
+	}
+	for _, route := range r.Routes {
+		if route.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) route(b []byte) (err error) {
+	p, err := ParsePacket(b)
+	if err != nil {
+		return err
+	}
+	if !r.Routed(p.Destination) {
+		return nil
+	}
+
+	switch p.Protocol {
+	case ProtocolUDP:
+		return r.routeUDP(p)
+	case ProtocolTCP:
+		r.tcp.inject(b)
+		return nil
+	default:
+		return fmt.Errorf("%w: protocol %d", ErrUnsupportedPacket, p.Protocol)
+	}
+}
+
+func (r *Router) writePacket(packet []byte) (err error) {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+
+	_, err = r.Device.Write(packet)
+	if err != nil {
+		return fmt.Errorf("failed to write packet: %w", err)
+	}
+	return nil
+}
+
+func (r *Router) routeUDP(p Packet) (err error) {
+	header, payload, err := ParseUDP(p.Payload)
+	if err != nil {
+		return err
+	}
+
+	source := &net.UDPAddr{IP: cloneIP(p.Source), Port: int(header.SourcePort)}
+	destination := &net.UDPAddr{IP: cloneIP(p.Destination), Port: int(header.DestinationPort)}
+	key := flowKey{Source: source.String(), Destination: destination.String()}
+
+	r.flowsMutex.Lock()
+	defer r.flowsMutex.Unlock()
+
+	if r.flows == nil {
+		r.flows = make(map[flowKey]*udpFlow)
+	}
+	flow, found := r.flows[key]
+	if !found {
+		flow = &udpFlow{
+			Source:      source,
+			Destination: destination,
+			Pending:     make(chan []byte, MaxPendingDatagrams),
+		}
+		r.flows[key] = flow
+		go r.serveFlow(key, flow)
+	}
+
+	select {
+	case flow.Pending <- append([]byte(nil), payload...):
+	default:
+		// Datagrams are unreliable. Full queues drop them
+	}
+	return nil
+}
+
+// Dials the flow and relays its datagrams until it is idle for IdleTimeout
+func (r *Router) serveFlow(key flowKey, flow *udpFlow) {
+	defer func() {
+		r.flowsMutex.Lock()
+		defer r.flowsMutex.Unlock()
+
+		if r.flows[key] == flow {
+			delete(r.flows, key)
+		}
+	}()
+
+	idleTimeout := r.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.dialTimeout())
+	defer cancel()
+
+	conn, err := r.Dial(ctx, "udp", flow.Destination.String())
+	if err != nil {
+		log.Printf("failed to dial flow: %s: %v", flow.Destination, err)
+		return
+	}
+	defer conn.Close()
+
+	flow.lastActivity.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	defer close(done)
+	// Idle flows are closed by a timer. Read deadlines could interrupt a datagram half read
+	go func() {
+		idle := time.NewTimer(idleTimeout)
+		defer idle.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case datagram, ok := <-flow.Pending:
+				if !ok {
+					conn.Close()
+					return
+				}
+				flow.lastActivity.Store(time.Now().UnixNano())
+				conn.Write(datagram)
+			case <-idle.C:
+				elapsed := time.Since(time.Unix(0, flow.lastActivity.Load()))
+				if elapsed >= idleTimeout {
+					conn.Close()
+					return
+				}
+				idle.Reset(idleTimeout - elapsed)
+			}
+		}
+	}()
+
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		flow.lastActivity.Store(time.Now().UnixNano())
+
+		packet, err := BuildUDP(flow.Destination, flow.Source, buffer[:n])
+		if err != nil {
+			continue
+		}
+		err = r.writePacket(packet)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *Router) dialTimeout() (timeout time.Duration) {
+	if r.DialTimeout == 0 {
+		return DefaultDialTimeout
+	}
+	return r.DialTimeout
+}
+
+func (r *Router) closeFlows() {
+	r.flowsMutex.Lock()
+	defer r.flowsMutex.Unlock()
+
+	for key, flow := range r.flows {
+		close(flow.Pending)
+		delete(r.flows, key)
+	}
+}
+
+// Packets are parsed in place. Addresses kept by the flows need their own copy
+func cloneIP(ip net.IP) (cloned net.IP) {
+	return append(net.IP(nil), ip...)
+}
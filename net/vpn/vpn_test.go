@@ -0,0 +1,429 @@
+package vpn_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RogueTeam/onion/net/vpn"
+	"github.com/stretchr/testify/assert"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// In memory TUN device. Packets written by the test are read by the router and the other way around
+type device struct {
+	inbound  chan []byte
+	outbound chan []byte
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func newDevice() (d *device) {
+	return &device{
+		inbound:  make(chan []byte, 16),
+		outbound: make(chan []byte, 16),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (d *device) Read(b []byte) (n int, err error) {
+	select {
+	case packet := <-d.inbound:
+		return copy(b, packet), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *device) Write(b []byte) (n int, err error) {
+	d.outbound <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (d *device) Close() (err error) {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *device) next(t *testing.T) (packet vpn.Packet) {
+	select {
+	case raw := <-d.outbound:
+		packet, err := vpn.ParsePacket(raw)
+		if err != nil {
+			t.Fatalf("failed to parse packet: %v", err)
+		}
+		return packet
+	case <-time.After(10 * time.Second):
+		t.Fatal("no packet written")
+		return packet
+	}
+}
+
+// Userspace stack playing the role of the host kernel. Its packets go through the device
+type clientStack struct {
+	Stack *stack.Stack
+	Link  *channel.Endpoint
+
+	cancel context.CancelFunc
+}
+
+func newClientStack(t *testing.T, dev *device) (c *clientStack) {
+	c = &clientStack{
+		Stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+		}),
+		Link: channel.New(256, vpn.DefaultMTU, ""),
+	}
+	if err := c.Stack.CreateNIC(1, c.Link); err != nil {
+		t.Fatalf("failed to create nic: %s", err)
+	}
+	c.Stack.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{10, 0, 0, 2}).WithPrefix(),
+	}, stack.AddressProperties{})
+	c.Stack.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go func() {
+		for {
+			pkt := c.Link.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+			view := pkt.ToView()
+			pkt.DecRef()
+			dev.inbound <- view.AsSlice()
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case raw := <-dev.outbound:
+				pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(raw)})
+				c.Link.InjectInbound(ipv4.ProtocolNumber, pkt)
+				pkt.DecRef()
+			}
+		}
+	}()
+	return c
+}
+
+func (c *clientStack) Dial(ip net.IP, port uint16) (conn net.Conn, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	address := tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFromSlice(ip.To4()), Port: port}
+	return gonet.DialContextTCP(ctx, c.Stack, address, ipv4.ProtocolNumber)
+}
+
+func (c *clientStack) Close() {
+	c.cancel()
+	c.Stack.Close()
+}
+
+func Test_Router(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if !assertions.Nil(err, "failed to listen echo") {
+			return
+		}
+		defer echo.Close()
+		go func() {
+			buffer := make([]byte, 65535)
+			for {
+				n, source, err := echo.ReadFromUDP(buffer)
+				if err != nil {
+					return
+				}
+				echo.WriteToUDP(buffer[:n], source)
+			}
+		}()
+
+		var (
+			dialer    net.Dialer
+			mutex     sync.Mutex
+			requested []string
+		)
+		dev := newDevice()
+		router := vpn.Router{
+			Device: dev,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				mutex.Lock()
+				requested = append(requested, network+"/"+address)
+				mutex.Unlock()
+				return dialer.DialContext(ctx, network, echo.LocalAddr().String())
+			},
+		}
+		defer dev.Close()
+		go router.Serve()
+
+		for _, test := range []struct {
+			Source      *net.UDPAddr
+			Destination *net.UDPAddr
+		}{
+			{
+				Source:      &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 5000},
+				Destination: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 53},
+			},
+			{
+				Source:      &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 5000},
+				Destination: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 123},
+			},
+		} {
+			payload := []byte("HELLO")
+			packet, err := vpn.BuildUDP(test.Source, test.Destination, payload)
+			if !assertions.Nil(err, "failed to build packet") {
+				return
+			}
+			dev.inbound <- packet
+
+			reply := dev.next(t)
+			assertions.Equal(byte(vpn.ProtocolUDP), reply.Protocol, "expecting udp")
+			assertions.True(reply.Source.Equal(test.Destination.IP), "expecting destination as source")
+			assertions.True(reply.Destination.Equal(test.Source.IP), "expecting source as destination")
+
+			header, received, err := vpn.ParseUDP(reply.Payload)
+			assertions.Nil(err, "failed to parse udp")
+			assertions.Equal(uint16(test.Destination.Port), header.SourcePort, "expecting destination port")
+			assertions.Equal(uint16(test.Source.Port), header.DestinationPort, "expecting source port")
+			assertions.Equal(payload, received, "expecting echo")
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		assertions.Equal([]string{"udp/192.0.2.1:53", "udp/[2001:db8::1]:123"}, requested, "expecting flow destinations")
+	})
+	t.Run("Idle UDP flow", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if !assertions.Nil(err, "failed to listen echo") {
+			return
+		}
+		defer echo.Close()
+		go func() {
+			buffer := make([]byte, 65535)
+			for {
+				n, source, err := echo.ReadFromUDP(buffer)
+				if err != nil {
+					return
+				}
+				echo.WriteToUDP(buffer[:n], source)
+			}
+		}()
+
+		var (
+			dialer net.Dialer
+			dials  atomic.Int64
+		)
+		dev := newDevice()
+		router := vpn.Router{
+			Device:      dev,
+			IdleTimeout: 200 * time.Millisecond,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				dials.Add(1)
+				return dialer.DialContext(ctx, network, echo.LocalAddr().String())
+			},
+		}
+		defer dev.Close()
+		go router.Serve()
+
+		source := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 5000}
+		destination := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 53}
+		packet, err := vpn.BuildUDP(source, destination, []byte("HELLO"))
+		if !assertions.Nil(err, "failed to build packet") {
+			return
+		}
+
+		// Activity keeps the flow open
+		for range 3 {
+			dev.inbound <- packet
+			dev.next(t)
+			time.Sleep(100 * time.Millisecond)
+		}
+		assertions.Equal(int64(1), dials.Load(), "expecting active flow kept")
+
+		// Idle flows are closed and dialed again
+		time.Sleep(500 * time.Millisecond)
+		dev.inbound <- packet
+		dev.next(t)
+		assertions.Equal(int64(2), dials.Load(), "expecting idle flow closed")
+	})
+	t.Run("TCP", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		echo, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assertions.Nil(err, "failed to listen echo") {
+			return
+		}
+		defer echo.Close()
+		go func() {
+			for {
+				conn, err := echo.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		var (
+			dialer    net.Dialer
+			requested = make(chan string, 1)
+		)
+		dev := newDevice()
+		router := vpn.Router{
+			Device: dev,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				requested <- network + "/" + address
+				return dialer.DialContext(ctx, network, echo.Addr().String())
+			},
+		}
+		defer dev.Close()
+		go router.Serve()
+
+		client := newClientStack(t, dev)
+		defer client.Close()
+
+		conn, err := client.Dial(net.IPv4(192, 0, 2, 1), 80)
+		if !assertions.Nil(err, "failed to dial through the router") {
+			return
+		}
+		defer conn.Close()
+		assertions.Equal("tcp/192.0.2.1:80", <-requested, "expecting flow destination")
+
+		payload := bytes.Repeat([]byte("HELLO"), 4096)
+		go conn.Write(payload)
+
+		received := make([]byte, len(payload))
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = io.ReadFull(conn, received)
+		assertions.Nil(err, "failed to read echo")
+		assertions.Equal(payload, received, "expecting echo")
+	})
+	t.Run("Refused TCP", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		dev := newDevice()
+		router := vpn.Router{
+			Device: dev,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				return nil, errors.New("no circuit available")
+			},
+		}
+		defer dev.Close()
+		go router.Serve()
+
+		client := newClientStack(t, dev)
+		defer client.Close()
+
+		_, err := client.Dial(net.IPv4(192, 0, 2, 1), 80)
+		assertions.NotNil(err, "expecting flow reset without circuit")
+	})
+	t.Run("Kill switch", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		_, routed, _ := net.ParseCIDR("192.0.2.0/24")
+		dials := make(chan string, 4)
+		dev := newDevice()
+		router := vpn.Router{
+			Device: dev,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+				dials <- address
+				return nil, errors.New("no circuit available")
+			},
+			Routes: []*net.IPNet{routed},
+		}
+		defer dev.Close()
+		go router.Serve()
+
+		source := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 5000}
+		for _, destination := range []*net.UDPAddr{
+			{IP: net.IPv4(198, 51, 100, 1).To4(), Port: 53},
+			{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 53},
+		} {
+			packet, err := vpn.BuildUDP(source, destination, []byte("HELLO"))
+			if !assertions.Nil(err, "failed to build packet") {
+				return
+			}
+			dev.inbound <- packet
+		}
+
+		select {
+		case address := <-dials:
+			assertions.Equal("192.0.2.1:53", address, "expecting only routed destinations dialed")
+		case <-time.After(10 * time.Second):
+			assertions.Fail("expecting dial")
+		}
+		select {
+		case <-dev.outbound:
+			assertions.Fail("expecting no packets without circuit")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func Test_Packet(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		packet, err := vpn.BuildUDP(
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000},
+			&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53},
+			[]byte("HELLO"),
+		)
+		if !assertions.Nil(err, "failed to build packet") {
+			return
+		}
+
+		// Checksums of valid headers sum to 0xffff
+		var sum uint32
+		for i := 0; i < 20; i += 2 {
+			sum += uint32(packet[i])<<8 | uint32(packet[i+1])
+		}
+		for sum > 0xffff {
+			sum = sum>>16 + sum&0xffff
+		}
+		assertions.Equal(uint32(0xffff), sum, "expecting valid ipv4 checksum")
+
+		p, err := vpn.ParsePacket(packet)
+		assertions.Nil(err, "failed to parse packet")
+		assertions.True(p.Source.Equal(net.IPv4(10, 0, 0, 2)), "expecting source")
+		assertions.True(p.Destination.Equal(net.IPv4(192, 0, 2, 1)), "expecting destination")
+	})
+	t.Run("Fail", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		for _, packet := range [][]byte{
+			nil,
+			{0x45, 0x00},
+			make([]byte, 40),
+		} {
+			_, err := vpn.ParsePacket(packet)
+			assertions.NotNil(err, "expecting invalid packet")
+		}
+	})
+}
@@ -34,14 +34,9 @@ func LoadIdentity(location string) (privKey crypto.PrivKey, err error) {
 			return nil, fmt.Errorf("failed to generate private key: %w", err)
 		}
 
-		contents, err := crypto.MarshalPrivateKey(privKey)
+		err = SaveIdentity(location, privKey)
 		if err != nil {
-			return nil, fmt.Errorf("failed to marshal key: %w", err)
-		}
-
-		err = os.WriteFile(location, contents, 0o660)
-		if err != nil {
-			return nil, fmt.Errorf("failed to save private key: %w", err)
+			return nil, err
 		}
 
 		return privKey, nil
@@ -50,3 +45,32 @@ func LoadIdentity(location string) (privKey crypto.PrivKey, err error) {
 		return nil, fmt.Errorf("failed to load key: %w", err)
 	}
 }
+
+// Writes the key in the format read by LoadIdentity
+func SaveIdentity(location string, privKey crypto.PrivKey) (err error) {
+	return saveIdentity(location, privKey, os.O_TRUNC)
+}
+
+// Same as SaveIdentity but fails with os.ErrExist instead of replacing an existing file
+func CreateIdentity(location string, privKey crypto.PrivKey) (err error) {
+	return saveIdentity(location, privKey, os.O_EXCL)
+}
+
+func saveIdentity(location string, privKey crypto.PrivKey, flag int) (err error) {
+	contents, err := crypto.MarshalPrivateKey(privKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	file, err := os.OpenFile(location, os.O_WRONLY|os.O_CREATE|flag, 0o660)
+	if err != nil {
+		return fmt.Errorf("failed to save private key: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(contents)
+	if err != nil {
+		return fmt.Errorf("failed to save private key: %w", err)
+	}
+	return file.Close()
+}
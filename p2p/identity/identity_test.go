@@ -2,6 +2,7 @@ package identity_test
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/RogueTeam/onion/p2p/identity"
@@ -46,3 +47,33 @@ func Test_LoadIdentity(t *testing.T) {
 		assertions.False(key1.Equals(key3), "keys should be different: %w", err)
 	})
 }
+
+func Test_CreateIdentity(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		location := filepath.Join(t.TempDir(), "hidden.key")
+
+		key1, err := identity.NewKey()
+		assertions.Nil(err, "failed to generate key 1")
+		key2, err := identity.NewKey()
+		assertions.Nil(err, "failed to generate key 2")
+
+		err = identity.CreateIdentity(location, key1)
+		assertions.Nil(err, "failed to create identity")
+
+		err = identity.CreateIdentity(location, key2)
+		assertions.ErrorIs(err, os.ErrExist, "expecting existing identity kept")
+
+		loaded, err := identity.LoadIdentity(location)
+		assertions.Nil(err, "failed to load identity")
+		assertions.True(key1.Equals(loaded), "expecting first key")
+
+		err = identity.SaveIdentity(location, key2)
+		assertions.Nil(err, "failed to overwrite identity")
+
+		loaded, err = identity.LoadIdentity(location)
+		assertions.Nil(err, "failed to load identity")
+		assertions.True(key2.Equals(loaded), "expecting overwritten key")
+	})
+}
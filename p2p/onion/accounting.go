@@ -0,0 +1,210 @@
+package onion
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Fraction of the quota relayed before hibernating
+	DefaultAccountingThreshold = 0.95
+	// Interval between saves of the usage
+	DefaultAccountingSaveInterval = time.Minute
+)
+
+var ErrQuotaExhausted = errors.New("accounting quota exhausted")
+
+// Limits the bytes relayed per accounting period. Sent and received bytes both count
+type AccountingConfig struct {
+	// Bytes relayed per period
+	Quota uint64
+	// Length of the periods. Zero means calendar months in UTC
+	Period time.Duration
+	// Fraction of the quota at which the node hibernates. Zero means DefaultAccountingThreshold
+	Threshold float64
+	// File persisting the usage across restarts. Empty keeps it in memory
+	Path string
+}
+
+func (c AccountingConfig) defaults() (cfg AccountingConfig) {
+	if c.Threshold == 0 {
+		c.Threshold = DefaultAccountingThreshold
+	}
+	return c
+}
+
+// Persisted state of the accounting
+type accountingState struct {
+	Start time.Time `json:"start"`
+	Used  uint64    `json:"used"`
+}
+
+// Bytes relayed in the current period. Once the threshold of the quota is reached the node hibernates:
+// it stops advertising itself and refuses new circuits until the next period.
+// Circuits still open stop relaying once the whole quota is used
+type Accounting struct {
+	Config AccountingConfig
+
+	used atomic.Uint64
+
+	mutex sync.Mutex
+	start time.Time
+
+	// Closed to stop the periodic saves
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Loads the usage of the current period from the Path. Usage of past periods is discarded
+func NewAccounting(cfg AccountingConfig) (a *Accounting, err error) {
+	if cfg.Quota == 0 {
+		return nil, errors.New("accounting quota not set")
+	}
+
+	a = &Accounting{Config: cfg.defaults(), closed: make(chan struct{})}
+	a.start = a.periodStart(time.Now())
+	if cfg.Path == "" {
+		return a, nil
+	}
+
+	contents, err := os.ReadFile(cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accounting: %w", err)
+	}
+
+	var state accountingState
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal accounting: %w", err)
+	}
+	if state.Start.Equal(a.start) {
+		a.used.Store(state.Used)
+	}
+	return a, nil
+}
+
+// Start of the period containing t
+func (a *Accounting) periodStart(t time.Time) (start time.Time) {
+	t = t.UTC()
+	if a.Config.Period == 0 {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(a.Config.Period)
+}
+
+// End of the period starting at start
+func (a *Accounting) periodEnd(start time.Time) (end time.Time) {
+	if a.Config.Period == 0 {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.Add(a.Config.Period)
+}
+
+// Resets the usage when a new period started
+func (a *Accounting) rollover() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	start := a.periodStart(time.Now())
+	if start.Equal(a.start) {
+		return
+	}
+	a.start = start
+	a.used.Store(0)
+}
+
+// Adds the relayed bytes returning the usage of the period
+func (a *Accounting) Add(n uint64) (used uint64) {
+	a.rollover()
+	return a.used.Add(n)
+}
+
+// Bytes relayed in the current period and the bounds of the period
+func (a *Accounting) Usage() (used uint64, start, end time.Time) {
+	a.rollover()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.used.Load(), a.start, a.periodEnd(a.start)
+}
+
+// Checks if the quota is nearly exhausted. Nil accountings never hibernate
+func (a *Accounting) Hibernating() (hibernating bool) {
+	if a == nil {
+		return false
+	}
+	used, _, _ := a.Usage()
+	return float64(used) >= float64(a.Config.Quota)*a.Config.Threshold
+}
+
+// Checks if the whole quota was relayed. Nil accountings are never exhausted
+func (a *Accounting) Exhausted() (exhausted bool) {
+	if a == nil {
+		return false
+	}
+	used, _, _ := a.Usage()
+	return used >= a.Config.Quota
+}
+
+// Writes the usage to the Path
+func (a *Accounting) Save() (err error) {
+	if a.Config.Path == "" {
+		return nil
+	}
+
+	used, start, _ := a.Usage()
+	contents, err := json.Marshal(accountingState{Start: start, Used: used})
+	if err != nil {
+		return fmt.Errorf("failed to marshal accounting: %w", err)
+	}
+
+	// Replaced atomically. A crash never leaves a truncated file
+	tmp := a.Config.Path + ".tmp"
+	err = os.WriteFile(tmp, contents, 0o660)
+	if err != nil {
+		return fmt.Errorf("failed to write accounting: %w", err)
+	}
+	err = os.Rename(tmp, a.Config.Path)
+	if err != nil {
+		return fmt.Errorf("failed to save accounting: %w", err)
+	}
+	return nil
+}
+
+// Stops the periodic saves and saves the usage once more. Nil accountings do nothing
+func (a *Accounting) Close() (err error) {
+	if a == nil {
+		return nil
+	}
+	a.closeOnce.Do(func() { close(a.closed) })
+	return a.Save()
+}
+
+// Periodically saves the usage until closed
+func (a *Accounting) serve(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.closed:
+			return
+		}
+
+		err := a.Save()
+		if err != nil {
+			log.Printf("failed to save accounting: %v", err)
+		}
+	}
+}
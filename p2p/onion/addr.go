@@ -0,0 +1,23 @@
+package onion
+
+import (
+	"net"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Network name reported by onion addresses
+const Network = BaseString
+
+// net.Addr compatible representation of a peer inside the onion network.
+// For hidden services Address corresponds to the hidden address
+type Addr struct {
+	Address peer.ID
+	// Virtual port of the hidden service. Zero when not applicable
+	Port uint16
+}
+
+func (a *Addr) Network() (network string) { return Network }
+func (a *Addr) String() (s string)        { return FormatAddress(a.Address) }
+
+var _ net.Addr = (*Addr)(nil)
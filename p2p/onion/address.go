@@ -0,0 +1,111 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// Suffix of the encoded hidden addresses
+	AddressSuffix = "." + BaseString
+	// Version of the encoding. Appended to every encoded address
+	AddressVersion byte = 1
+
+	addressKeyLength      = 32
+	addressChecksumLength = 2
+	addressChecksumPrefix = AddressSuffix + " checksum"
+)
+
+// Length of an encoded address without the suffix
+var AddressLength = addressEncoding.EncodedLen(addressKeyLength + addressChecksumLength + 1)
+
+var addressEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func addressChecksum(key []byte, version byte) (checksum []byte) {
+	h := sha3.New256()
+	h.Write([]byte(addressChecksumPrefix))
+	h.Write(key)
+	h.Write([]byte{version})
+	return h.Sum(nil)[:addressChecksumLength]
+}
+
+// Encodes the hidden address as base32(public key || checksum || version) followed by AddressSuffix.
+// Only addresses derived from Ed25519 keys can be encoded
+func EncodeAddress(address peer.ID) (encoded string, err error) {
+	pub, err := address.ExtractPublicKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to extract public key: %w", err)
+	}
+	if pub.Type() != crypto.Ed25519 {
+		return "", errors.New("hidden address is not derived from an ed25519 key")
+	}
+
+	key, err := pub.Raw()
+	if err != nil {
+		return "", fmt.Errorf("failed to get raw public key: %w", err)
+	}
+
+	raw := slices.Concat(key, addressChecksum(key, AddressVersion), []byte{AddressVersion})
+	return addressEncoding.EncodeToString(raw) + AddressSuffix, nil
+}
+
+// String form of the hidden address. Falls back to the peer.ID form when the address can't be encoded
+func FormatAddress(address peer.ID) (s string) {
+	encoded, err := EncodeAddress(address)
+	if err != nil {
+		return address.String()
+	}
+	return encoded
+}
+
+// Parses encoded hidden addresses. The legacy peer.ID form is also accepted
+func ParseAddress(s string) (address peer.ID, err error) {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	if !strings.HasSuffix(lower, AddressSuffix) {
+		address, err = peer.Decode(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid hidden address: %w", err)
+		}
+		return address, nil
+	}
+
+	encoded := strings.TrimSuffix(lower, AddressSuffix)
+	if len(encoded) != AddressLength {
+		return "", errors.New("invalid hidden address length")
+	}
+
+	raw, err := addressEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode hidden address: %w", err)
+	}
+
+	key := raw[:addressKeyLength]
+	checksum := raw[addressKeyLength : addressKeyLength+addressChecksumLength]
+	version := raw[len(raw)-1]
+	if version != AddressVersion {
+		return "", fmt.Errorf("unsupported hidden address version: %d", version)
+	}
+	if !bytes.Equal(checksum, addressChecksum(key, version)) {
+		return "", errors.New("invalid hidden address checksum")
+	}
+
+	pub, err := crypto.UnmarshalEd25519PublicKey(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal public key: %w", err)
+	}
+	return HiddenAddressFromPubKey(pub)
+}
+
+// Checks if the host is an encoded hidden address. Doesn't validate it
+func IsHiddenHost(host string) (hidden bool) {
+	return strings.HasSuffix(strings.ToLower(host), AddressSuffix)
+}
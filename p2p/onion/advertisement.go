@@ -0,0 +1,80 @@
+package onion
+
+import (
+	"sync"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
+	"github.com/RogueTeam/onion/utils"
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Snapshot of the DHT advertisement of a hidden service
+type AdvertisementStatus struct {
+	// Last time the CID was successfully provided
+	LastProvided time.Time
+	// Error of the last provide. Nil if it succeeded
+	LastError error
+	// Number of successful provides
+	Provides uint64
+	// Proof of work difficulty suggested by the hidden service for new introductions
+	Effort uint64
+}
+
+// Advertisement of a hidden service hosted by this node.
+// The relay provides the CID of the hidden address on every TTL while the service is bound
+type Advertisement struct {
+	Address peer.ID
+	Cid     cid.Cid
+	// Certificate of the signing key bound. Forwarded to clients so they can verify the chain
+	Certificate *message.Certificate
+	// Set when the service declared itself as a single onion service
+	NonAnonymous bool
+
+	mutex  sync.Mutex
+	status AdvertisementStatus
+}
+
+func (a *Advertisement) Status() (status AdvertisementStatus) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.status
+}
+
+func (a *Advertisement) provide(d *dht.IpfsDHT) (err error) {
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	err = d.Provide(ctx, a.Cid, true)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.status.LastError = err
+	if err == nil {
+		a.status.LastProvided = time.Now()
+		a.status.Provides++
+	}
+	return err
+}
+
+func (a *Advertisement) setEffort(effort uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.status.Effort = min(effort, hashcash.DefaultMaxDifficulty)
+}
+
+// Advertisement status of a hidden service hosted by this node.
+// Not found once the relay stopped advertising it. Already published provider records remain in the DHT until they expire
+func (s *Service) AdvertisementStatus(address peer.ID) (status AdvertisementStatus, found bool) {
+	entry, found := s.HiddenServices.Load(address)
+	if !found {
+		return status, false
+	}
+	return entry.Advertisement.Status(), true
+}
@@ -0,0 +1,242 @@
+package onion
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+// Token bucket limits of the traffic relayed by the node. Rates are in bytes per second.
+// Zero rates are unlimited and zero bursts default to the rate
+type BandwidthConfig struct {
+	// Shared by every relayed circuit
+	Rate  int
+	Burst int
+	// Shared by the circuits of each remote peer
+	PeerRate  int
+	PeerBurst int
+	// Of each circuit passing through the node
+	CircuitRate  int
+	CircuitBurst int
+}
+
+func newLimiter(bytesPerSecond, burst int) (limiter *rate.Limiter) {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+type peerLimiter struct {
+	Limiter     *rate.Limiter
+	Connections int
+}
+
+// Limiters of the relayed traffic
+type Bandwidth struct {
+	Config BandwidthConfig
+
+	global *rate.Limiter
+
+	mutex sync.Mutex
+	peers map[peer.ID]*peerLimiter
+}
+
+func NewBandwidth(cfg BandwidthConfig) (b *Bandwidth) {
+	return &Bandwidth{
+		Config: cfg,
+		global: newLimiter(cfg.Rate, cfg.Burst),
+		peers:  make(map[peer.ID]*peerLimiter),
+	}
+}
+
+// Limiters of a new circuit from the remote peer. Release should be called once the circuit finishes.
+// Nil bandwidths return no limiters
+func (b *Bandwidth) Acquire(remote peer.ID) (limiters []*rate.Limiter, release func()) {
+	if b == nil {
+		return nil, func() {}
+	}
+
+	if b.global != nil {
+		limiters = append(limiters, b.global)
+	}
+	if circuit := newLimiter(b.Config.CircuitRate, b.Config.CircuitBurst); circuit != nil {
+		limiters = append(limiters, circuit)
+	}
+	if b.Config.PeerRate <= 0 {
+		return limiters, func() {}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, found := b.peers[remote]
+	if !found {
+		entry = &peerLimiter{Limiter: newLimiter(b.Config.PeerRate, b.Config.PeerBurst)}
+		b.peers[remote] = entry
+	}
+	entry.Connections++
+	limiters = append(limiters, entry.Limiter)
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+
+			entry.Connections--
+			if entry.Connections == 0 {
+				delete(b.peers, remote)
+			}
+		})
+	}
+	return limiters, release
+}
+
+// Bytes relayed through a circuit
+type Traffic struct {
+	// Previous hop of the circuit
+	Peer    peer.ID
+	Started time.Time
+	// Bytes sent back to the previous hop
+	Sent atomic.Uint64
+	// Bytes received from the previous hop and relayed
+	Received atomic.Uint64
+}
+
+// Snapshot of the traffic of a circuit
+type TrafficStats struct {
+	Peer     peer.ID
+	Started  time.Time
+	Sent     uint64
+	Received uint64
+}
+
+func (t *Traffic) Stats() (stats TrafficStats) {
+	return TrafficStats{
+		Peer:     t.Peer,
+		Started:  t.Started,
+		Sent:     t.Sent.Load(),
+		Received: t.Received.Load(),
+	}
+}
+
+// Counts relayed bytes. Like atomic.Uint64
+type byteCounter interface {
+	Add(delta uint64) (new uint64)
+}
+
+// Writer throttled by the limiters. Written bytes are added to the counters
+type relayWriter struct {
+	io.Writer
+	Limiters []*rate.Limiter
+	Counters []byteCounter
+	// Writes fail once its quota is exhausted. Nil is unlimited
+	Accounting *Accounting
+	// Writes are never split. Those larger than a burst fail
+	Datagrams bool
+}
+
+func (w *relayWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if w.Accounting.Exhausted() {
+			return n, ErrQuotaExhausted
+		}
+
+		chunk := len(b)
+		if !w.Datagrams {
+			for _, limiter := range w.Limiters {
+				chunk = min(chunk, limiter.Burst())
+			}
+		}
+		for _, limiter := range w.Limiters {
+			err = limiter.WaitN(context.Background(), chunk)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		written, err := w.Writer.Write(b[:chunk])
+		n += written
+		for _, counter := range w.Counters {
+			counter.Add(uint64(written))
+		}
+		if err != nil {
+			return n, err
+		}
+		b = b[chunk:]
+	}
+	return n, nil
+}
+
+// Writer of the traffic relayed back to the previous hop
+func (c *Connection) backward(w io.Writer) (relay io.Writer) {
+	return c.relayWriter(w, func(t *Traffic) *atomic.Uint64 { return &t.Sent })
+}
+
+// Writer of the traffic received from the previous hop
+func (c *Connection) forward(w io.Writer) (relay io.Writer) {
+	return c.relayWriter(w, func(t *Traffic) *atomic.Uint64 { return &t.Received })
+}
+
+// Same as forward but for datagram writers. Datagrams are never split
+func (c *Connection) forwardDatagrams(w io.Writer) (relay io.Writer) {
+	writer := c.relayWriter(w, func(t *Traffic) *atomic.Uint64 { return &t.Received })
+	writer.Datagrams = true
+	return writer
+}
+
+func (c *Connection) relayWriter(w io.Writer, counter func(t *Traffic) *atomic.Uint64) (relay *relayWriter) {
+	writer := &relayWriter{Writer: w, Limiters: c.Limiters}
+	for _, traffic := range []*Traffic{c.Traffic, c.TotalTraffic} {
+		if traffic != nil {
+			writer.Counters = append(writer.Counters, counter(traffic))
+		}
+	}
+	if c.Accounting != nil {
+		writer.Counters = append(writer.Counters, c.Accounting)
+		writer.Accounting = c.Accounting
+	}
+	return writer
+}
+
+// Starts tracking the traffic of a circuit from the remote peer
+func (s *Service) trackTraffic(remote peer.ID) (traffic *Traffic) {
+	traffic = &Traffic{Peer: remote, Started: time.Now()}
+
+	s.relaysMutex.Lock()
+	defer s.relaysMutex.Unlock()
+
+	if s.relays == nil {
+		s.relays = make(map[*Traffic]struct{})
+	}
+	s.relays[traffic] = struct{}{}
+	return traffic
+}
+
+func (s *Service) untrackTraffic(traffic *Traffic) {
+	s.relaysMutex.Lock()
+	defer s.relaysMutex.Unlock()
+
+	delete(s.relays, traffic)
+}
+
+// Traffic of the circuits currently passing through the node
+func (s *Service) Relays() (relays []TrafficStats) {
+	s.relaysMutex.Lock()
+	defer s.relaysMutex.Unlock()
+
+	relays = make([]TrafficStats, 0, len(s.relays))
+	for traffic := range s.relays {
+		relays = append(relays, traffic.Stats())
+	}
+	return relays
+}
@@ -0,0 +1,163 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const certificateDomain = BaseString + "-certificate"
+
+// Content signed by the master key
+func certificatePayload(cert *message.Certificate) (payload []byte) {
+	var buf bytes.Buffer
+	buf.WriteString(certificateDomain)
+	binary.Write(&buf, binary.BigEndian, uint32(len(cert.MasterPublicKey)))
+	buf.Write(cert.MasterPublicKey)
+	binary.Write(&buf, binary.BigEndian, uint32(len(cert.SigningPublicKey)))
+	buf.Write(cert.SigningPublicKey)
+	binary.Write(&buf, binary.BigEndian, cert.Expiry)
+	return buf.Bytes()
+}
+
+// Certifies the signing key to act on behalf of the hidden address of the master key until expiry.
+// This is the only operation requiring the master key. Run it offline
+func NewCertificate(master crypto.PrivKey, signing crypto.PubKey, expiry time.Time) (cert *message.Certificate, err error) {
+	masterPub, err := crypto.MarshalPublicKey(master.GetPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal master public key: %w", err)
+	}
+
+	signingPub, err := crypto.MarshalPublicKey(signing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal signing public key: %w", err)
+	}
+
+	cert = &message.Certificate{
+		MasterPublicKey:  masterPub,
+		SigningPublicKey: signingPub,
+		Expiry:           expiry.Unix(),
+	}
+	cert.Signature, err = master.Sign(certificatePayload(cert))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// Hidden address certified. Notice the certificate is not verified
+func HiddenAddressFromCertificate(cert *message.Certificate) (address peer.ID, err error) {
+	masterPub, err := crypto.UnmarshalPublicKey(cert.MasterPublicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal master public key: %w", err)
+	}
+	return HiddenAddressFromPubKey(masterPub)
+}
+
+// Verifies the certificate chains back to the hidden address and is not expired.
+// Returns the certified signing key
+func VerifyCertificate(cert *message.Certificate, address peer.ID) (signing crypto.PubKey, err error) {
+	if cert == nil {
+		return nil, errors.New("no certificate passed")
+	}
+
+	certAddress, err := HiddenAddressFromCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	if certAddress != address {
+		return nil, errors.New("certificate issued for a different address")
+	}
+
+	if time.Now().Unix() >= cert.Expiry {
+		return nil, errors.New("certificate expired")
+	}
+
+	masterPub, err := crypto.UnmarshalPublicKey(cert.MasterPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal master public key: %w", err)
+	}
+
+	valid, err := masterPub.Verify(certificatePayload(cert), cert.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify certificate signature: %w", err)
+	}
+	if !valid {
+		return nil, errors.New("invalid certificate signature")
+	}
+
+	signing, err = crypto.UnmarshalPublicKey(cert.SigningPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal signing public key: %w", err)
+	}
+	return signing, nil
+}
+
+// Hidden address the public key acts for.
+// When a certificate is passed the key should be the certified signing key
+func verifyCredentials(pub crypto.PubKey, cert *message.Certificate) (address peer.ID, err error) {
+	if cert == nil {
+		address, err = HiddenAddressFromPubKey(pub)
+		if err != nil {
+			return "", fmt.Errorf("failed to convert public key to hidden address: %w", err)
+		}
+		return address, nil
+	}
+
+	address, err = HiddenAddressFromCertificate(cert)
+	if err != nil {
+		return "", fmt.Errorf("failed to get address from certificate: %w", err)
+	}
+
+	signing, err := VerifyCertificate(cert, address)
+	if err != nil {
+		return "", fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	if !signing.Equals(pub) {
+		return "", errors.New("certificate issued for a different signing key")
+	}
+	return address, nil
+}
+
+func MarshalCertificate(cert *message.Certificate) (contents []byte, err error) {
+	return msgpack.Marshal(cert)
+}
+
+func UnmarshalCertificate(contents []byte) (cert *message.Certificate, err error) {
+	cert = new(message.Certificate)
+	err = msgpack.Unmarshal(contents, cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func SaveCertificate(location string, cert *message.Certificate) (err error) {
+	contents, err := MarshalCertificate(cert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certificate: %w", err)
+	}
+
+	err = os.WriteFile(location, contents, 0o660)
+	if err != nil {
+		return fmt.Errorf("failed to save certificate: %w", err)
+	}
+	return nil
+}
+
+func LoadCertificate(location string) (cert *message.Certificate, err error) {
+	contents, err := os.ReadFile(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	return UnmarshalCertificate(contents)
+}
@@ -1,10 +1,13 @@
 package onion
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
+	"slices"
 
 	"github.com/RogueTeam/onion/p2p/onion/message"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -65,3 +68,90 @@ func (s *Service) Circuit(peers []peer.ID) (c *Circuit, err error) {
 	}
 	return c, nil
 }
+
+// Number of times RandomCircuit retries when a peer fails to extend the circuit
+const DefaultCircuitAttempts = 5
+
+var (
+	ErrEmptyCircuit   = errors.New("empty circuit")
+	ErrNotEnoughPeers = errors.New("not enough peers for the circuit")
+)
+
+// Builds a circuit of length peers. Picked randomly from ListPeers and ending with the final peers.
+// Fails with ErrNotEnoughPeers instead of building a shorter circuit.
+// Peers failing to extend the circuit are replaced by other random ones. Failing final peers are not retried
+func (s *Service) RandomCircuit(length int, final ...peer.ID) (c *Circuit, err error) {
+	return s.randomCircuit(context.Background(), length, nil, final)
+}
+
+// Same as RandomCircuit but never picks the avoided peers.
+// The context is checked before every extension
+func (s *Service) randomCircuit(ctx context.Context, length int, avoid, final []peer.ID) (c *Circuit, err error) {
+	if length <= 0 && len(final) == 0 {
+		return nil, ErrEmptyCircuit
+	}
+
+	peers, err := s.ListPeers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peers: %w", err)
+	}
+
+	var excluded = append([]peer.ID{s.ID}, avoid...)
+	for range DefaultCircuitAttempts {
+		var candidates []peer.ID
+		for _, p := range peers {
+			if slices.Contains(excluded, p.Info.ID) || slices.Contains(final, p.Info.ID) {
+				continue
+			}
+			candidates = append(candidates, p.Info.ID)
+		}
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		// Just like Tor's guards, already connected peers are preferred as root.
+		// They already know our real identity and are known to be reachable
+		root := slices.IndexFunc(candidates, func(id peer.ID) bool {
+			return s.Host.Network().Connectedness(id) == network.Connected
+		})
+		if root > 0 {
+			candidates[0], candidates[root] = candidates[root], candidates[0]
+		}
+
+		random := max(length-len(final), 0)
+		if len(candidates) < random {
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrNotEnoughPeers, err)
+			}
+			return nil, ErrNotEnoughPeers
+		}
+		candidates = candidates[:random]
+
+		c = &Circuit{
+			Settings: make(map[peer.ID]*message.Settings),
+			Service:  s,
+		}
+		for _, peerId := range append(candidates, final...) {
+			err = ctx.Err()
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+
+			err = c.Extend(peerId)
+			if err != nil {
+				c.Close()
+				err = fmt.Errorf("failed to connect to peer: %s: %w", peerId, err)
+				// Final peers are the destination. Other peers can't replace them
+				if slices.Contains(final, peerId) {
+					return nil, err
+				}
+				excluded = append(excluded, peerId)
+				break
+			}
+		}
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
@@ -2,47 +2,316 @@ package onion
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/RogueTeam/onion/p2p/onion/message"
 	"github.com/RogueTeam/onion/utils"
 	"github.com/hashicorp/yamux"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/security/noise"
 )
 
 type HiddenServiceListener struct {
-	Noise   *noise.Transport
-	PrivKey crypto.PrivKey
-	Session *yamux.Session
+	Address peer.ID
+	// Set for single onion services. Relays flag the service as non-anonymous to its clients
+	NonAnonymous bool
+
+	mutex sync.Mutex
+	// Key used by the bind and the noise responder. When certified it is a signing key instead of the master key
+	privKey crypto.PrivKey
+	// Certificate of the signing key. Nil when the master key is used directly
+	certificate *message.Certificate
+	noise       *noise.Transport
+	// Session with the relay currently hosting the service
+	session *yamux.Session
+	// Listeners of the routed virtual ports
+	ports map[uint16]*HiddenPortListener
+	// Receives the connections of the ports with no listener
+	fallback *HiddenPortListener
+	// Closed once the listener is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	introMutex sync.Mutex
+	introCond  *sync.Cond
+	// Introductions waiting to be handshaked
+	introductions introductionQueue
+	// Effort suggested to the clients
+	effort        uint64
+	effortChanged chan struct{}
+}
+
+// Hidden address served by the key. When a certificate is passed the key should be the certified signing key
+func hiddenAddressFromCredentials(priv crypto.PrivKey, cert *message.Certificate) (address peer.ID, err error) {
+	return verifyCredentials(priv.GetPublic(), cert)
+}
+
+func newHiddenServiceListener(priv crypto.PrivKey, cert *message.Certificate) (h *HiddenServiceListener, err error) {
+	hiddenAddress, err := hiddenAddressFromCredentials(priv, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	h = &HiddenServiceListener{
+		Address: hiddenAddress,
+		ports:   make(map[uint16]*HiddenPortListener),
+		closed:  make(chan struct{}),
+
+		effortChanged: make(chan struct{}, 1),
+	}
+	err = h.setCredentials(priv, cert)
+	if err != nil {
+		return nil, err
+	}
+	h.fallback = newHiddenPortListener(h, 0)
+	h.introCond = sync.NewCond(&h.introMutex)
+
+	for range DefaultIntroductionWorkers {
+		go h.introductionWorker()
+	}
+	return h, nil
 }
 
 func (h *HiddenServiceListener) Close() (err error) {
-	return h.Session.Close()
+	h.closeOnce.Do(func() {
+		close(h.closed)
+		h.drainIntroductions()
+
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if h.session != nil {
+			err = h.session.Close()
+		}
+	})
+	return err
+}
+
+// Session with the relay currently hosting the service.
+// Supervised listeners replace it on every rebind
+func (h *HiddenServiceListener) Session() (session *yamux.Session) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.session
+}
+
+// Certificate of the signing key currently in use. Nil when the master key is used directly
+func (h *HiddenServiceListener) Certificate() (cert *message.Certificate) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.certificate
+}
+
+// Replaces the key used by the noise responder. Allows rotating signing keys without changing the address
+func (h *HiddenServiceListener) setCredentials(priv crypto.PrivKey, cert *message.Certificate) (err error) {
+	hiddenAddress, err := hiddenAddressFromCredentials(priv, cert)
+	if err != nil {
+		return err
+	}
+	if hiddenAddress != h.Address {
+		return errors.New("credentials of a different hidden address")
+	}
+
+	noiseTransport, err := noise.New(ProtocolId, priv, DefaultMuxerUpgrader)
+	if err != nil {
+		return fmt.Errorf("failed to create noise tranport: %w", err)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.privKey = priv
+	h.certificate = cert
+	h.noise = noiseTransport
+	return nil
+}
+
+func (h *HiddenServiceListener) credentials() (priv crypto.PrivKey, cert *message.Certificate, noiseTransport *noise.Transport) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.privKey, h.certificate, h.noise
 }
 
-// Accept hidden service connections
-func (h *HiddenServiceListener) Accept() (conn io.ReadWriteCloser, err error) {
-	insecure, err := h.Session.Accept()
+// Accept hidden service connections whose virtual port has no listener or handler
+func (h *HiddenServiceListener) Accept() (conn net.Conn, err error) {
+	return h.fallback.Accept()
+}
+
+func (h *HiddenServiceListener) Addr() (addr net.Addr) {
+	return &Addr{Address: h.Address}
+}
+
+// Routes the connections of the virtual port into the returned listener
+func (h *HiddenServiceListener) Listen(port uint16) (l *HiddenPortListener, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, found := h.ports[port]; found {
+		return nil, fmt.Errorf("port %d already routed", port)
+	}
+
+	l = newHiddenPortListener(h, port)
+	h.ports[port] = l
+	return l, nil
+}
+
+// Serves every connection of the virtual port with the handler.
+// Each connection is handled in its own goroutine
+func (h *HiddenServiceListener) Handle(port uint16, handler HiddenServiceHandler) (err error) {
+	l, err := h.Listen(port)
 	if err != nil {
-		return nil, fmt.Errorf("failed to accept connection: %w", err)
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	return nil
+}
+
+func (h *HiddenServiceListener) unroute(l *HiddenPortListener) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.ports[l.Port] == l {
+		delete(h.ports, l.Port)
+	}
+}
+
+func (h *HiddenServiceListener) route(port uint16) (l *HiddenPortListener) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	l, found := h.ports[port]
+	if !found {
+		return h.fallback
+	}
+	return l
+}
+
+// Replaces the session with the relay. Fails if the listener is already closed
+func (h *HiddenServiceListener) setSession(session *yamux.Session) (err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	select {
+	case <-h.closed:
+		session.Close()
+		return net.ErrClosed
+	default:
+		h.session = session
+		return nil
+	}
+}
+
+// Accepts the streams forwarded by the relay until the session is closed.
+// Streams are handshaked by priority based on the effort paid by the client
+func (h *HiddenServiceListener) serve(session *yamux.Session) {
+	go h.advertiseEffort(session)
+
+	for {
+		insecure, err := session.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			effort, err := h.receiveIntroduction(insecure)
+			if err != nil {
+				insecure.Close()
+				log.Printf("failed to introduce hidden service connection: %v", err)
+				return
+			}
+
+			h.enqueue(&introduction{
+				conn:    insecure,
+				effort:  effort,
+				arrival: time.Now(),
+			})
+		}()
 	}
+}
+
+// Upgrades the stream and routes it based on the requested virtual port
+func (h *HiddenServiceListener) handshake(insecure net.Conn) (err error) {
+	ctx, cancel := utils.NewContextWithTimeout(DefaultIntroductionTimeout)
+	defer cancel()
 
-	ctx, _ := utils.NewContext()
+	_, _, noiseTransport := h.credentials()
+	secure, err := noiseTransport.SecureInbound(ctx, insecure, "")
+	if err != nil {
+		return fmt.Errorf("failed to upgrade insecure: %w", err)
+	}
 
-	conn, err = h.Noise.SecureInbound(ctx, insecure, "")
+	secure.SetReadDeadline(time.Now().Add(DefaultIntroductionTimeout))
+	var msg message.Message
+	err = msg.Recv(secure, DefaultSettings)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upgrade insecure: %w", err)
+		return fmt.Errorf("failed to receive virtual port: %w", err)
+	}
+	secure.SetReadDeadline(time.Time{})
+
+	if msg.Data.VirtualPort == nil {
+		return errors.New("no virtual port received")
 	}
-	return conn, nil
+
+	port := msg.Data.VirtualPort.Port
+	h.route(port).deliver(&HiddenConn{
+		Conn:   secure,
+		Local:  &Addr{Address: h.Address, Port: port},
+		Remote: &Addr{Address: secure.RemotePeer()},
+	})
+	return nil
 }
 
-// Binds a hidden service based on a private key
+// Binds a hidden service based on a private key.
+// The listener is closed once the relay session ends. Check Service.BindHidden for a supervised alternative
 func (c *Circuit) Bind(priv crypto.PrivKey) (h *HiddenServiceListener, err error) {
-	hiddenAddress, err := HiddenAddressFromPrivKey(priv)
+	return c.BindCertified(priv, nil)
+}
+
+// Binds a hidden service using a signing key certified by the master key of the address.
+// The master key never touches the serving machine. Relays drop the bind once the certificate expires
+func (c *Circuit) BindCertified(signing crypto.PrivKey, cert *message.Certificate) (h *HiddenServiceListener, err error) {
+	h, err = newHiddenServiceListener(signing, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := c.bind(signing, cert, false)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.setSession(session)
+
+	go func() {
+		defer h.Close()
+		h.serve(session)
+	}()
+	return h, nil
+}
+
+// Requests the last peer of the circuit to host the hidden service.
+// The certificate is optional and only required when the key is a signing key
+func (c *Circuit) bind(priv crypto.PrivKey, cert *message.Certificate, nonAnonymous bool) (session *yamux.Session, err error) {
+	hiddenAddress, err := hiddenAddressFromCredentials(priv, cert)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get address from private key: %w", err)
+		return nil, err
 	}
 
 	pubMarshaled, err := crypto.MarshalPublicKey(priv.GetPublic())
@@ -60,6 +329,8 @@ func (c *Circuit) Bind(priv crypto.PrivKey) (h *HiddenServiceListener, err error
 			Bind: &message.Bind{
 				HexPublicKey: hex.EncodeToString(pubMarshaled),
 				HexSignature: hex.EncodeToString(sign),
+				Certificate:  cert,
+				NonAnonymous: nonAnonymous,
 			},
 		},
 	}
@@ -68,26 +339,11 @@ func (c *Circuit) Bind(priv crypto.PrivKey) (h *HiddenServiceListener, err error
 		return nil, fmt.Errorf("failed to send bind: %w", err)
 	}
 
-	session, err := yamux.Server(c.Active, yamux.DefaultConfig())
+	session, err = yamux.Server(c.Active, yamux.DefaultConfig())
 	if err != nil {
 		return nil, fmt.Errorf("failed to upgrade yamux: %w", err)
 	}
-	defer func() {
-		if err == nil {
-			return
-		}
-		session.Close()
-	}()
-
-	noiseTransport, err := noise.New(ProtocolId, priv, DefaultMuxerUpgrader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create noise tranport: %w", err)
-	}
-
-	h = &HiddenServiceListener{
-		Noise:   noiseTransport,
-		PrivKey: priv,
-		Session: session,
-	}
-	return h, nil
+	return session, nil
 }
+
+var _ net.Listener = (*HiddenServiceListener)(nil)
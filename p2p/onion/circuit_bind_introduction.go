@@ -0,0 +1,205 @@
+package onion
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
+	"github.com/hashicorp/yamux"
+)
+
+const (
+	// Number of introductions handshaked concurrently by a hidden service
+	DefaultIntroductionWorkers = 16
+	// Maximum number of introductions waiting for a worker. Lowest effort ones are dropped first
+	DefaultIntroductionBacklog = 1024
+)
+
+// Stream forwarded by the relay waiting to be handshaked
+type introduction struct {
+	conn    net.Conn
+	effort  uint64
+	arrival time.Time
+}
+
+// Priority queue of introductions. Higher effort first, then the oldest
+type introductionQueue []*introduction
+
+func (q introductionQueue) Len() int { return len(q) }
+func (q introductionQueue) Less(i, j int) bool {
+	if q[i].effort != q[j].effort {
+		return q[i].effort > q[j].effort
+	}
+	return q[i].arrival.Before(q[j].arrival)
+}
+func (q introductionQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *introductionQueue) Push(x any)   { *q = append(*q, x.(*introduction)) }
+func (q *introductionQueue) Pop() any {
+	old := *q
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return last
+}
+
+// Effort currently suggested to the clients
+func (h *HiddenServiceListener) Effort() (effort uint64) {
+	h.introMutex.Lock()
+	defer h.introMutex.Unlock()
+
+	return h.effort
+}
+
+// Effort grows logarithmically with the number of introductions waiting.
+// Clients are notified through the relay every time it changes.
+// Should be called with introMutex locked
+func (h *HiddenServiceListener) updateEffort() {
+	effort := hashcash.LogDifficulty(hashcash.DefaultHashAlgorithm(), int64(max(len(h.introductions), 1)))
+	if effort == h.effort {
+		return
+	}
+	h.effort = effort
+
+	select {
+	case h.effortChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (h *HiddenServiceListener) enqueue(intro *introduction) {
+	h.introMutex.Lock()
+
+	select {
+	case <-h.closed:
+		h.introMutex.Unlock()
+		intro.conn.Close()
+		return
+	default:
+	}
+
+	heap.Push(&h.introductions, intro)
+
+	var dropped *introduction
+	if len(h.introductions) > DefaultIntroductionBacklog {
+		lowest := 0
+		for index := range h.introductions {
+			if h.introductions.Less(lowest, index) {
+				lowest = index
+			}
+		}
+		dropped = heap.Remove(&h.introductions, lowest).(*introduction)
+	}
+	h.updateEffort()
+
+	h.introMutex.Unlock()
+	h.introCond.Signal()
+
+	if dropped != nil {
+		dropped.conn.Close()
+	}
+}
+
+// Waits for the introduction with the highest effort. Fails once the listener is closed
+func (h *HiddenServiceListener) dequeue() (intro *introduction, err error) {
+	h.introMutex.Lock()
+	defer h.introMutex.Unlock()
+
+	for {
+		select {
+		case <-h.closed:
+			return nil, net.ErrClosed
+		default:
+		}
+
+		if len(h.introductions) > 0 {
+			break
+		}
+		h.introCond.Wait()
+	}
+
+	intro = heap.Pop(&h.introductions).(*introduction)
+	h.updateEffort()
+	return intro, nil
+}
+
+// Releases the waiting workers and introductions
+func (h *HiddenServiceListener) drainIntroductions() {
+	h.introMutex.Lock()
+	defer h.introMutex.Unlock()
+
+	for _, intro := range h.introductions {
+		intro.conn.Close()
+	}
+	h.introductions = nil
+	h.introCond.Broadcast()
+}
+
+func (h *HiddenServiceListener) introductionWorker() {
+	for {
+		intro, err := h.dequeue()
+		if err != nil {
+			return
+		}
+
+		err = h.handshake(intro.conn)
+		if err != nil {
+			intro.conn.Close()
+			log.Printf("failed to handshake hidden service connection: %v", err)
+		}
+	}
+}
+
+// Receives the introduction forwarded by the relay
+func (h *HiddenServiceListener) receiveIntroduction(insecure net.Conn) (effort uint64, err error) {
+	insecure.SetReadDeadline(time.Now().Add(DefaultIntroductionTimeout))
+	defer insecure.SetReadDeadline(time.Time{})
+
+	var msg message.Message
+	err = msg.Recv(insecure, DefaultSettings)
+	if err != nil {
+		return 0, fmt.Errorf("failed to receive introduction: %w", err)
+	}
+
+	if msg.Data.Introduction == nil {
+		return 0, errors.New("no introduction received")
+	}
+	return msg.Data.Introduction.Effort, nil
+}
+
+// Sends the current descriptor to the relay every time the effort changes
+func (h *HiddenServiceListener) advertiseEffort(session *yamux.Session) {
+	control, err := session.Open()
+	if err != nil {
+		log.Printf("failed to open descriptor stream: %v", err)
+		return
+	}
+	defer control.Close()
+
+	for {
+		var descriptor = message.Message{
+			Data: message.Data{
+				Descriptor: &message.Descriptor{
+					Effort: h.Effort(),
+				},
+			},
+		}
+		err = descriptor.Send(control, DefaultSettings)
+		if err != nil {
+			log.Printf("failed to send descriptor: %v", err)
+			return
+		}
+
+		select {
+		case <-h.effortChanged:
+		case <-session.CloseChan():
+			return
+		case <-h.closed:
+			return
+		}
+	}
+}
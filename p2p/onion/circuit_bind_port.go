@@ -0,0 +1,91 @@
+package onion
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Connections waiting for Accept on each virtual port. Following ones are closed
+const DefaultHiddenPortBacklog = 32
+
+// Function serving a single hidden service connection.
+// Implementations are responsible of closing the connection
+type HiddenServiceHandler func(conn net.Conn)
+
+// Listener of a single virtual port of a hidden service.
+// Just like Tor's HiddenServicePort, allows multiple applications under the same hidden address
+type HiddenPortListener struct {
+	// Virtual port routed to this listener
+	Port uint16
+
+	parent *HiddenServiceListener
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newHiddenPortListener(parent *HiddenServiceListener, port uint16) (l *HiddenPortListener) {
+	return &HiddenPortListener{
+		Port:   port,
+		parent: parent,
+		conns:  make(chan net.Conn, DefaultHiddenPortBacklog),
+		closed: make(chan struct{}),
+	}
+}
+
+// Stops routing the port. Following connections to the port are received by the parent listener.
+// Connections not accepted yet are closed
+func (l *HiddenPortListener) Close() (err error) {
+	l.once.Do(func() {
+		l.parent.unroute(l)
+		close(l.closed)
+		for {
+			select {
+			case conn := <-l.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// Accept connections to the virtual port
+func (l *HiddenPortListener) Accept() (conn net.Conn, err error) {
+	select {
+	case conn = <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.parent.closed:
+		return nil, fmt.Errorf("hidden service closed: %w", net.ErrClosed)
+	}
+}
+
+func (l *HiddenPortListener) Addr() (addr net.Addr) {
+	return &Addr{Address: l.parent.Address, Port: l.Port}
+}
+
+// Queues the connection for Accept without blocking the introduction workers.
+// Closed when the backlog is full or the listener closed
+func (l *HiddenPortListener) deliver(conn net.Conn) {
+	select {
+	case <-l.closed:
+		conn.Close()
+		return
+	case <-l.parent.closed:
+		conn.Close()
+		return
+	default:
+	}
+
+	select {
+	case l.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+var _ net.Listener = (*HiddenPortListener)(nil)
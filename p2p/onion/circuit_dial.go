@@ -1,8 +1,9 @@
 package onion
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"net"
 
 	"github.com/RogueTeam/onion/p2p/identity"
 	"github.com/RogueTeam/onion/p2p/onion/message"
@@ -22,20 +23,95 @@ func (h *HiddenServiceConnection) Close() (err error) {
 	return h.Session.Close()
 }
 
-func (h *HiddenServiceConnection) Open() (conn io.ReadWriteCloser, err error) {
+// Opens a new connection to the virtual port of the hidden service.
+// The introduction puzzle suggested by the relay is solved before the service is reached
+func (h *HiddenServiceConnection) Open(port uint16) (conn net.Conn, err error) {
 	insecure, err := h.Session.Open()
 	if err != nil {
 		return nil, fmt.Errorf("failed to open connection: %w", err)
 	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		insecure.Close()
+	}()
+
+	descriptor, remote, err := h.introduce(insecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to introduce: %w", err)
+	}
 
 	ctx, _ := utils.NewContext()
-	conn, err = h.Noise.SecureOutbound(ctx, insecure, h.Address)
+	secure, err := h.Noise.SecureOutbound(ctx, insecure, remote)
 	if err != nil {
 		return nil, fmt.Errorf("failed upgrade connection: %w", err)
 	}
+
+	var virtualPort = message.Message{
+		Data: message.Data{
+			VirtualPort: &message.VirtualPort{
+				Port: port,
+			},
+		},
+	}
+	err = virtualPort.Send(secure, DefaultSettings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send virtual port: %w", err)
+	}
+
+	conn = &HiddenConn{
+		Conn:   secure,
+		Local:  &Addr{Address: secure.LocalPeer()},
+		Remote: &Addr{Address: h.Address, Port: port},
+
+		NonAnonymous: descriptor.NonAnonymous,
+	}
 	return conn, nil
 }
 
+// Receives the descriptor from the relay and solves the introduction with the suggested effort.
+// Returns the descriptor and the peer expected at the noise handshake. The signing key when the service is certified
+func (h *HiddenServiceConnection) introduce(insecure net.Conn) (descriptor *message.Descriptor, remote peer.ID, err error) {
+	var msg message.Message
+	err = msg.Recv(insecure, DefaultSettings)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to receive descriptor: %w", err)
+	}
+
+	descriptor = msg.Data.Descriptor
+	if descriptor == nil {
+		return nil, "", errors.New("no descriptor received")
+	}
+
+	remote = h.Address
+	if descriptor.Certificate != nil {
+		signing, err := VerifyCertificate(descriptor.Certificate, h.Address)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid certificate: %w", err)
+		}
+
+		remote, err = peer.IDFromPublicKey(signing)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get signing key id: %w", err)
+		}
+	}
+
+	var introduction = message.Message{
+		Data: message.Data{
+			Introduction: &message.Introduction{
+				Address: h.Address,
+				Nonce:   descriptor.Nonce,
+			},
+		},
+	}
+	err = introduction.Send(insecure, &message.Settings{PoWDifficulty: descriptor.Effort})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to send introduction: %w", err)
+	}
+	return descriptor, remote, nil
+}
+
 // Receives the DefaultHashAlgorithm of the public key of the hidden service and returns a yamux.Session
 // The yamux session can create multiple dials to the same address using the session.Open method.
 // The circuit should be constructed in order to force the last node be the one advertising the service.
@@ -0,0 +1,97 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Publishes the signed listing through the last peer of the circuit. Check NewListing
+func (c *Circuit) Publish(listing *message.Listing) (err error) {
+	hc, err := listingHashcash(listing)
+	if err != nil {
+		return fmt.Errorf("failed to calculate publish hashcash: %w", err)
+	}
+
+	var req = message.Message{
+		Data: message.Data{
+			Publish: &message.Publish{
+				Listing:  *listing,
+				Hashcash: hc,
+			},
+		},
+	}
+	err = req.Send(c.Active, c.Settings[c.Current])
+	if err != nil {
+		return fmt.Errorf("failed to send publish: %w", err)
+	}
+
+	_, err = c.recvDirectoryResponse()
+	return err
+}
+
+// Requests the listing of the address to the last peer of the circuit
+func (c *Circuit) Listing(address peer.ID) (listing *message.Listing, err error) {
+	listings, err := c.directoryQuery(&message.DirectoryQuery{Address: address})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, listing := range listings {
+		if listing.Address == address {
+			return &listing, nil
+		}
+	}
+	return nil, errors.New("listing not found")
+}
+
+// Searches the listings known by the last peer of the circuit. An empty search lists all of them
+func (c *Circuit) SearchDirectory(search string) (listings []message.Listing, err error) {
+	return c.directoryQuery(&message.DirectoryQuery{Search: search})
+}
+
+// Sends the query and returns the listings passing the verification
+func (c *Circuit) directoryQuery(query *message.DirectoryQuery) (listings []message.Listing, err error) {
+	var req = message.Message{
+		Data: message.Data{
+			DirectoryQuery: query,
+		},
+	}
+	err = req.Send(c.Active, c.Settings[c.Current])
+	if err != nil {
+		return nil, fmt.Errorf("failed to send directory query: %w", err)
+	}
+
+	received, err := c.recvDirectoryResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	// Relays are not trusted
+	for _, listing := range received {
+		if VerifyListing(&listing) != nil || !matchListing(&listing, query.Search) {
+			continue
+		}
+		listings = append(listings, listing)
+	}
+	return listings, nil
+}
+
+func (c *Circuit) recvDirectoryResponse() (listings []message.Listing, err error) {
+	var res message.Message
+	err = res.Recv(c.Active, DefaultSettings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recv response: %w", err)
+	}
+
+	response := res.Data.DirectoryResponse
+	if response == nil {
+		return nil, errors.New("no directory response found")
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("directory error: %s", response.Error)
+	}
+	return response.Listings, nil
+}
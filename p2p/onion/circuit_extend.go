@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/RogueTeam/onion/p2p/identity"
 	"github.com/RogueTeam/onion/p2p/onion/message"
@@ -15,6 +16,9 @@ import (
 	"github.com/libp2p/go-libp2p/p2p/security/noise"
 )
 
+// Maximum time waited for a new peer to handshake
+const DefaultExtendTimeout = 30 * time.Second
+
 // Extends the circuit with a new peer.
 // This function assumes the passed id corresponds to a valid onion protocol peer.
 // Use ListPeers for more details
@@ -61,6 +65,10 @@ func (c *Circuit) Extend(id peer.ID) (err error) {
 		}
 	}
 
+	// Unresponsive peers should not block the circuit forever
+	conn.SetDeadline(time.Now().Add(DefaultExtendTimeout))
+	defer conn.SetDeadline(time.Time{})
+
 	// Retrieve settings
 	var settingsMsg message.Message
 	err = settingsMsg.Recv(conn, DefaultSettings)
@@ -10,6 +10,7 @@ import (
 
 // Connect to a remote service outside the onion network.
 // Notice the last peer of the circuit chain should support external connections.
+// DNS multiaddrs are resolved by the exit node, so hostnames don't leak outside the circuit.
 // You can check this by doing the proper filtering once you called ListPeers
 func (c *Circuit) External(maddr multiaddr.Multiaddr) (conn net.Conn, err error) {
 	var external = message.Message{
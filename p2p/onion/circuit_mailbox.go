@@ -0,0 +1,108 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Deposits a message for the hidden address at the last peer of the circuit.
+// The peer stores it until the owner of the address fetches it. Payloads should be sealed for the owner with SealMailboxPayload
+func (c *Circuit) Deposit(address peer.ID, payload []byte) (err error) {
+	settings := c.Settings[c.Current]
+	if !settings.Mailbox {
+		return errors.New("peer doesn't support mailbox mode")
+	}
+	if settings.MailboxMessageSize > 0 && len(payload) > settings.MailboxMessageSize {
+		return ErrMailboxMessageTooBig
+	}
+
+	deposit, err := NewDeposit(c.Current, address, payload, settings.MailboxDifficulty)
+	if err != nil {
+		return err
+	}
+
+	var req = message.Message{
+		Data: message.Data{
+			Deposit: deposit,
+		},
+	}
+	err = req.Send(c.Active, settings)
+	if err != nil {
+		return fmt.Errorf("failed to send deposit: %w", err)
+	}
+
+	_, err = c.recvMailboxResponse()
+	return err
+}
+
+// Fetches the messages stored for the hidden address of the key at the last peer of the circuit.
+// When a certificate is passed the key should be the certified signing key
+func (c *Circuit) FetchMailbox(priv crypto.PrivKey, cert *message.Certificate) (messages []message.MailboxMessage, err error) {
+	return c.mailboxRequest(priv, cert, nil)
+}
+
+// Deletes the messages with the passed ids from the mailbox at the last peer of the circuit
+func (c *Circuit) DeleteMailbox(priv crypto.PrivKey, cert *message.Certificate, ids []string) (err error) {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err = c.mailboxRequest(priv, cert, ids)
+	return err
+}
+
+func (c *Circuit) mailboxRequest(priv crypto.PrivKey, cert *message.Certificate, ids []string) (messages []message.MailboxMessage, err error) {
+	address, err := hiddenAddressFromCredentials(priv, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	pubMarshaled, err := crypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+
+	mailboxReq := &message.MailboxRequest{
+		PublicKey:   pubMarshaled,
+		Certificate: cert,
+		Timestamp:   time.Now().Unix(),
+		Delete:      ids,
+	}
+	mailboxReq.Signature, err = priv.Sign(mailboxRequestPayload(c.Current, address, mailboxReq))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+
+	var req = message.Message{
+		Data: message.Data{
+			MailboxRequest: mailboxReq,
+		},
+	}
+	err = req.Send(c.Active, c.Settings[c.Current])
+	if err != nil {
+		return nil, fmt.Errorf("failed to send mailbox request: %w", err)
+	}
+
+	return c.recvMailboxResponse()
+}
+
+func (c *Circuit) recvMailboxResponse() (messages []message.MailboxMessage, err error) {
+	var res message.Message
+	err = res.Recv(c.Active, DefaultSettings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recv response: %w", err)
+	}
+
+	response := res.Data.MailboxResponse
+	if response == nil {
+		return nil, errors.New("no mailbox response found")
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("mailbox error: %s", response.Error)
+	}
+	return response.Messages, nil
+}
@@ -0,0 +1,82 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+)
+
+// Registers the signed name record through the last peer of the circuit. Check NewNameRecord
+func (c *Circuit) RegisterName(rec *message.NameRecord) (err error) {
+	var req = message.Message{
+		Data: message.Data{
+			RegisterName: &message.RegisterName{
+				Record: *rec,
+			},
+		},
+	}
+	err = req.Send(c.Active, c.Settings[c.Current])
+	if err != nil {
+		return fmt.Errorf("failed to send register name: %w", err)
+	}
+
+	_, err = c.recvNameResponse()
+	return err
+}
+
+// Requests the record of the name to the last peer of the circuit. The record is verified
+func (c *Circuit) NameRecord(name string) (rec *message.NameRecord, err error) {
+	name = normalizeName(name)
+	err = ValidateName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var req = message.Message{
+		Data: message.Data{
+			NameQuery: &message.NameQuery{
+				Name: name,
+			},
+		},
+	}
+	err = req.Send(c.Active, c.Settings[c.Current])
+	if err != nil {
+		return nil, fmt.Errorf("failed to send name query: %w", err)
+	}
+
+	rec, err = c.recvNameResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	// Relays are not trusted
+	if rec.Name != name {
+		return nil, errors.New("received record of a different name")
+	}
+	err = VerifyNameRecord(rec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name record: %w", err)
+	}
+	return rec, nil
+}
+
+func (c *Circuit) recvNameResponse() (rec *message.NameRecord, err error) {
+	var res message.Message
+	err = res.Recv(c.Active, DefaultSettings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recv response: %w", err)
+	}
+
+	response := res.Data.NameResponse
+	if response == nil {
+		return nil, errors.New("no name response found")
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("name error: %s", response.Error)
+	}
+	if response.Record == nil {
+		return nil, errors.New("no name record found")
+	}
+	return response.Record, nil
+}
@@ -0,0 +1,66 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+)
+
+var (
+	// Returned when the exit reports the host doesn't exist
+	ErrHostNotFound = errors.New("host not found")
+	// Returned when the exit fails resolving the host. The circuit remains usable
+	ErrResolve = errors.New("resolve error")
+)
+
+// Resolves the host at the last peer of the circuit. It should be an exit node.
+// Network is ip, ip4 or ip6
+func (c *Circuit) Resolve(network, host string) (ips []net.IP, err error) {
+	ips, _, err = c.Lookup(network, host)
+	return ips, err
+}
+
+// Same as Resolve but also returns the time the exit allows caching the addresses
+func (c *Circuit) Lookup(network, host string) (ips []net.IP, ttl time.Duration, err error) {
+	var req = message.Message{
+		Data: message.Data{
+			Resolve: &message.Resolve{
+				Host:    host,
+				Network: network,
+			},
+		},
+	}
+	err = req.Send(c.Active, c.Settings[c.Current])
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to send resolve: %w", err)
+	}
+
+	var res message.Message
+	err = res.Recv(c.Active, DefaultSettings)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to recv response: %w", err)
+	}
+
+	response := res.Data.ResolveResponse
+	if response == nil {
+		return nil, 0, errors.New("no resolve response found")
+	}
+	if response.NotFound {
+		return nil, 0, fmt.Errorf("%w: %s", ErrHostNotFound, host)
+	}
+	if response.Error != "" {
+		return nil, 0, fmt.Errorf("%w: %s", ErrResolve, response.Error)
+	}
+
+	for _, address := range response.Addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, 0, fmt.Errorf("invalid resolved address: %s", address)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, time.Duration(response.TTL) * time.Second, nil
+}
@@ -0,0 +1,25 @@
+package onion
+
+import (
+	"fmt"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Opens an UDP association with the /udp destination at the last peer of the circuit.
+// Notice it should be an exit node. Each Write of the returned connection sends a datagram and each Read receives one
+func (c *Circuit) UDPAssociate(maddr multiaddr.Multiaddr) (conn *DatagramConn, err error) {
+	var associate = message.Message{
+		Data: message.Data{
+			UDPAssociate: &message.UDPAssociate{
+				Address: maddr,
+			},
+		},
+	}
+	err = associate.Send(c.Active, c.Settings[c.Current])
+	if err != nil {
+		return nil, fmt.Errorf("failed to send udp associate: %w", err)
+	}
+	return &DatagramConn{Conn: c.Active}, nil
+}
@@ -3,10 +3,13 @@ package onion
 import (
 	"time"
 
+	"github.com/RogueTeam/onion/p2p/onion/exitpolicy"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 )
 
+const DefaultHops = 3
+
 type Config struct {
 	// LIBP2P host already listening and running
 	Host host.Host
@@ -22,14 +25,45 @@ type Config struct {
 	// This basically connects the node into a proxy to the clearnet
 	// Just like Tor's Exit nodes.
 	ExitNode bool
+	// Destinations exit nodes are allowed to connect to. Nil uses exitpolicy.Default
+	ExitPolicy exitpolicy.Policy
+	// Abuse controls of exit nodes. Zero values use the defaults
+	ExitLimits ExitLimitsConfig
+	// Idle time after which exit nodes close UDP associations
+	UDPIdleTimeout time.Duration
 	// Time To Live
 	TTL time.Duration
+	// Number of peers used by the circuits the service builds on its own. Like the ones of DialHidden
+	Hops int
+	// Maximum number of hidden services bound at this node. Negative means unlimited
+	MaxHiddenServices int
+	// Limits of the traffic relayed by the node. Nil is unlimited
+	Bandwidth *BandwidthConfig
+	// Quota of traffic relayed per period. The node hibernates when it is nearly exhausted. Nil is unlimited
+	Accounting *AccountingConfig
+	// Enables the mailbox role. The node stores messages for hidden services currently offline
+	Mailbox *MailboxConfig
+	// Set when the DHT was built with DHTOptions. The node stores names and directory listings,
+	// and clients pick it as the last hop of their registrations and lookups
+	Records bool
 }
 
 func (c Config) defaults() (cfg Config) {
 	if c.TTL == 0 {
 		c.TTL = time.Minute
 	}
+	if c.Hops == 0 {
+		c.Hops = DefaultHops
+	}
+	if c.UDPIdleTimeout == 0 {
+		c.UDPIdleTimeout = DefaultUDPIdleTimeout
+	}
+	if c.ExitPolicy == nil {
+		c.ExitPolicy = exitpolicy.Default()
+	}
+	if c.MaxHiddenServices == 0 {
+		c.MaxHiddenServices = DefaultMaxHiddenServices
+	}
 	return c
 }
 
@@ -38,6 +72,51 @@ func (c Config) WithTTL(d time.Duration) (cfg Config) {
 	return c
 }
 
+func (c Config) WithHops(hops int) (cfg Config) {
+	c.Hops = hops
+	return c
+}
+
+func (c Config) WithMaxHiddenServices(n int) (cfg Config) {
+	c.MaxHiddenServices = n
+	return c
+}
+
+func (c Config) WithExitPolicy(policy exitpolicy.Policy) (cfg Config) {
+	c.ExitPolicy = policy
+	return c
+}
+
+func (c Config) WithExitLimits(limits ExitLimitsConfig) (cfg Config) {
+	c.ExitLimits = limits
+	return c
+}
+
+func (c Config) WithUDPIdleTimeout(d time.Duration) (cfg Config) {
+	c.UDPIdleTimeout = d
+	return c
+}
+
+func (c Config) WithBandwidth(bandwidth BandwidthConfig) (cfg Config) {
+	c.Bandwidth = &bandwidth
+	return c
+}
+
+func (c Config) WithAccounting(accounting AccountingConfig) (cfg Config) {
+	c.Accounting = &accounting
+	return c
+}
+
+func (c Config) WithMailbox(mailbox MailboxConfig) (cfg Config) {
+	c.Mailbox = &mailbox
+	return c
+}
+
+func (c Config) WithRecords(records bool) (cfg Config) {
+	c.Records = records
+	return c
+}
+
 func (c Config) WithHost(host host.Host) (cfg Config) {
 	c.Host = host
 	return c
@@ -54,5 +133,8 @@ func DefaultConfig() (cfg Config) {
 		HiddenMode: false,
 		ExitNode:   false,
 		TTL:        time.Minute,
+		Hops:       DefaultHops,
+
+		MaxHiddenServices: DefaultMaxHiddenServices,
 	}
 }
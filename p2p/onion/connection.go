@@ -3,16 +3,16 @@ package onion
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/RogueTeam/onion/p2p/log"
+	"github.com/RogueTeam/onion/p2p/onion/exitpolicy"
 	"github.com/RogueTeam/onion/p2p/onion/message"
-	"github.com/RogueTeam/onion/utils"
-	"github.com/hashicorp/yamux"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"golang.org/x/time/rate"
 )
 
 // Unit responsible to handle a single stream to a peer
@@ -38,8 +38,30 @@ type Connection struct {
 	Secured bool
 	// Used for identifying those peers that support External mode (Exit nodes)
 	ExitNode bool
+	// Destinations allowed in External
+	ExitPolicy exitpolicy.Policy
+	// Outbound connections of the remote peers. Nil when not an exit node
+	ExitLimits *ExitLimits
+	// Resolver of the hosts requested by clients
+	Resolver *Resolver
+	// UDP associations without traffic for this time are closed
+	UDPIdleTimeout time.Duration
+	// Token buckets throttling the relayed traffic
+	Limiters []*rate.Limiter
+	// Traffic relayed through this connection
+	Traffic *Traffic
+	// Traffic relayed by the whole node
+	TotalTraffic *Traffic
+	// Relayed bytes of the accounting period. Nil disables the accounting
+	Accounting *Accounting
 	// Storage for hidden services
-	HiddenServices *utils.Map[peer.ID, *yamux.Session]
+	HiddenServices *HiddenServiceRegistry
+	// Messages of offline hidden services. Nil when the mailbox role is disabled
+	Mailbox *Mailbox
+	// Listings of the public directory published through this node
+	Directory *Directory
+	// Interval between advertisements of the hidden services
+	TTL time.Duration
 }
 
 // Base logic for handling the connection
@@ -91,6 +113,46 @@ func (c *Connection) Handle() (err error) {
 			if err != nil {
 				return fmt.Errorf("failed to handle bind: %w", err)
 			}
+		case msg.Data.Deposit != nil:
+			err = c.Deposit(&msg)
+			if err != nil {
+				return fmt.Errorf("failed to handle deposit: %w", err)
+			}
+		case msg.Data.MailboxRequest != nil:
+			err = c.MailboxRequest(&msg)
+			if err != nil {
+				return fmt.Errorf("failed to handle mailbox request: %w", err)
+			}
+		case msg.Data.Publish != nil:
+			err = c.Publish(&msg)
+			if err != nil {
+				return fmt.Errorf("failed to handle publish: %w", err)
+			}
+		case msg.Data.DirectoryQuery != nil:
+			err = c.DirectoryQuery(&msg)
+			if err != nil {
+				return fmt.Errorf("failed to handle directory query: %w", err)
+			}
+		case msg.Data.RegisterName != nil:
+			err = c.RegisterName(&msg)
+			if err != nil {
+				return fmt.Errorf("failed to handle register name: %w", err)
+			}
+		case msg.Data.NameQuery != nil:
+			err = c.NameQuery(&msg)
+			if err != nil {
+				return fmt.Errorf("failed to handle name query: %w", err)
+			}
+		case msg.Data.UDPAssociate != nil:
+			err = c.UDPAssociate(&msg)
+			if err != nil {
+				return fmt.Errorf("failed to handle udp associate: %w", err)
+			}
+		case msg.Data.Resolve != nil:
+			err = c.Resolve(&msg)
+			if err != nil {
+				return fmt.Errorf("failed to handle resolve: %w", err)
+			}
 		case msg.Data.HiddenDHT != nil:
 			err = c.HiddenDHT(&msg)
 			if err != nil {
@@ -4,9 +4,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/RogueTeam/onion/p2p/log"
 	"github.com/RogueTeam/onion/p2p/onion/message"
-	"github.com/RogueTeam/onion/utils"
 	"github.com/hashicorp/yamux"
 	"github.com/libp2p/go-libp2p/core/crypto"
 )
@@ -31,9 +32,18 @@ func (c *Connection) Bind(msg *message.Message) (err error) {
 		return fmt.Errorf("failed to unmarshal public key: %w", err)
 	}
 
-	hiddenAddress, err := HiddenAddressFromPubKey(pub)
+	// Verify certificate chain ============================
+	cert := msg.Data.Bind.Certificate
+	hiddenAddress, err := verifyCredentials(pub, cert)
 	if err != nil {
-		return fmt.Errorf("failed to convert public key to hidden address: %w", err)
+		return err
+	}
+
+	var expired <-chan time.Time
+	if cert != nil {
+		expiry := time.NewTimer(time.Until(time.Unix(cert.Expiry, 0)))
+		defer expiry.Stop()
+		expired = expiry.C
 	}
 
 	// Prepare signature ===================================
@@ -52,17 +62,12 @@ func (c *Connection) Bind(msg *message.Message) (err error) {
 		return errors.New("invalid signature")
 	}
 
-	ctx, cancel := utils.NewContext()
-	defer cancel()
+	advertisement := &Advertisement{
+		Address:     hiddenAddress,
+		Cid:         CidFromData(hiddenAddress),
+		Certificate: cert,
 
-	cid := CidFromData(hiddenAddress)
-	if err != nil {
-		return fmt.Errorf("failed to create cid from pub hash: %w", err)
-	}
-
-	err = c.DHT.Provide(ctx, cid, true)
-	if err != nil {
-		return fmt.Errorf("failed to advertise cid: %w", err)
+		NonAnonymous: msg.Data.Bind.NonAnonymous,
 	}
 
 	// Accept connections ==================================
@@ -72,11 +77,72 @@ func (c *Connection) Bind(msg *message.Message) (err error) {
 	}
 	defer session.Close()
 
-	c.HiddenServices.Store(hiddenAddress, session)
-	defer c.HiddenServices.Delete(hiddenAddress)
+	entry := &HiddenServiceEntry{
+		Address:       hiddenAddress,
+		BoundAt:       time.Now(),
+		Peer:          c.Stream.Conn().RemotePeer(),
+		Connection:    c,
+		Session:       session,
+		Advertisement: advertisement,
+	}
+	err = c.HiddenServices.Register(entry)
+	if err != nil {
+		return fmt.Errorf("failed to register hidden service: %w", err)
+	}
+	// Only remove the entry if it wasn't replaced by a rebind
+	defer c.HiddenServices.Unregister(entry)
 
-	// Wait until caller closes. This will prevent corruption of the pipeline
-	<-session.CloseChan()
+	err = advertisement.provide(c.DHT)
+	if err != nil {
+		return fmt.Errorf("failed to advertise cid: %w", err)
+	}
+
+	go c.receiveDescriptors(session, advertisement)
+
+	// Provider records expire. Keep advertising the service until the caller closes.
+	// Waiting for the close also prevents corruption of the pipeline
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultConfig().TTL
+	}
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.CloseChan():
+			return nil
+		case <-expired:
+			c.Logger.Log(log.LogLevelInfo, "certificate of hidden service %s expired", hiddenAddress)
+			return nil
+		case <-ticker.C:
+			err = advertisement.provide(c.DHT)
+			if err != nil {
+				c.Logger.Log(log.LogLevelError, "failed to re-provide hidden service %s: %v", hiddenAddress, err)
+			}
+		}
+	}
+}
 
-	return nil
+// Receives the descriptor updates sent by the hidden service
+func (c *Connection) receiveDescriptors(session *yamux.Session, advertisement *Advertisement) {
+	stream, err := session.Accept()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	var msg message.Message
+	for {
+		err = msg.Recv(stream, DefaultSettings)
+		if err != nil {
+			return
+		}
+
+		if msg.Data.Descriptor == nil {
+			c.Logger.Log(log.LogLevelError, "invalid descriptor received for %s", advertisement.Address)
+			return
+		}
+		advertisement.setEffort(msg.Data.Descriptor.Effort)
+	}
 }
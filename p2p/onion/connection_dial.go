@@ -4,11 +4,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"time"
 
+	"github.com/RogueTeam/onion/crypto"
+	"github.com/RogueTeam/onion/p2p/log"
 	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
 	"github.com/hashicorp/yamux"
 )
 
+const (
+	// Maximum time clients have to solve the introduction puzzle
+	DefaultIntroductionTimeout = time.Minute
+	DefaultNonceLength         = 32
+)
+
 // Dial to a hidden service hosted by the machine
 func (c *Connection) Dial(msg *message.Message) (err error) {
 	if !c.Secured {
@@ -18,10 +29,12 @@ func (c *Connection) Dial(msg *message.Message) (err error) {
 		return errors.New("dial not passed")
 	}
 
-	svcSession, found := c.HiddenServices.Load(msg.Data.Dial.Address)
+	address := msg.Data.Dial.Address
+	entry, found := c.HiddenServices.Load(address)
 	if !found {
 		return errors.New("service not hosted by this node")
 	}
+	svcSession := entry.Session
 
 	clientSession, err := yamux.Client(c.Conn, yamux.DefaultConfig())
 	if err != nil {
@@ -29,21 +42,100 @@ func (c *Connection) Dial(msg *message.Message) (err error) {
 	}
 	defer clientSession.Close()
 
+	// Clients should notice once the hidden service is gone
+	go func() {
+		select {
+		case <-svcSession.CloseChan():
+			clientSession.Close()
+		case <-clientSession.CloseChan():
+		}
+	}()
+
 	for {
 		clientConn, err := clientSession.Accept()
 		if err != nil {
 			return fmt.Errorf("failed to accept client connection: %w", err)
 		}
 
-		serviceConn, err := svcSession.Open()
-		if err != nil {
-			return fmt.Errorf("failed to open new connection: %w", err)
-		}
-
 		go func() {
-			defer serviceConn.Close()
-			go io.Copy(clientConn, serviceConn)
-			io.Copy(serviceConn, clientConn)
+			err := c.introduce(entry, clientConn)
+			if err != nil {
+				clientConn.Close()
+				c.Logger.Log(log.LogLevelDebug, "failed to introduce client to %s: %v", address, err)
+			}
 		}()
 	}
 }
+
+// Forwards the client stream to the hidden service once the client solved the introduction puzzle.
+// The puzzle is bound to the service address and a nonce only valid for this stream
+func (c *Connection) introduce(entry *HiddenServiceEntry, clientConn net.Conn) (err error) {
+	address := entry.Address
+	advertisement := entry.Advertisement
+	effort := advertisement.Status().Effort
+
+	var descriptor = message.Message{
+		Data: message.Data{
+			Descriptor: &message.Descriptor{
+				Effort:      effort,
+				Nonce:       crypto.String(DefaultNonceLength),
+				Certificate: advertisement.Certificate,
+
+				NonAnonymous: advertisement.NonAnonymous,
+			},
+		},
+	}
+	err = descriptor.Send(clientConn, DefaultSettings)
+	if err != nil {
+		return fmt.Errorf("failed to send descriptor: %w", err)
+	}
+
+	clientConn.SetReadDeadline(time.Now().Add(DefaultIntroductionTimeout))
+	var msg message.Message
+	err = msg.Recv(clientConn, &message.Settings{PoWDifficulty: effort})
+	if err != nil {
+		return fmt.Errorf("failed to receive introduction: %w", err)
+	}
+	clientConn.SetReadDeadline(time.Time{})
+
+	introduction := msg.Data.Introduction
+	switch {
+	case introduction == nil:
+		return errors.New("no introduction received")
+	case introduction.Address != address:
+		return errors.New("introduction for a different address")
+	case introduction.Nonce != descriptor.Data.Descriptor.Nonce:
+		return errors.New("introduction with invalid nonce")
+	}
+
+	paid, err := hashcash.Bits(msg.Hashcash)
+	if err != nil {
+		return fmt.Errorf("failed to get introduction effort: %w", err)
+	}
+
+	serviceConn, err := entry.Session.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open new connection: %w", err)
+	}
+	defer serviceConn.Close()
+
+	var forward = message.Message{
+		Data: message.Data{
+			Introduction: &message.Introduction{
+				Address: address,
+				Effort:  paid,
+			},
+		},
+	}
+	err = forward.Send(serviceConn, DefaultSettings)
+	if err != nil {
+		return fmt.Errorf("failed to forward introduction: %w", err)
+	}
+
+	entry.activeStreams.Add(1)
+	defer entry.activeStreams.Add(-1)
+
+	go io.Copy(&countingWriter{Writer: c.backward(clientConn), Counter: &entry.bytesRelayed}, serviceConn)
+	io.Copy(&countingWriter{Writer: c.forward(serviceConn), Counter: &entry.bytesRelayed}, clientConn)
+	return nil
+}
@@ -0,0 +1,106 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RogueTeam/onion/p2p/log"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
+	"github.com/RogueTeam/onion/utils"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Publishes a listing of the public directory on behalf of the hidden service
+func (c *Connection) Publish(msg *message.Message) (err error) {
+	if !c.Secured {
+		return errors.New("connection not secured")
+	}
+	if msg.Data.Publish == nil {
+		return errors.New("publish not passed")
+	}
+
+	listing := &msg.Data.Publish.Listing
+	err = VerifyListing(listing)
+	if err != nil {
+		return c.sendDirectoryResponse(&message.DirectoryResponse{Error: err.Error()})
+	}
+
+	err = hashcash.VerifyWithDifficultyAndPayload(hashcash.DefaultHashAlgorithm(), msg.Data.Publish.Hashcash, DirectoryDifficulty, listingDigest(listing))
+	if err != nil {
+		return fmt.Errorf("failed to verify publish hashcash: %w", err)
+	}
+
+	_, err = c.Directory.Store(listing)
+	if err != nil {
+		return c.sendDirectoryResponse(&message.DirectoryResponse{Error: err.Error()})
+	}
+
+	value, err := msgpack.Marshal(listing)
+	if err != nil {
+		return fmt.Errorf("failed to marshal listing: %w", err)
+	}
+
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	err = c.DHT.PutValue(ctx, DirectoryKey(listing.Address), value)
+	if err != nil {
+		return c.sendDirectoryResponse(&message.DirectoryResponse{Error: fmt.Sprintf("failed to put listing: %v", err)})
+	}
+
+	err = c.Directory.provide()
+	if err != nil {
+		c.Logger.Log(log.LogLevelError, "failed to provide directory: %v", err)
+	}
+	return c.sendDirectoryResponse(&message.DirectoryResponse{})
+}
+
+// Answers listings of the public directory.
+// Listings of a specific address are looked up in the DHT when not known by the relay
+func (c *Connection) DirectoryQuery(msg *message.Message) (err error) {
+	if !c.Secured {
+		return errors.New("connection not secured")
+	}
+	if msg.Data.DirectoryQuery == nil {
+		return errors.New("directory query not passed")
+	}
+
+	query := msg.Data.DirectoryQuery
+	if query.Address == "" {
+		return c.sendDirectoryResponse(&message.DirectoryResponse{Listings: c.Directory.Search(query.Search)})
+	}
+
+	listing, found := c.Directory.Load(query.Address)
+	if found {
+		return c.sendDirectoryResponse(&message.DirectoryResponse{Listings: []message.Listing{*listing}})
+	}
+
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	value, err := c.DHT.GetValue(ctx, DirectoryKey(query.Address))
+	if err != nil {
+		return c.sendDirectoryResponse(&message.DirectoryResponse{Error: fmt.Sprintf("failed to get listing: %v", err)})
+	}
+
+	var stored message.Listing
+	err = msgpack.Unmarshal(value, &stored)
+	if err != nil {
+		return c.sendDirectoryResponse(&message.DirectoryResponse{Error: fmt.Sprintf("failed to unmarshal listing: %v", err)})
+	}
+	return c.sendDirectoryResponse(&message.DirectoryResponse{Listings: []message.Listing{stored}})
+}
+
+func (c *Connection) sendDirectoryResponse(res *message.DirectoryResponse) (err error) {
+	var response = message.Message{
+		Data: message.Data{
+			DirectoryResponse: res,
+		},
+	}
+	err = response.Send(c.Conn, DefaultSettings)
+	if err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	return nil
+}
@@ -34,8 +34,13 @@ func (c *Connection) Extend(msg *message.Message) (err error) {
 
 	c.Logger.Log(log.LogLevelDebug, "Piping traffic")
 	defer c.Logger.Log(log.LogLevelDebug, "Finished")
-	go io.Copy(c.Conn, stream)
-	_, err = io.Copy(stream, c.Conn)
+	// Tear down the previous hops once the next one closes.
+	// Otherwise they only notice after the yamux keepalive fails
+	go func() {
+		io.Copy(c.backward(c.Conn), stream)
+		c.Conn.Close()
+	}()
+	_, err = io.Copy(c.forward(stream), c.Conn)
 	if err != nil {
 		return fmt.Errorf("failed to copy from conn: %w", err)
 	}
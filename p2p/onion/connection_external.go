@@ -4,9 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/RogueTeam/onion/p2p/log"
 	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/utils"
+	"github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 )
 
@@ -22,19 +27,95 @@ func (c *Connection) External(msg *message.Message) (err error) {
 		return errors.New("this peer doesn't support external mode")
 	}
 
-	remote, err := manet.Dial(msg.Data.External.Address)
+	maddr := msg.Data.External.Address
+	allowed, err := c.ExitPolicy.AllowsMultiaddr(maddr)
 	if err != nil {
-		return fmt.Errorf("failed to dial external: %w", err)
+		return fmt.Errorf("failed to check exit policy: %w", err)
+	}
+	if !allowed {
+		return errors.New("destination rejected by the exit policy")
+	}
+
+	release, err := c.acquireExit(maddr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	remote, err := c.dialExternal(maddr)
+	if err != nil {
+		return err
 	}
 	defer remote.Close()
 
 	c.Logger.Log(log.LogLevelDebug, "Piping traffic")
 	defer c.Logger.Log(log.LogLevelDebug, "Finished")
 
-	go io.Copy(c.Conn, remote)
-	_, err = io.Copy(remote, c.Conn)
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.closeIdle(remote, &lastActivity, c.ExitLimits.idleTimeout(), done)
+
+	go io.Copy(&activityWriter{Writer: c.backward(c.Conn), LastActivity: &lastActivity}, remote)
+	_, err = io.Copy(&activityWriter{Writer: c.forward(remote), LastActivity: &lastActivity}, c.Conn)
 	if err != nil {
 		return fmt.Errorf("failed to read from connection: %w", err)
 	}
 	return nil
 }
+
+// Reserves an outbound connection of the remote peer.
+// External and UDPAssociate take over the stream, so each circuit holds at most one
+func (c *Connection) acquireExit(maddr multiaddr.Multiaddr) (release func(), err error) {
+	release, err = c.ExitLimits.Acquire(c.Stream.Conn().RemotePeer(), maddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire exit connection: %w", err)
+	}
+	return release, nil
+}
+
+// Records the time of the last write
+type activityWriter struct {
+	io.Writer
+	LastActivity *atomic.Int64
+}
+
+func (w *activityWriter) Write(b []byte) (n int, err error) {
+	w.LastActivity.Store(time.Now().UnixNano())
+	return w.Writer.Write(b)
+}
+
+// Dials the destination. DNS multiaddrs are resolved and every resolved address is checked against the exit policy
+func (c *Connection) dialExternal(maddr multiaddr.Multiaddr) (remote net.Conn, err error) {
+	candidates := []multiaddr.Multiaddr{maddr}
+	if isDNSMultiaddr(maddr) {
+		ctx, cancel := utils.NewContext()
+		defer cancel()
+
+		candidates, err = c.Resolver.ResolveMultiaddr(ctx, maddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := manet.Dialer{Dialer: net.Dialer{Timeout: c.ExitLimits.connectTimeout()}}
+
+	var errs []error
+	for _, candidate := range candidates {
+		allowed, err := c.ExitPolicy.AllowsMultiaddr(candidate)
+		if err != nil || !allowed {
+			errs = append(errs, fmt.Errorf("%s: destination rejected by the exit policy", candidate))
+			continue
+		}
+
+		remote, err = dialer.Dial(candidate)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", candidate, err))
+			continue
+		}
+		return remote, nil
+	}
+	return nil, fmt.Errorf("failed to dial external: %w", errors.Join(errs...))
+}
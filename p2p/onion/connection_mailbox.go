@@ -0,0 +1,109 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/log"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// Stores a message for an offline hidden service
+func (c *Connection) Deposit(msg *message.Message) (err error) {
+	if !c.Secured {
+		return errors.New("connection not secured")
+	}
+	if msg.Data.Deposit == nil {
+		return errors.New("deposit not passed")
+	}
+	if c.Mailbox == nil {
+		return errors.New("this peer doesn't support mailbox mode")
+	}
+
+	deposit := msg.Data.Deposit
+	issued := time.Unix(deposit.Timestamp, 0)
+	if time.Since(issued).Abs() > DefaultMailboxRequestWindow {
+		return errors.New("deposit outside the accepted time window")
+	}
+
+	err = hashcash.VerifyWithDifficultyAndPayload(hashcash.DefaultHashAlgorithm(), deposit.Hashcash, c.Mailbox.Config.Difficulty, depositDigest(c.Host.ID(), deposit))
+	if err != nil {
+		return fmt.Errorf("failed to verify deposit hashcash: %w", err)
+	}
+	if !c.Mailbox.spend(deposit.Hashcash, issued.Add(DefaultMailboxRequestWindow)) {
+		return ErrDepositReplayed
+	}
+
+	first, err := c.Mailbox.Store(deposit.Address, deposit.Payload)
+	if err != nil {
+		return c.sendMailboxResponse(&message.MailboxResponse{Error: err.Error()})
+	}
+
+	if first {
+		err = c.Mailbox.provide(deposit.Address)
+		if err != nil {
+			c.Logger.Log(log.LogLevelError, "failed to provide mailbox of %s: %v", deposit.Address, err)
+		}
+	}
+	return c.sendMailboxResponse(&message.MailboxResponse{})
+}
+
+// Fetches or deletes the messages of a hidden address. Requests are signed by the owner of the address
+func (c *Connection) MailboxRequest(msg *message.Message) (err error) {
+	if !c.Secured {
+		return errors.New("connection not secured")
+	}
+	if msg.Data.MailboxRequest == nil {
+		return errors.New("mailbox request not passed")
+	}
+	if c.Mailbox == nil {
+		return errors.New("this peer doesn't support mailbox mode")
+	}
+
+	req := msg.Data.MailboxRequest
+
+	pub, err := crypto.UnmarshalPublicKey(req.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal public key: %w", err)
+	}
+
+	address, err := verifyCredentials(pub, req.Certificate)
+	if err != nil {
+		return err
+	}
+
+	issued := time.Unix(req.Timestamp, 0)
+	if time.Since(issued).Abs() > DefaultMailboxRequestWindow {
+		return errors.New("mailbox request outside the accepted time window")
+	}
+
+	valid, err := pub.Verify(mailboxRequestPayload(c.Host.ID(), address, req), req.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to verify mailbox request signature: %w", err)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+
+	if len(req.Delete) > 0 {
+		c.Mailbox.Delete(address, req.Delete)
+		return c.sendMailboxResponse(&message.MailboxResponse{})
+	}
+	return c.sendMailboxResponse(&message.MailboxResponse{Messages: c.Mailbox.Fetch(address)})
+}
+
+func (c *Connection) sendMailboxResponse(res *message.MailboxResponse) (err error) {
+	var response = message.Message{
+		Data: message.Data{
+			MailboxResponse: res,
+		},
+	}
+	err = response.Send(c.Conn, DefaultSettings)
+	if err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	return nil
+}
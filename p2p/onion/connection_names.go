@@ -0,0 +1,89 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/utils"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Registers or renews a name on behalf of the hidden service.
+// Records of other addresses for names already registered are refused.
+// The relay checks it before storing, since its own datastore accepts the record locally
+func (c *Connection) RegisterName(msg *message.Message) (err error) {
+	if !c.Secured {
+		return errors.New("connection not secured")
+	}
+	if msg.Data.RegisterName == nil {
+		return errors.New("register name not passed")
+	}
+
+	rec := &msg.Data.RegisterName.Record
+	err = VerifyNameRecord(rec)
+	if err != nil {
+		return c.sendNameResponse(&message.NameResponse{Error: err.Error()})
+	}
+
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	current, err := c.DHT.GetValue(ctx, NameKey(rec.Name))
+	if err == nil {
+		var stored message.NameRecord
+		err = msgpack.Unmarshal(current, &stored)
+		if err == nil && stored.Address != rec.Address {
+			return c.sendNameResponse(&message.NameResponse{Error: ErrNameTaken.Error()})
+		}
+	}
+
+	value, err := msgpack.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal name record: %w", err)
+	}
+
+	err = c.DHT.PutValue(ctx, NameKey(rec.Name), value)
+	if err != nil {
+		return c.sendNameResponse(&message.NameResponse{Error: fmt.Sprintf("failed to put name record: %v", err)})
+	}
+	return c.sendNameResponse(&message.NameResponse{Record: rec})
+}
+
+// Looks up the record of the name in the DHT
+func (c *Connection) NameQuery(msg *message.Message) (err error) {
+	if !c.Secured {
+		return errors.New("connection not secured")
+	}
+	if msg.Data.NameQuery == nil {
+		return errors.New("name query not passed")
+	}
+
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	value, err := c.DHT.GetValue(ctx, NameKey(msg.Data.NameQuery.Name))
+	if err != nil {
+		return c.sendNameResponse(&message.NameResponse{Error: fmt.Sprintf("failed to get name record: %v", err)})
+	}
+
+	var rec message.NameRecord
+	err = msgpack.Unmarshal(value, &rec)
+	if err != nil {
+		return c.sendNameResponse(&message.NameResponse{Error: fmt.Sprintf("failed to unmarshal name record: %v", err)})
+	}
+	return c.sendNameResponse(&message.NameResponse{Record: &rec})
+}
+
+func (c *Connection) sendNameResponse(res *message.NameResponse) (err error) {
+	var response = message.Message{
+		Data: message.Data{
+			NameResponse: res,
+		},
+	}
+	err = response.Send(c.Conn, DefaultSettings)
+	if err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	return nil
+}
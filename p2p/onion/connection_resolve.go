@@ -0,0 +1,72 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/utils"
+)
+
+// Resolves a host on behalf of the client. Addresses rejected by the exit policy are not returned
+func (c *Connection) Resolve(msg *message.Message) (err error) {
+	if !c.Secured {
+		return errors.New("connection not secured")
+	}
+	if msg.Data.Resolve == nil {
+		return errors.New("resolve not passed")
+	}
+	if !c.ExitNode {
+		return errors.New("this peer doesn't support external mode")
+	}
+
+	network := msg.Data.Resolve.Network
+	switch network {
+	case "ip", "ip4", "ip6":
+	default:
+		return c.sendResolveResponse(&message.ResolveResponse{Error: fmt.Sprintf("invalid network: %s", network)})
+	}
+
+	err = c.ExitLimits.Resolve(c.Stream.Conn().RemotePeer(), msg.Data.Resolve.Host)
+	if err != nil {
+		return c.sendResolveResponse(&message.ResolveResponse{Error: err.Error()})
+	}
+
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	ips, ttl, err := c.Resolver.Lookup(ctx, network, msg.Data.Resolve.Host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		notFound := errors.As(err, &dnsErr) && dnsErr.IsNotFound
+		return c.sendResolveResponse(&message.ResolveResponse{Error: err.Error(), NotFound: notFound})
+	}
+
+	var res = message.ResolveResponse{
+		TTL: max(int64(ttl/time.Second), 1),
+	}
+	for _, ip := range ips {
+		if c.ExitPolicy.AllowsAddress(ip) {
+			res.Addresses = append(res.Addresses, ip.String())
+		}
+	}
+	if len(res.Addresses) == 0 {
+		res.Error = "no address allowed by the exit policy"
+	}
+	return c.sendResolveResponse(&res)
+}
+
+func (c *Connection) sendResolveResponse(res *message.ResolveResponse) (err error) {
+	var response = message.Message{
+		Data: message.Data{
+			ResolveResponse: res,
+		},
+	}
+	err = response.Send(c.Conn, DefaultSettings)
+	if err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/log"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Time waited before closing UDP associations without traffic
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+// Relays the datagrams of the circuit to the UDP destination
+func (c *Connection) UDPAssociate(msg *message.Message) (err error) {
+	if !c.Secured {
+		return errors.New("connection not secured")
+	}
+	if msg.Data.UDPAssociate == nil {
+		return errors.New("udp associate not passed")
+	}
+	if !c.ExitNode {
+		return errors.New("this peer doesn't support external mode")
+	}
+
+	maddr := msg.Data.UDPAssociate.Address
+	_, err = maddr.ValueForProtocol(multiaddr.P_UDP)
+	if err != nil {
+		return errors.New("udp associate requires an udp address")
+	}
+
+	allowed, err := c.ExitPolicy.AllowsMultiaddr(maddr)
+	if err != nil {
+		return fmt.Errorf("failed to check exit policy: %w", err)
+	}
+	if !allowed {
+		return errors.New("destination rejected by the exit policy")
+	}
+
+	release, err := c.acquireExit(maddr)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	remote, err := c.dialExternal(maddr)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	c.Logger.Log(log.LogLevelDebug, "Relaying datagrams")
+	defer c.Logger.Log(log.LogLevelDebug, "Finished")
+
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	defer close(done)
+	timeout := c.UDPIdleTimeout
+	if timeout == 0 {
+		timeout = DefaultUDPIdleTimeout
+	}
+	go c.closeIdle(remote, &lastActivity, timeout, done)
+
+	backward, forward := c.backward(c.Conn), c.forwardDatagrams(remote)
+	go func() {
+		defer c.Conn.Close()
+
+		buffer := make([]byte, MaxDatagramSize)
+		for {
+			n, err := remote.Read(buffer)
+			if err != nil {
+				return
+			}
+			lastActivity.Store(time.Now().UnixNano())
+
+			err = writeDatagram(backward, buffer[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, err := readDatagram(c.Conn, buffer)
+		if err != nil {
+			return nil
+		}
+		lastActivity.Store(time.Now().UnixNano())
+
+		// Datagrams are unreliable. Failed writes are dropped
+		forward.Write(buffer[:n])
+	}
+}
+
+// Closes both ends once there is no traffic for the timeout
+func (c *Connection) closeIdle(remote net.Conn, lastActivity *atomic.Int64, timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(max(timeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, lastActivity.Load())) < timeout {
+				continue
+			}
+			c.Logger.Log(log.LogLevelDebug, "Closing idle exit connection")
+			remote.Close()
+			c.Conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package onion
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Largest datagram carried over a circuit
+const MaxDatagramSize = 65507
+
+// Writes the datagram prefixed by its length
+func writeDatagram(w io.Writer, datagram []byte) (err error) {
+	if len(datagram) > MaxDatagramSize {
+		return fmt.Errorf("datagram too large: %d", len(datagram))
+	}
+
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(datagram)), uint16(len(datagram)))
+	_, err = w.Write(append(frame, datagram...))
+	if err != nil {
+		return fmt.Errorf("failed to write datagram: %w", err)
+	}
+	return nil
+}
+
+// Reads a single datagram into b. Just like UDP sockets the excess is discarded
+func readDatagram(r io.Reader, b []byte) (n int, err error) {
+	var header [2]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[:]))
+	n = min(length, len(b))
+	_, err = io.ReadFull(r, b[:n])
+	if err != nil {
+		return 0, fmt.Errorf("failed to read datagram: %w", err)
+	}
+
+	_, err = io.CopyN(io.Discard, r, int64(length-n))
+	if err != nil {
+		return 0, fmt.Errorf("failed to discard datagram: %w", err)
+	}
+	return n, nil
+}
+
+// Datagram oriented connection over a circuit. Each Write sends a datagram and each Read receives one.
+// Reads interrupted by a deadline can leave the stream mid datagram. Close the conn instead of timing out reads
+type DatagramConn struct {
+	net.Conn
+
+	writeMutex sync.Mutex
+	readMutex  sync.Mutex
+}
+
+func (c *DatagramConn) Read(b []byte) (n int, err error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	return readDatagram(c.Conn, b)
+}
+
+func (c *DatagramConn) Write(b []byte) (n int, err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	err = writeDatagram(c.Conn, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
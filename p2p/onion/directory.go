@@ -0,0 +1,365 @@
+package onion
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RogueTeam/onion/crypto"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
+	"github.com/RogueTeam/onion/utils"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	record "github.com/libp2p/go-libp2p-record"
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// DHT namespace of the listings
+	DirectoryNamespace = BaseString + "-directory"
+
+	// Time a listing is valid when no expiry is set
+	DefaultListingTTL = 24 * time.Hour
+	// Longest time a listing is valid after its publication. Publishers republish to keep it
+	MaxListingTTL = 7 * 24 * time.Hour
+
+	MaxListingTitle       = 128
+	MaxListingDescription = 1024
+	MaxListingTags        = 16
+	MaxListingTag         = 32
+	MaxListingContact     = 256
+
+	// Listings stored by a single relay
+	DefaultMaxListings = 4096
+	// Proof of work difficulty paid by every publication
+	DirectoryDifficulty uint64 = 16
+
+	// Tolerated clock difference with the publisher
+	listingClockSkew = 5 * time.Minute
+)
+
+var ErrDirectoryFull = errors.New("directory full")
+
+// Cid provided by the relays holding listings. Browsing the directory starts by finding them
+var DirectoryP2PCid cid.Cid = CidFromData(DirectoryNamespace)
+
+// DHT key of the listing of the address
+func DirectoryKey(address peer.ID) (key string) {
+	return "/" + DirectoryNamespace + "/" + string(address)
+}
+
+// Protocol prefix of the onion records DHT. The default /ipfs prefix doesn't accept custom validators
+const DHTProtocolPrefix protocol.ID = "/" + BaseString
+
+// Opt-in DHT options of the nodes storing names and directory listings.
+// Registers the validators of the onion records under DHTProtocolPrefix and uses the store as the DHT datastore.
+// Nodes using them form a DHT apart from the nodes built without them, so every node of the network should agree.
+// Without them names and listings can't be stored. Relays using them set Config.Records to be picked by the clients
+func DHTOptions(store datastore.Batching) (options []dht.Option) {
+	return []dht.Option{
+		dht.ProtocolPrefix(DHTProtocolPrefix),
+		dht.Datastore(store),
+		dht.NamespacedValidator(DirectoryNamespace, DirectoryValidator{}),
+		dht.NamespacedValidator(NamesNamespace, NameValidator{Datastore: store}),
+	}
+}
+
+// Content signed by the owner of the hidden address
+func listingPayload(listing *message.Listing) (payload []byte, err error) {
+	unsigned := *listing
+	unsigned.Signature = nil
+
+	payload, err = msgpack.Marshal(&unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal listing: %w", err)
+	}
+	return append([]byte(DirectoryNamespace), payload...), nil
+}
+
+// Signs the listing with the key of the hidden service.
+// When a certificate is passed the key should be the certified signing key.
+// Address, publication time and public key are filled. Expiry defaults to DefaultListingTTL
+func NewListing(priv p2pcrypto.PrivKey, cert *message.Certificate, listing message.Listing) (signed *message.Listing, err error) {
+	listing.Address, err = hiddenAddressFromCredentials(priv, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	listing.PublicKey, err = p2pcrypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	listing.Certificate = cert
+
+	now := time.Now()
+	listing.Published = now.Unix()
+	if listing.Expiry == 0 {
+		listing.Expiry = now.Add(DefaultListingTTL).Unix()
+	}
+
+	payload, err := listingPayload(&listing)
+	if err != nil {
+		return nil, err
+	}
+
+	listing.Signature, err = priv.Sign(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign listing: %w", err)
+	}
+	return &listing, nil
+}
+
+// Verifies the limits, the times and the signature of the listing
+func VerifyListing(listing *message.Listing) (err error) {
+	switch {
+	case len(listing.Title) > MaxListingTitle:
+		return errors.New("listing title too long")
+	case len(listing.Description) > MaxListingDescription:
+		return errors.New("listing description too long")
+	case len(listing.Tags) > MaxListingTags:
+		return errors.New("too many listing tags")
+	case len(listing.Contact) > MaxListingContact:
+		return errors.New("listing contact too long")
+	}
+	for _, tag := range listing.Tags {
+		if len(tag) > MaxListingTag {
+			return errors.New("listing tag too long")
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case now.Unix() >= listing.Expiry:
+		return errors.New("listing expired")
+	case listing.Published > now.Add(listingClockSkew).Unix():
+		return errors.New("listing published in the future")
+	case listing.Expiry > time.Unix(listing.Published, 0).Add(MaxListingTTL).Unix():
+		return errors.New("listing expiry too far")
+	}
+
+	pub, err := p2pcrypto.UnmarshalPublicKey(listing.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal public key: %w", err)
+	}
+
+	address, err := verifyCredentials(pub, listing.Certificate)
+	if err != nil {
+		return err
+	}
+	if address != listing.Address {
+		return errors.New("listing signed for a different address")
+	}
+
+	payload, err := listingPayload(listing)
+	if err != nil {
+		return err
+	}
+
+	valid, err := pub.Verify(payload, listing.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to verify listing signature: %w", err)
+	}
+	if !valid {
+		return errors.New("invalid listing signature")
+	}
+	return nil
+}
+
+// Payload of the proof of work of a publication
+func listingDigest(listing *message.Listing) (digest string) {
+	h := hashcash.DefaultHashAlgorithm()
+	h.Write([]byte(DirectoryNamespace))
+	h.Write([]byte(listing.Address))
+	h.Write(listing.Signature)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Solves the DirectoryDifficulty proof of work of the signed listing
+func listingHashcash(listing *message.Listing) (hc string, err error) {
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	return hashcash.New(ctx, hashcash.DefaultHashAlgorithm(), DirectoryDifficulty, crypto.String(message.DefaultSaltLength), listingDigest(listing))
+}
+
+// Checks if the listing matches the case insensitive search
+func matchListing(listing *message.Listing, search string) (match bool) {
+	search = strings.ToLower(strings.TrimSpace(search))
+	if search == "" {
+		return true
+	}
+
+	fields := append([]string{listing.Title, listing.Description}, listing.Tags...)
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// DHT validator of the directory namespace
+type DirectoryValidator struct{}
+
+func (DirectoryValidator) Validate(key string, value []byte) (err error) {
+	var listing message.Listing
+	err = msgpack.Unmarshal(value, &listing)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal listing: %w", err)
+	}
+
+	if key != DirectoryKey(listing.Address) {
+		return errors.New("listing stored under a different key")
+	}
+	return VerifyListing(&listing)
+}
+
+// Selects the latest valid publication
+func (v DirectoryValidator) Select(key string, values [][]byte) (index int, err error) {
+	index = -1
+	var latest int64
+	for i, value := range values {
+		if v.Validate(key, value) != nil {
+			continue
+		}
+
+		var listing message.Listing
+		msgpack.Unmarshal(value, &listing)
+		if index == -1 || listing.Published > latest {
+			index, latest = i, listing.Published
+		}
+	}
+
+	if index == -1 {
+		return 0, errors.New("no valid listing found")
+	}
+	return index, nil
+}
+
+var _ record.Validator = DirectoryValidator{}
+
+// Listings published through this relay.
+// Relays holding listings provide DirectoryP2PCid so clients can browse them
+type Directory struct {
+	DHT *dht.IpfsDHT
+	// Listings stored at most. Publications of new addresses are refused once reached
+	MaxListings int
+
+	mutex    sync.Mutex
+	listings map[peer.ID]*message.Listing
+}
+
+func NewDirectory(d *dht.IpfsDHT) (directory *Directory) {
+	return &Directory{
+		DHT:         d,
+		MaxListings: DefaultMaxListings,
+		listings:    make(map[peer.ID]*message.Listing),
+	}
+}
+
+// Stores a verified listing. Older publications than the stored one are ignored.
+// New addresses are refused with ErrDirectoryFull once MaxListings is reached
+func (d *Directory) Store(listing *message.Listing) (stored bool, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	current, found := d.listings[listing.Address]
+	if found && current.Published > listing.Published {
+		return false, nil
+	}
+	if !found {
+		d.expire()
+		if len(d.listings) >= d.MaxListings {
+			return false, ErrDirectoryFull
+		}
+	}
+	d.listings[listing.Address] = listing
+	return true, nil
+}
+
+func (d *Directory) Load(address peer.ID) (listing *message.Listing, found bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.expire()
+
+	listing, found = d.listings[address]
+	return listing, found
+}
+
+// Listings matching the search sorted by address
+func (d *Directory) Search(search string) (listings []message.Listing) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.expire()
+
+	for _, listing := range d.listings {
+		if matchListing(listing, search) {
+			listings = append(listings, *listing)
+		}
+	}
+	slices.SortFunc(listings, func(a, b message.Listing) int {
+		return strings.Compare(string(a.Address), string(b.Address))
+	})
+	return listings
+}
+
+func (d *Directory) Len() (length int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.expire()
+
+	return len(d.listings)
+}
+
+// Drops expired listings. The mutex should be held by the caller
+func (d *Directory) expire() {
+	now := time.Now().Unix()
+	for address, listing := range d.listings {
+		if now >= listing.Expiry {
+			delete(d.listings, address)
+		}
+	}
+}
+
+func (d *Directory) provide() (err error) {
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	return d.DHT.Provide(ctx, DirectoryP2PCid, true)
+}
+
+// Expires listings and keeps advertising the relay while it holds any
+func (d *Directory) serve(ttl time.Duration, closed <-chan struct{}) {
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+
+		if d.Len() == 0 {
+			continue
+		}
+
+		err := d.provide()
+		if err != nil {
+			log.Printf("failed to provide directory: %v", err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Lookups running concurrently, each over its own exit circuit
+	DefaultExitResolverCircuits = 4
+	// Age after which the circuits of the ExitResolver are replaced
+	DefaultExitResolverRotation = 10 * time.Minute
+)
+
+// Exit circuit kept between lookups
+type resolverCircuit struct {
+	*Circuit
+	created time.Time
+}
+
+// Resolves hosts through a small pool of exit circuits reused between lookups.
+// Circuits are replaced when they fail or once they are older than the rotation
+type ExitResolver struct {
+	Service *Service
+	// Maximum circuits kept. Zero means DefaultExitResolverCircuits
+	Circuits int
+	// Circuits older than this are replaced. Zero means DefaultExitResolverRotation
+	Rotation time.Duration
+
+	mutex sync.Mutex
+	// Circuits not used by a lookup
+	idle []*resolverCircuit
+	// Limits the lookups running concurrently
+	slots  chan struct{}
+	closed bool
+}
+
+func (r *ExitResolver) rotation() (rotation time.Duration) {
+	if r.Rotation == 0 {
+		return DefaultExitResolverRotation
+	}
+	return r.Rotation
+}
+
+// Reserves a lookup slot. Created on first use
+func (r *ExitResolver) acquire(ctx context.Context) (err error) {
+	r.mutex.Lock()
+	if r.slots == nil {
+		n := r.Circuits
+		if n == 0 {
+			n = DefaultExitResolverCircuits
+		}
+		r.slots = make(chan struct{}, n)
+	}
+	slots := r.slots
+	r.mutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *ExitResolver) release() {
+	<-r.slots
+}
+
+// Takes an idle circuit dropping the expired ones. Prepares a new one when none is left
+func (r *ExitResolver) get(ctx context.Context) (c *resolverCircuit, err error) {
+	var expired []*resolverCircuit
+	defer func() {
+		for _, c := range expired {
+			c.Close()
+		}
+	}()
+
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return nil, net.ErrClosed
+	}
+	for len(r.idle) > 0 {
+		c = r.idle[len(r.idle)-1]
+		r.idle = r.idle[:len(r.idle)-1]
+		if time.Since(c.created) < r.rotation() {
+			r.mutex.Unlock()
+			return c, nil
+		}
+		expired = append(expired, c)
+	}
+	r.mutex.Unlock()
+
+	circuit, err := r.Service.ExitCircuit(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resolverCircuit{Circuit: circuit, created: time.Now()}, nil
+}
+
+// Returns the circuit to the idle ones. Closed if the resolver was closed in the meantime
+func (r *ExitResolver) put(c *resolverCircuit) {
+	r.mutex.Lock()
+	if !r.closed {
+		r.idle = append(r.idle, c)
+		r.mutex.Unlock()
+		return
+	}
+	r.mutex.Unlock()
+	c.Close()
+}
+
+// Resolves the host at the exit of the circuit. Network is ip, ip4 or ip6.
+// Returns the time the exit allows caching the addresses
+func (r *ExitResolver) Lookup(ctx context.Context, network, host string) (ips []net.IP, ttl time.Duration, err error) {
+	err = r.acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.release()
+
+	c, err := r.get(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	c.Active.SetDeadline(deadline)
+
+	ips, ttl, err = c.Lookup(network, host)
+	if err != nil && !errors.Is(err, ErrHostNotFound) && !errors.Is(err, ErrResolve) {
+		c.Close()
+		return nil, 0, fmt.Errorf("failed to lookup host: %w", err)
+	}
+	c.Active.SetDeadline(time.Time{})
+	r.put(c)
+	return ips, ttl, err
+}
+
+// Closes the idle circuits. Those in use are closed once their lookup finishes
+func (r *ExitResolver) Close() (err error) {
+	r.mutex.Lock()
+	idle := r.idle
+	r.idle = nil
+	r.closed = true
+	r.mutex.Unlock()
+
+	var errs []error
+	for _, c := range idle {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,194 @@
+package onion
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	DefaultExitConnectTimeout = 10 * time.Second
+	DefaultExitIdleTimeout    = 5 * time.Minute
+	DefaultMaxPeerConnections = 256
+	// Shared by every client behind the previous hop, so it is far above what a single client needs
+	DefaultMaxNewDestinations = 2048
+	DefaultDestinationWindow  = time.Minute
+	// Peers tracked before forgetting the idle ones
+	MaxExitPeers = 4096
+)
+
+// Ports rejected by default. SMTP is the classic spam vector
+var DefaultBlockedPorts = []uint16{25}
+
+var (
+	ErrTooManyConnections  = errors.New("too many exit connections")
+	ErrTooManyDestinations = errors.New("too many new destinations")
+)
+
+// Abuse controls of exit nodes. Zero values use the defaults
+type ExitLimitsConfig struct {
+	// Maximum duration of the connections to the destinations
+	ConnectTimeout time.Duration
+	// TCP connections without traffic for this time are closed
+	IdleTimeout time.Duration
+	// Concurrent outbound connections of each remote peer.
+	// The remote peer is the previous hop, so keep it high enough for relays carrying many clients
+	MaxPeerConnections int
+	// Distinct destinations each remote peer can reach per DestinationWindow. Makes scanning expensive.
+	// Like MaxPeerConnections it is counted per previous hop, not per client
+	MaxNewDestinations int
+	DestinationWindow  time.Duration
+	// Ports rejected before the exit policy. Nil means DefaultBlockedPorts, empty blocks nothing
+	BlockedPorts []uint16
+}
+
+func (c ExitLimitsConfig) defaults() (cfg ExitLimitsConfig) {
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = DefaultExitConnectTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultExitIdleTimeout
+	}
+	if c.MaxPeerConnections == 0 {
+		c.MaxPeerConnections = DefaultMaxPeerConnections
+	}
+	if c.MaxNewDestinations == 0 {
+		c.MaxNewDestinations = DefaultMaxNewDestinations
+	}
+	if c.DestinationWindow == 0 {
+		c.DestinationWindow = DefaultDestinationWindow
+	}
+	if c.BlockedPorts == nil {
+		c.BlockedPorts = DefaultBlockedPorts
+	}
+	return c
+}
+
+type exitPeer struct {
+	Connections int
+	// Last time each destination was reached
+	Destinations map[string]time.Time
+}
+
+// Drops the destinations outside the window
+func (p *exitPeer) expire(now time.Time, window time.Duration) {
+	for destination, seen := range p.Destinations {
+		if now.Sub(seen) > window {
+			delete(p.Destinations, destination)
+		}
+	}
+}
+
+// Outbound connections of the remote peers of an exit node
+type ExitLimits struct {
+	Config ExitLimitsConfig
+
+	mutex sync.Mutex
+	peers map[peer.ID]*exitPeer
+}
+
+func NewExitLimits(cfg ExitLimitsConfig) (l *ExitLimits) {
+	return &ExitLimits{
+		Config: cfg.defaults(),
+		peers:  make(map[peer.ID]*exitPeer),
+	}
+}
+
+// Reserves an outbound connection of the remote peer to the destination.
+// Release should be called once the connection finishes. Nil limits allow everything
+func (l *ExitLimits) Acquire(remote peer.ID, destination string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	entry := l.peer(remote, now)
+	if entry.Connections >= l.Config.MaxPeerConnections {
+		return nil, ErrTooManyConnections
+	}
+	err = l.reach(entry, destination, now)
+	if err != nil {
+		return nil, err
+	}
+	entry.Connections++
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+
+			entry.Connections--
+		})
+	}
+	return release, nil
+}
+
+// Records the lookup of the host by the remote peer. Lookups count as destinations of the window,
+// so resolving can't be used for scanning either. Nil limits allow everything
+func (l *ExitLimits) Resolve(remote peer.ID, host string) (err error) {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	return l.reach(l.peer(remote, now), "/dns/"+host, now)
+}
+
+// Entry of the remote peer with its expired destinations dropped. The mutex should be held by the caller
+func (l *ExitLimits) peer(remote peer.ID, now time.Time) (entry *exitPeer) {
+	entry, found := l.peers[remote]
+	if !found {
+		if len(l.peers) >= MaxExitPeers {
+			l.forget(now)
+		}
+		entry = &exitPeer{Destinations: make(map[string]time.Time)}
+		l.peers[remote] = entry
+	}
+	entry.expire(now, l.Config.DestinationWindow)
+	return entry
+}
+
+// Records the destination unless the window is full of other destinations. The mutex should be held by the caller
+func (l *ExitLimits) reach(entry *exitPeer, destination string, now time.Time) (err error) {
+	_, known := entry.Destinations[destination]
+	if !known && len(entry.Destinations) >= l.Config.MaxNewDestinations {
+		return ErrTooManyDestinations
+	}
+	entry.Destinations[destination] = now
+	return nil
+}
+
+// Forgets the peers without connections nor recent destinations. The mutex should be held by the caller
+func (l *ExitLimits) forget(now time.Time) {
+	for remote, entry := range l.peers {
+		entry.expire(now, l.Config.DestinationWindow)
+		if entry.Connections == 0 && len(entry.Destinations) == 0 {
+			delete(l.peers, remote)
+		}
+	}
+}
+
+// Nil limits use the default timeout
+func (l *ExitLimits) connectTimeout() (timeout time.Duration) {
+	if l == nil {
+		return DefaultExitConnectTimeout
+	}
+	return l.Config.ConnectTimeout
+}
+
+// Nil limits use the default timeout
+func (l *ExitLimits) idleTimeout() (timeout time.Duration) {
+	if l == nil {
+		return DefaultExitIdleTimeout
+	}
+	return l.Config.IdleTimeout
+}
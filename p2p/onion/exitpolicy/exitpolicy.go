@@ -0,0 +1,360 @@
+package exitpolicy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const (
+	Accept = "accept"
+	Reject = "reject"
+
+	// Address matching every address
+	AnyAddress = "*"
+	// Address matching the PrivateNetworks
+	PrivateAddress = "private"
+	// Ports matching every port
+	AnyPort = "*"
+
+	TCP = "tcp"
+	UDP = "udp"
+)
+
+// Loopback, private, link local, shared, reserved and multicast ranges.
+// Exits reaching them expose their own host and network. Cloud metadata services included
+var PrivateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) (networks []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Single rule of a policy. In its string form:
+//
+//	accept|reject ADDRESS:PORTS [tcp|udp]
+//
+// ADDRESS is *, private, an IP or a CIDR. IPv6 addresses go between brackets.
+// PORTS is *, a port or a range like 80-443. Rules without protocol match both
+type Rule struct {
+	Accept bool
+	// Address as written in the rule
+	Address string
+	// Networks matched by the rule. Nil matches every address
+	Networks []*net.IPNet
+	MinPort  uint16
+	MaxPort  uint16
+	// Empty matches every protocol
+	Protocol string
+}
+
+func (r *Rule) String() (s string) {
+	action := Reject
+	if r.Accept {
+		action = Accept
+	}
+
+	address := r.Address
+	if strings.Contains(address, ":") {
+		address = "[" + address + "]"
+	}
+
+	ports := AnyPort
+	switch {
+	case r.MinPort == 0 && r.MaxPort == 65535:
+	case r.MinPort == r.MaxPort:
+		ports = strconv.Itoa(int(r.MinPort))
+	default:
+		ports = fmt.Sprintf("%d-%d", r.MinPort, r.MaxPort)
+	}
+
+	s = action + " " + address + ":" + ports
+	if r.Protocol != "" {
+		s += " " + r.Protocol
+	}
+	return s
+}
+
+// Checks if the rule applies to the port and protocol
+func (r *Rule) matchesPort(port uint16, protocol string) (match bool) {
+	if r.Protocol != "" && r.Protocol != protocol {
+		return false
+	}
+	return port >= r.MinPort && port <= r.MaxPort
+}
+
+func (r *Rule) Matches(ip net.IP, port uint16, protocol string) (match bool) {
+	if !r.matchesPort(port, protocol) {
+		return false
+	}
+	if r.Networks == nil {
+		return true
+	}
+	for _, network := range r.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseRule(s string) (rule Rule, err error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, fmt.Errorf("invalid rule: %q", s)
+	}
+
+	switch fields[0] {
+	case Accept:
+		rule.Accept = true
+	case Reject:
+	default:
+		return rule, fmt.Errorf("invalid rule action: %q", fields[0])
+	}
+
+	if len(fields) == 3 {
+		switch fields[2] {
+		case TCP, UDP:
+			rule.Protocol = fields[2]
+		default:
+			return rule, fmt.Errorf("invalid rule protocol: %q", fields[2])
+		}
+	}
+
+	index := strings.LastIndex(fields[1], ":")
+	if index == -1 {
+		return rule, fmt.Errorf("no ports in rule: %q", s)
+	}
+	address, ports := fields[1][:index], fields[1][index+1:]
+
+	rule.Address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	switch rule.Address {
+	case AnyAddress:
+	case PrivateAddress:
+		rule.Networks = PrivateNetworks
+	default:
+		network, err := parseNetwork(rule.Address)
+		if err != nil {
+			return rule, err
+		}
+		rule.Networks = []*net.IPNet{network}
+	}
+
+	rule.MinPort, rule.MaxPort, err = parsePorts(ports)
+	if err != nil {
+		return rule, err
+	}
+	return rule, nil
+}
+
+// Parses IPs and CIDRs
+func parseNetwork(address string) (network *net.IPNet, err error) {
+	if strings.Contains(address, "/") {
+		_, network, err = net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule network: %w", err)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid rule address: %q", address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func parsePorts(ports string) (minPort, maxPort uint16, err error) {
+	if ports == AnyPort {
+		return 0, 65535, nil
+	}
+
+	low, high, isRange := strings.Cut(ports, "-")
+	minValue, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rule port: %w", err)
+	}
+	if !isRange {
+		return uint16(minValue), uint16(minValue), nil
+	}
+
+	maxValue, err := strconv.ParseUint(high, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rule port: %w", err)
+	}
+	if maxValue < minValue {
+		return 0, 0, fmt.Errorf("invalid rule port range: %q", ports)
+	}
+	return uint16(minValue), uint16(maxValue), nil
+}
+
+// Ordered list of rules. The first matching rule decides. Destinations matching no rule are rejected
+type Policy []Rule
+
+// Parses the rules in order
+func Parse(rules ...string) (policy Policy, err error) {
+	for _, s := range rules {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		policy = append(policy, rule)
+	}
+	return policy, nil
+}
+
+// Same as Parse but panics on invalid rules
+func MustParse(rules ...string) (policy Policy) {
+	policy, err := Parse(rules...)
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
+
+// Safe default of exit nodes. Rejects the private ranges and accepts the rest
+func Default() (policy Policy) {
+	return MustParse(
+		Reject+" "+PrivateAddress+":"+AnyPort,
+		Accept+" "+AnyAddress+":"+AnyPort,
+	)
+}
+
+// Copy of the policy rejecting the ports before any other rule
+func (p Policy) BlockPorts(ports ...uint16) (policy Policy) {
+	policy = make(Policy, 0, len(ports)+len(p))
+	for _, port := range ports {
+		policy = append(policy, Rule{
+			Accept:  false,
+			Address: AnyAddress,
+			MinPort: port,
+			MaxPort: port,
+		})
+	}
+	return append(policy, p...)
+}
+
+// String form of the rules. Parse reverts it
+func (p Policy) Strings() (rules []string) {
+	rules = make([]string, 0, len(p))
+	for _, rule := range p {
+		rules = append(rules, rule.String())
+	}
+	return rules
+}
+
+func (p Policy) Allows(ip net.IP, port uint16, protocol string) (allowed bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, rule := range p {
+		if rule.Matches(ip, port, protocol) {
+			return rule.Accept
+		}
+	}
+	return false
+}
+
+// Checks if the port could be allowed for some public address.
+// Used when the address is unknown, like hostnames resolved by the exit.
+// Only rules matching every address are considered
+func (p Policy) AllowsPort(port uint16, protocol string) (allowed bool) {
+	for _, rule := range p {
+		if rule.Address != AnyAddress || !rule.matchesPort(port, protocol) {
+			continue
+		}
+		return rule.Accept
+	}
+	return false
+}
+
+// Checks if some port of the address could be allowed. Used for filtering resolved addresses
+func (p Policy) AllowsAddress(ip net.IP) (allowed bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, rule := range p {
+		if !rule.Matches(ip, rule.MinPort, rule.Protocol) {
+			continue
+		}
+		if rule.Accept {
+			return true
+		}
+		if rule.Protocol == "" && rule.MinPort == 0 && rule.MaxPort == 65535 {
+			return false
+		}
+	}
+	return false
+}
+
+var ErrUnsupportedAddress = errors.New("unsupported address")
+
+// Checks the multiaddr. IP multiaddrs are fully checked. DNS ones only by port
+func (p Policy) AllowsMultiaddr(maddr multiaddr.Multiaddr) (allowed bool, err error) {
+	var (
+		port     uint16
+		protocol string
+	)
+	for _, proto := range []int{multiaddr.P_TCP, multiaddr.P_UDP} {
+		value, err := maddr.ValueForProtocol(proto)
+		if err != nil {
+			continue
+		}
+		raw, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return false, fmt.Errorf("invalid port: %w", err)
+		}
+		port = uint16(raw)
+		protocol = TCP
+		if proto == multiaddr.P_UDP {
+			protocol = UDP
+		}
+		break
+	}
+	if protocol == "" {
+		return false, ErrUnsupportedAddress
+	}
+
+	ip, err := manet.ToIP(maddr)
+	if err != nil {
+		for _, proto := range []int{multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6} {
+			_, err := maddr.ValueForProtocol(proto)
+			if err == nil {
+				return p.AllowsPort(port, protocol), nil
+			}
+		}
+		return false, ErrUnsupportedAddress
+	}
+	return p.Allows(ip, port, protocol), nil
+}
@@ -0,0 +1,131 @@
+package exitpolicy_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/RogueTeam/onion/p2p/onion/exitpolicy"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Parse(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		rules := []string{
+			"reject private:*",
+			"reject *:25",
+			"accept 1.2.3.0/24:80-443 tcp",
+			"accept [2001:db8::/32]:53 udp",
+			"reject 8.8.8.8:*",
+			"accept *:*",
+		}
+		policy, err := exitpolicy.Parse(rules...)
+		if !assertions.Nil(err, "failed to parse policy") {
+			return
+		}
+		assertions.Equal(rules, policy.Strings(), "expecting same rules")
+
+		reparsed, err := exitpolicy.Parse(policy.Strings()...)
+		assertions.Nil(err, "failed to parse string form")
+		assertions.Equal(policy.Strings(), reparsed.Strings(), "expecting same policy")
+	})
+	t.Run("Fail", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		for _, rule := range []string{
+			"allow *:*",
+			"accept *",
+			"accept *:70000",
+			"accept *:443-80",
+			"accept 1.2.3:80",
+			"accept *:80 sctp",
+		} {
+			_, err := exitpolicy.Parse(rule)
+			assertions.NotNil(err, "expecting invalid rule: %s", rule)
+		}
+	})
+}
+
+func Test_Allows(t *testing.T) {
+	policy := exitpolicy.MustParse(
+		"reject private:*",
+		"reject *:25",
+		"accept *:53 udp",
+		"reject *:* udp",
+		"accept *:*",
+	)
+
+	type Test struct {
+		IP       string
+		Port     uint16
+		Protocol string
+		Allowed  bool
+	}
+	tests := []Test{
+		{IP: "1.1.1.1", Port: 443, Protocol: exitpolicy.TCP, Allowed: true},
+		{IP: "1.1.1.1", Port: 25, Protocol: exitpolicy.TCP, Allowed: false},
+		{IP: "1.1.1.1", Port: 53, Protocol: exitpolicy.UDP, Allowed: true},
+		{IP: "1.1.1.1", Port: 123, Protocol: exitpolicy.UDP, Allowed: false},
+		{IP: "127.0.0.1", Port: 80, Protocol: exitpolicy.TCP, Allowed: false},
+		{IP: "10.1.2.3", Port: 80, Protocol: exitpolicy.TCP, Allowed: false},
+		{IP: "169.254.169.254", Port: 80, Protocol: exitpolicy.TCP, Allowed: false},
+		{IP: "::ffff:192.168.1.1", Port: 80, Protocol: exitpolicy.TCP, Allowed: false},
+		{IP: "::1", Port: 80, Protocol: exitpolicy.TCP, Allowed: false},
+		{IP: "2606:4700::1111", Port: 80, Protocol: exitpolicy.TCP, Allowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.IP, func(t *testing.T) {
+			assertions := assert.New(t)
+
+			allowed := policy.Allows(net.ParseIP(test.IP), test.Port, test.Protocol)
+			assertions.Equal(test.Allowed, allowed, "unexpected decision")
+		})
+	}
+
+	t.Run("Ports", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		assertions.True(policy.AllowsPort(80, exitpolicy.TCP), "expecting 80 allowed")
+		assertions.False(policy.AllowsPort(25, exitpolicy.TCP), "expecting 25 rejected")
+		assertions.False(exitpolicy.Policy{}.AllowsPort(80, exitpolicy.TCP), "expecting empty policy to reject")
+	})
+	t.Run("Addresses", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		assertions.True(policy.AllowsAddress(net.ParseIP("1.1.1.1")), "expecting public address allowed")
+		assertions.False(policy.AllowsAddress(net.ParseIP("192.168.1.1")), "expecting private address rejected")
+		assertions.True(exitpolicy.MustParse("reject 1.1.1.1:80", "accept 1.1.1.1:443").AllowsAddress(net.ParseIP("1.1.1.1")), "expecting some port allowed")
+		assertions.False(exitpolicy.MustParse("reject 1.1.1.1:80").AllowsAddress(net.ParseIP("1.1.1.1")), "expecting no port allowed")
+	})
+	t.Run("Blocked ports", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		blocked := exitpolicy.Default().BlockPorts(25, 465)
+		assertions.Equal([]string{"reject *:25", "reject *:465", "reject private:*", "accept *:*"}, blocked.Strings(), "expecting blocks before the rules")
+		assertions.False(blocked.Allows(net.ParseIP("1.1.1.1"), 25, exitpolicy.TCP), "expecting 25 rejected")
+		assertions.False(blocked.Allows(net.ParseIP("1.1.1.1"), 465, exitpolicy.UDP), "expecting 465 rejected")
+		assertions.True(blocked.Allows(net.ParseIP("1.1.1.1"), 443, exitpolicy.TCP), "expecting 443 allowed")
+		assertions.Equal([]string{"reject private:*", "accept *:*"}, exitpolicy.Default().Strings(), "expecting original untouched")
+	})
+	t.Run("Multiaddrs", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		for maddr, expected := range map[string]bool{
+			"/ip4/1.1.1.1/tcp/443":     true,
+			"/ip4/127.0.0.1/tcp/443":   false,
+			"/ip6/::1/tcp/443":         false,
+			"/dns/example.com/tcp/443": true,
+			"/dns4/example.com/tcp/25": false,
+			"/ip4/1.1.1.1/udp/53":      true,
+		} {
+			allowed, err := policy.AllowsMultiaddr(multiaddr.StringCast(maddr))
+			assertions.Nil(err, "failed to check %s", maddr)
+			assertions.Equal(expected, allowed, "unexpected decision for %s", maddr)
+		}
+
+		_, err := policy.AllowsMultiaddr(multiaddr.StringCast("/ip4/1.1.1.1"))
+		assertions.ErrorIs(err, exitpolicy.ErrUnsupportedAddress, "expecting unsupported address")
+	})
+}
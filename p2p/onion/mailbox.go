@@ -0,0 +1,417 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/RogueTeam/onion/crypto"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
+	"github.com/RogueTeam/onion/utils"
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	MailboxNodeCidString = BaseString + "-mailbox"
+
+	// Time messages are stored
+	DefaultMailboxTTL = 24 * time.Hour
+	// Maximum size of a single message
+	DefaultMailboxMessageSize = 64 * 1024
+	// Maximum bytes stored for a single hidden address
+	DefaultMailboxQuota = 1024 * 1024
+	// Maximum bytes stored by the relay
+	DefaultMailboxCapacity = 64 * 1024 * 1024
+	// Minimum proof of work difficulty of deposits
+	DefaultMailboxDifficulty = 16
+	// Maximum clock difference accepted for signed mailbox requests and deposits
+	DefaultMailboxRequestWindow = 5 * time.Minute
+
+	mailboxIdLength = 16
+)
+
+var MailboxNodeP2PCid cid.Cid = CidFromData(MailboxNodeCidString)
+
+var (
+	ErrMailboxMessageTooBig = errors.New("message too big")
+	ErrMailboxQuotaExceeded = errors.New("mailbox quota exceeded")
+	ErrMailboxFull          = errors.New("mailbox storage full")
+	ErrDepositReplayed      = errors.New("deposit already received")
+)
+
+// Cid provided by the relays holding messages for the hidden address
+func MailboxCid(address peer.ID) (c cid.Cid) {
+	return CidFromData(MailboxNodeCidString + "-" + address.String())
+}
+
+// Limits of the mailbox relay role
+type MailboxConfig struct {
+	// Time messages are stored before being dropped
+	TTL time.Duration
+	// Maximum size of a single message
+	MessageSize int
+	// Maximum bytes stored for a single hidden address
+	Quota int
+	// Maximum bytes stored by the relay
+	Capacity int
+	// Minimum proof of work difficulty of deposits. Makes flooding mailboxes expensive
+	Difficulty uint64
+}
+
+func (c MailboxConfig) defaults() (cfg MailboxConfig) {
+	if c.TTL == 0 {
+		c.TTL = DefaultMailboxTTL
+	}
+	if c.MessageSize == 0 {
+		c.MessageSize = DefaultMailboxMessageSize
+	}
+	if c.Quota == 0 {
+		c.Quota = DefaultMailboxQuota
+	}
+	if c.Capacity == 0 {
+		c.Capacity = DefaultMailboxCapacity
+	}
+	if c.Difficulty == 0 {
+		c.Difficulty = DefaultMailboxDifficulty
+	}
+	return c
+}
+
+type storedMessage struct {
+	message.MailboxMessage
+	expiry time.Time
+}
+
+// Store and forward storage for hidden services currently offline.
+// Relays with the mailbox role provide MailboxCid of every address they hold messages for
+type Mailbox struct {
+	Config MailboxConfig
+	DHT    *dht.IpfsDHT
+
+	mutex sync.Mutex
+	boxes map[peer.ID][]*storedMessage
+	size  int
+	// Hashcash of accepted deposits until their timestamp leaves the window
+	spent map[string]time.Time
+}
+
+func NewMailbox(cfg MailboxConfig, d *dht.IpfsDHT) (m *Mailbox) {
+	return &Mailbox{
+		Config: cfg.defaults(),
+		DHT:    d,
+		boxes:  make(map[peer.ID][]*storedMessage),
+		spent:  make(map[string]time.Time),
+	}
+}
+
+// Stores the payload. Returns if it is the first message of the address
+func (m *Mailbox) Store(address peer.ID, payload []byte) (first bool, err error) {
+	if len(payload) > m.Config.MessageSize {
+		return false, ErrMailboxMessageTooBig
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expire()
+
+	var used int
+	for _, msg := range m.boxes[address] {
+		used += len(msg.Payload)
+	}
+	if used+len(payload) > m.Config.Quota {
+		return false, ErrMailboxQuotaExceeded
+	}
+	if m.size+len(payload) > m.Config.Capacity {
+		return false, ErrMailboxFull
+	}
+
+	now := time.Now()
+	first = len(m.boxes[address]) == 0
+	m.boxes[address] = append(m.boxes[address], &storedMessage{
+		MailboxMessage: message.MailboxMessage{
+			Id:       crypto.String(mailboxIdLength),
+			Payload:  payload,
+			Received: now.Unix(),
+		},
+		expiry: now.Add(m.Config.TTL),
+	})
+	m.size += len(payload)
+	return first, nil
+}
+
+// Messages stored for the address
+func (m *Mailbox) Fetch(address peer.ID) (messages []message.MailboxMessage) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expire()
+
+	messages = make([]message.MailboxMessage, 0, len(m.boxes[address]))
+	for _, msg := range m.boxes[address] {
+		messages = append(messages, msg.MailboxMessage)
+	}
+	return messages
+}
+
+// Deletes the messages of the address with the passed ids
+func (m *Mailbox) Delete(address peer.ID, ids []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	remove := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		remove[id] = struct{}{}
+	}
+
+	var kept []*storedMessage
+	for _, msg := range m.boxes[address] {
+		if _, found := remove[msg.Id]; found {
+			m.size -= len(msg.Payload)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+
+	if len(kept) == 0 {
+		delete(m.boxes, address)
+		return
+	}
+	m.boxes[address] = kept
+}
+
+// Records the hashcash of a deposit. Returns false when it was already spent
+func (m *Mailbox) spend(hc string, expiry time.Time) (fresh bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expire()
+
+	if _, found := m.spent[hc]; found {
+		return false
+	}
+	m.spent[hc] = expiry
+	return true
+}
+
+// Drops expired messages and spent hashcash. The mutex should be held by the caller
+func (m *Mailbox) expire() {
+	now := time.Now()
+	for hc, expiry := range m.spent {
+		if now.After(expiry) {
+			delete(m.spent, hc)
+		}
+	}
+	for address, box := range m.boxes {
+		var kept []*storedMessage
+		for _, msg := range box {
+			if now.After(msg.expiry) {
+				m.size -= len(msg.Payload)
+				continue
+			}
+			kept = append(kept, msg)
+		}
+
+		if len(kept) == 0 {
+			delete(m.boxes, address)
+			continue
+		}
+		m.boxes[address] = kept
+	}
+}
+
+// Addresses with stored messages
+func (m *Mailbox) Addresses() (addresses []peer.ID) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expire()
+
+	addresses = make([]peer.ID, 0, len(m.boxes))
+	for address := range m.boxes {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func (m *Mailbox) provide(address peer.ID) (err error) {
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	return m.DHT.Provide(ctx, MailboxCid(address), true)
+}
+
+// Expires messages and re-provides the addresses with stored messages on every ttl
+func (m *Mailbox) serve(ttl time.Duration, closed <-chan struct{}) {
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+
+		for _, address := range m.Addresses() {
+			err := m.provide(address)
+			if err != nil {
+				log.Printf("failed to provide mailbox of %s: %v", address, err)
+			}
+		}
+	}
+}
+
+// Payload of the proof of work of a deposit. Bound to the relay to prevent replays at other relays
+func depositDigest(relay peer.ID, deposit *message.Deposit) (digest string) {
+	h := hashcash.DefaultHashAlgorithm()
+	h.Write([]byte(relay))
+	h.Write([]byte(deposit.Address))
+	binary.Write(h, binary.BigEndian, deposit.Timestamp)
+	h.Write(deposit.Payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Prepares a deposit for the relay solving its proof of work
+func NewDeposit(relay peer.ID, address peer.ID, payload []byte, difficulty uint64) (deposit *message.Deposit, err error) {
+	deposit = &message.Deposit{
+		Address:   address,
+		Payload:   payload,
+		Timestamp: time.Now().Unix(),
+	}
+
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	deposit.Hashcash, err = hashcash.New(ctx, hashcash.DefaultHashAlgorithm(), difficulty, crypto.String(message.DefaultSaltLength), depositDigest(relay, deposit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate deposit hashcash: %w", err)
+	}
+	return deposit, nil
+}
+
+// Content signed by the owner of the hidden address. Bound to the relay to prevent replays at other relays.
+// Variable fields are length prefixed so different requests never sign the same bytes
+func mailboxRequestPayload(relay peer.ID, address peer.ID, req *message.MailboxRequest) (payload []byte) {
+	var buf bytes.Buffer
+	buf.WriteString(MailboxNodeCidString)
+	for _, field := range []string{relay.String(), address.String()} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	binary.Write(&buf, binary.BigEndian, req.Timestamp)
+	binary.Write(&buf, binary.BigEndian, uint32(len(req.Delete)))
+	for _, id := range req.Delete {
+		binary.Write(&buf, binary.BigEndian, uint32(len(id)))
+		buf.WriteString(id)
+	}
+	return buf.Bytes()
+}
+
+// Field prime of Curve25519. 2^255 - 19
+var curve25519Prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// X25519 public key of the hidden address. Birational map of the Ed25519 key: u = (1 + y) / (1 - y)
+func mailboxPublicKey(address peer.ID) (pub *[32]byte, err error) {
+	key, err := address.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract public key: %w", err)
+	}
+	if key.Type() != p2pcrypto.Ed25519 {
+		return nil, errors.New("hidden addresses require ed25519 keys")
+	}
+	raw, err := key.Raw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw public key: %w", err)
+	}
+
+	// Little endian y with the sign bit of x cleared
+	var be [32]byte
+	for i := range be {
+		be[i] = raw[31-i]
+	}
+	be[0] &= 0x7f
+	y := new(big.Int).SetBytes(be[:])
+
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519Prime)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, curve25519Prime))
+	u.Mod(u, curve25519Prime)
+
+	pub = new([32]byte)
+	u.FillBytes(be[:])
+	for i := range pub {
+		pub[i] = be[31-i]
+	}
+	return pub, nil
+}
+
+// X25519 private key of the master key of the hidden address. The scalar Ed25519 derives from its seed
+func mailboxPrivateKey(priv p2pcrypto.PrivKey) (key *[32]byte, err error) {
+	if priv.Type() != p2pcrypto.Ed25519 {
+		return nil, errors.New("hidden addresses require ed25519 keys")
+	}
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw private key: %w", err)
+	}
+
+	digest := sha512.Sum512(raw[:ed25519.SeedSize])
+	key = new([32]byte)
+	copy(key[:], digest[:32])
+	return key, nil
+}
+
+// Encrypts the payload for the owner of the hidden address. Only its master key opens it.
+// Sealed payloads are box.AnonymousOverhead bytes longer
+func SealMailboxPayload(address peer.ID, payload []byte) (sealed []byte, err error) {
+	pub, err := mailboxPublicKey(address)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err = box.SealAnonymous(nil, payload, pub, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal payload: %w", err)
+	}
+	return sealed, nil
+}
+
+// Decrypts a payload sealed for the hidden address of the master key
+func OpenMailboxPayload(priv p2pcrypto.PrivKey, sealed []byte) (payload []byte, err error) {
+	address, err := HiddenAddressFromPrivKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := mailboxPublicKey(address)
+	if err != nil {
+		return nil, err
+	}
+	key, err := mailboxPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, ok := box.OpenAnonymous(nil, sealed, pub, key)
+	if !ok {
+		return nil, errors.New("failed to open sealed payload")
+	}
+	return payload, nil
+}
@@ -24,6 +24,14 @@ type (
 	Settings struct {
 		ExitNode      bool
 		PoWDifficulty uint64
+		// Rules of the exit policy in their string form. Check exitpolicy.Parse
+		ExitPolicy []string `msgpack:",omitempty"`
+		// Set when the peer stores messages for offline hidden services
+		Mailbox bool `msgpack:",omitempty"`
+		// Minimum proof of work difficulty of deposits
+		MailboxDifficulty uint64 `msgpack:",omitempty"`
+		// Maximum size of a deposited message
+		MailboxMessageSize int `msgpack:",omitempty"`
 	}
 	Noise struct {
 		PeerPublicKey []byte `json:"peerId"`
@@ -34,16 +42,183 @@ type (
 	External struct {
 		Address multiaddr.Multiaddr `json:"address"`
 	}
+	// Opens an UDP association at the exit node. Datagrams are then framed over the circuit
+	UDPAssociate struct {
+		Address multiaddr.Multiaddr `json:"address"`
+	}
 	Bind struct {
 		// Hex encoded public key
 		HexPublicKey string `json:"publicKey"`
 		// Hex encoded signature of the DefaultHashAlgorithm of the public key
 		HexSignature string
+		// Set when the public key is a signing key certified by the master key of the hidden address
+		Certificate *Certificate `json:"certificate" msgpack:",omitempty"`
+		// Set by single onion services. The service is reachable through a one hop circuit and doesn't hide its location
+		NonAnonymous bool `json:"nonAnonymous" msgpack:",omitempty"`
+	}
+	// Certificate delegating a hidden address to a short lived signing key.
+	// Signed by the master key the hidden address derives from. Allowing the master key to be kept offline
+	Certificate struct {
+		// Marshaled master public key
+		MasterPublicKey []byte `json:"masterPublicKey"`
+		// Marshaled public key of the online signing key
+		SigningPublicKey []byte `json:"signingPublicKey"`
+		// Unix time after which the certificate is no longer valid
+		Expiry int64 `json:"expiry"`
+		// Signature of the master key
+		Signature []byte `json:"signature"`
 	}
 	Dial struct {
 		// Address of the hidden service
 		Address peer.ID `json:"address"`
 	}
+	// VirtualPort is sent by clients once the end-to-end channel with the hidden service is established.
+	// Allows a single hidden address to serve multiple applications
+	VirtualPort struct {
+		Port uint16 `json:"port"`
+	}
+	// Descriptor of a hidden service.
+	// Sent by the relay on every new stream of a dialed hidden service
+	// and by the hidden service to the relay each time it changes
+	Descriptor struct {
+		// Suggested proof of work difficulty required to introduce a new stream
+		Effort uint64 `json:"effort"`
+		// Random value the introduction should include. Prevents precomputed and replayed introductions
+		Nonce string `json:"nonce"`
+		// Certificate of the signing key used by the hidden service. Nil when it uses its master key
+		Certificate *Certificate `json:"certificate" msgpack:",omitempty"`
+		// Set when the hidden service doesn't hide its location. Only the anonymity of the client is preserved
+		NonAnonymous bool `json:"nonAnonymous" msgpack:",omitempty"`
+	}
+	// Introduction of a new stream to a hidden service.
+	// Clients send it to the relay solving the hashcash with the effort of the descriptor.
+	// Then the relay forwards it to the hidden service with the effort the client paid
+	Introduction struct {
+		// Address of the hidden service
+		Address peer.ID `json:"address"`
+		// Nonce of the received descriptor
+		Nonce string `json:"nonce"`
+		// Effort paid by the client. Only set by the relay
+		Effort uint64 `json:"effort"`
+	}
+	// Deposit of a message into the mailbox of a hidden service. Payloads are sealed for the owner of the address
+	Deposit struct {
+		// Address of the hidden service
+		Address peer.ID `json:"address"`
+		Payload []byte  `json:"payload"`
+		// Unix time of the deposit. Bounds how long the proof of work is accepted
+		Timestamp int64 `json:"timestamp"`
+		// Proof of work over the digest of the relay, the address, the timestamp and the payload.
+		// Keeps the cost of the puzzle independent of the payload size
+		Hashcash string `json:"hashcash"`
+	}
+	// Signed request of the owner of a hidden address for its mailbox
+	MailboxRequest struct {
+		// Marshaled public key of the hidden address. The signing key when certified
+		PublicKey []byte `json:"publicKey"`
+		// Certificate of the signing key. Nil when the master key is used directly
+		Certificate *Certificate `json:"certificate" msgpack:",omitempty"`
+		// Unix time of the request. Prevents replays of old requests
+		Timestamp int64 `json:"timestamp"`
+		// Identifiers of the messages to delete. When empty the stored messages are fetched
+		Delete []string `json:"delete" msgpack:",omitempty"`
+		// Signature of the request
+		Signature []byte `json:"signature"`
+	}
+	MailboxMessage struct {
+		Id      string `json:"id"`
+		Payload []byte `json:"payload"`
+		// Unix time the relay received the message
+		Received int64 `json:"received"`
+	}
+	// Response to deposits and mailbox requests
+	MailboxResponse struct {
+		Messages []MailboxMessage `json:"messages" msgpack:",omitempty"`
+		// Reason of the failure. Empty on success
+		Error string `json:"error" msgpack:",omitempty"`
+	}
+	// Signed listing of a hidden service in the public directory
+	Listing struct {
+		// Address of the hidden service
+		Address     peer.ID  `json:"address"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+		Contact     string   `json:"contact"`
+		// Unix time of the publication. Newer listings of the same address replace older ones
+		Published int64 `json:"published"`
+		// Unix time after which the listing is dropped
+		Expiry int64 `json:"expiry"`
+		// Marshaled public key of the hidden address. The signing key when certified
+		PublicKey []byte `json:"publicKey"`
+		// Certificate of the signing key. Nil when the master key is used directly
+		Certificate *Certificate `json:"certificate" msgpack:",omitempty"`
+		Signature   []byte       `json:"signature"`
+	}
+	// Publication of a listing by the last peer of a circuit
+	Publish struct {
+		Listing Listing `json:"listing"`
+		// Proof of work over the digest of the listing. The cost of the publication
+		Hashcash string `json:"hashcash"`
+	}
+	DirectoryQuery struct {
+		// Address of the requested listing. When empty the listings known by the peer matching Search are returned
+		Address peer.ID `json:"address" msgpack:",omitempty"`
+		// Case insensitive text matched against titles, descriptions and tags. Empty matches every listing
+		Search string `json:"search"`
+	}
+	// Response to publications and directory queries
+	DirectoryResponse struct {
+		Listings []Listing `json:"listings" msgpack:",omitempty"`
+		// Reason of the failure. Empty on success
+		Error string `json:"error" msgpack:",omitempty"`
+	}
+	// Signed record mapping a name to a hidden address
+	NameRecord struct {
+		Name string `json:"name"`
+		// Address of the hidden service
+		Address peer.ID `json:"address"`
+		// Unix time of the first registration. Kept by renewals
+		Registered int64 `json:"registered"`
+		// Unix time after which the name is free again
+		Expiry int64 `json:"expiry"`
+		// Proof of work over the digest of the record. The cost of the registration
+		Hashcash string `json:"hashcash"`
+		// Marshaled public key of the hidden address. The signing key when certified
+		PublicKey []byte `json:"publicKey"`
+		// Certificate of the signing key. Nil when the master key is used directly
+		Certificate *Certificate `json:"certificate" msgpack:",omitempty"`
+		Signature   []byte       `json:"signature"`
+	}
+	// Registration or renewal of a name by the last peer of a circuit
+	RegisterName struct {
+		Record NameRecord `json:"record"`
+	}
+	NameQuery struct {
+		Name string `json:"name"`
+	}
+	// Response to registrations and name queries
+	NameResponse struct {
+		Record *NameRecord `json:"record" msgpack:",omitempty"`
+		// Reason of the failure. Empty on success
+		Error string `json:"error" msgpack:",omitempty"`
+	}
+	// Resolution of a host by the exit node at the end of a circuit
+	Resolve struct {
+		Host string `json:"host"`
+		// ip, ip4 or ip6
+		Network string `json:"network"`
+	}
+	ResolveResponse struct {
+		// Resolved addresses allowed by the exit policy
+		Addresses []string `json:"addresses" msgpack:",omitempty"`
+		// Reason of the failure. Empty on success
+		Error string `json:"error" msgpack:",omitempty"`
+		// Set when the host doesn't exist
+		NotFound bool `json:"notFound" msgpack:",omitempty"`
+		// Seconds the addresses can be cached
+		TTL int64 `json:"ttl" msgpack:",omitempty"`
+	}
 	// HiddenDHT msg used for querying anonymously the IPFS HiddenDHT without revealing who is doing it
 	HiddenDHT struct {
 		Cid cid.Cid // Target Cid requested
@@ -56,10 +231,25 @@ type (
 		Noise             *Noise             `msgpack:",omitempty"`
 		Extend            *Extend            `msgpack:",omitempty"`
 		External          *External          `msgpack:",omitempty"`
+		UDPAssociate      *UDPAssociate      `msgpack:",omitempty"`
 		Bind              *Bind              `msgpack:",omitempty"`
 		Dial              *Dial              `msgpack:",omitempty"`
 		HiddenDHT         *HiddenDHT         `msgpack:",omitempty"`
 		HiddenDHTResponse *HiddenDHTResponse `msgpack:",omitempty"`
+		VirtualPort       *VirtualPort       `msgpack:",omitempty"`
+		Descriptor        *Descriptor        `msgpack:",omitempty"`
+		Introduction      *Introduction      `msgpack:",omitempty"`
+		Deposit           *Deposit           `msgpack:",omitempty"`
+		MailboxRequest    *MailboxRequest    `msgpack:",omitempty"`
+		MailboxResponse   *MailboxResponse   `msgpack:",omitempty"`
+		Publish           *Publish           `msgpack:",omitempty"`
+		DirectoryQuery    *DirectoryQuery    `msgpack:",omitempty"`
+		DirectoryResponse *DirectoryResponse `msgpack:",omitempty"`
+		RegisterName      *RegisterName      `msgpack:",omitempty"`
+		NameQuery         *NameQuery         `msgpack:",omitempty"`
+		NameResponse      *NameResponse      `msgpack:",omitempty"`
+		Resolve           *Resolve           `msgpack:",omitempty"`
+		ResolveResponse   *ResolveResponse   `msgpack:",omitempty"`
 	}
 	Message struct {
 		Hashcash string
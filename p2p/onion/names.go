@@ -0,0 +1,288 @@
+package onion
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RogueTeam/onion/crypto"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
+	"github.com/RogueTeam/onion/utils"
+	"github.com/ipfs/go-datastore"
+	record "github.com/libp2p/go-libp2p-record"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/multiformats/go-base32"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DHT namespace of the name records
+	NamesNamespace = BaseString + "-names"
+
+	// Proof of work difficulty paid by every registration and renewal
+	NameDifficulty uint64 = 16
+
+	// Time a name is registered when no TTL is passed
+	DefaultNameTTL = 30 * 24 * time.Hour
+	// Longest time a name can be registered for. Owners renew before the expiry to keep it
+	MaxNameTTL = 365 * 24 * time.Hour
+
+	// Longest name. Shorter than encoded addresses so both can't be confused
+	MaxName = 32
+
+	// Tolerated clock difference with the registrant
+	nameClockSkew = 5 * time.Minute
+)
+
+var ErrNameTaken = errors.New("name registered by another address")
+
+// DHT key of the record of the name
+func NameKey(name string) (key string) {
+	return "/" + NamesNamespace + "/" + name
+}
+
+// Lower cases the name and removes the AddressSuffix
+func normalizeName(name string) (normalized string) {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), AddressSuffix)
+}
+
+// Names are made of lower case letters, digits and hyphens. They can't start or end with a hyphen
+func ValidateName(name string) (err error) {
+	if name == "" || len(name) > MaxName {
+		return fmt.Errorf("names should have between 1 and %d characters", MaxName)
+	}
+	if name[0] == '-' || name[len(name)-1] == '-' {
+		return errors.New("names can't start or end with a hyphen")
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return fmt.Errorf("invalid name character %q", r)
+		}
+	}
+	return nil
+}
+
+// Payload of the proof of work of a name record
+func nameDigest(rec *message.NameRecord) (digest string) {
+	h := hashcash.DefaultHashAlgorithm()
+	h.Write([]byte(NamesNamespace))
+	h.Write([]byte(rec.Name))
+	h.Write([]byte(rec.Address))
+	binary.Write(h, binary.BigEndian, rec.Registered)
+	binary.Write(h, binary.BigEndian, rec.Expiry)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Content signed by the owner of the hidden address
+func nameRecordPayload(rec *message.NameRecord) (payload []byte, err error) {
+	unsigned := *rec
+	unsigned.Signature = nil
+
+	payload, err = msgpack.Marshal(&unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal name record: %w", err)
+	}
+	return append([]byte(NamesNamespace), payload...), nil
+}
+
+// Registers the name for the hidden address of the key. Solving the NameDifficulty proof of work.
+// When a certificate is passed the key should be the certified signing key.
+// Renewals pass the registration time of the current record. A zero time means now.
+// Registrations older than MaxNameTTL before the expiry are moved up to it.
+// A zero TTL means DefaultNameTTL
+func NewNameRecord(ctx context.Context, priv p2pcrypto.PrivKey, cert *message.Certificate, name string, registered time.Time, ttl time.Duration) (rec *message.NameRecord, err error) {
+	name = normalizeName(name)
+	err = ValidateName(name)
+	if err != nil {
+		return nil, err
+	}
+	if ttl == 0 {
+		ttl = DefaultNameTTL
+	}
+	if ttl > MaxNameTTL {
+		return nil, fmt.Errorf("names can't be registered for more than %s", MaxNameTTL)
+	}
+
+	now := time.Now()
+	if registered.IsZero() {
+		registered = now
+	}
+	expiry := now.Add(ttl)
+	if earliest := expiry.Add(-MaxNameTTL); registered.Before(earliest) {
+		registered = earliest
+	}
+
+	rec = &message.NameRecord{
+		Name:        name,
+		Registered:  registered.Unix(),
+		Expiry:      expiry.Unix(),
+		Certificate: cert,
+	}
+	rec.Address, err = hiddenAddressFromCredentials(priv, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.PublicKey, err = p2pcrypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+
+	rec.Hashcash, err = hashcash.New(ctx, hashcash.DefaultHashAlgorithm(), NameDifficulty, crypto.String(message.DefaultSaltLength), nameDigest(rec))
+	if err != nil {
+		return nil, fmt.Errorf("failed to solve name proof of work: %w", err)
+	}
+
+	payload, err := nameRecordPayload(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.Signature, err = priv.Sign(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign name record: %w", err)
+	}
+	return rec, nil
+}
+
+// Verifies the name, the times, the proof of work and the signature of the record.
+// Registrations can't be older than MaxNameTTL before the expiry. Bounds how far back a record can claim to be
+func VerifyNameRecord(rec *message.NameRecord) (err error) {
+	err = ValidateName(rec.Name)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	switch {
+	case now.Unix() >= rec.Expiry:
+		return errors.New("name record expired")
+	case rec.Expiry > now.Add(MaxNameTTL+nameClockSkew).Unix():
+		return errors.New("name record expiry too far")
+	case rec.Registered > now.Add(nameClockSkew).Unix():
+		return errors.New("name registered in the future")
+	case rec.Registered < rec.Expiry-int64(MaxNameTTL/time.Second):
+		return errors.New("name registration too old")
+	}
+
+	err = hashcash.VerifyWithDifficultyAndPayload(hashcash.DefaultHashAlgorithm(), rec.Hashcash, NameDifficulty, nameDigest(rec))
+	if err != nil {
+		return fmt.Errorf("invalid name proof of work: %w", err)
+	}
+
+	pub, err := p2pcrypto.UnmarshalPublicKey(rec.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal public key: %w", err)
+	}
+
+	address, err := verifyCredentials(pub, rec.Certificate)
+	if err != nil {
+		return err
+	}
+	if address != rec.Address {
+		return errors.New("name record signed for a different address")
+	}
+
+	payload, err := nameRecordPayload(rec)
+	if err != nil {
+		return err
+	}
+
+	valid, err := pub.Verify(payload, rec.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to verify name record signature: %w", err)
+	}
+	if !valid {
+		return errors.New("invalid name record signature")
+	}
+	return nil
+}
+
+// DHT validator of the names namespace.
+// Datastore is the one of the DHT. Its stored record protects the name from backdated registrations
+type NameValidator struct {
+	Datastore datastore.Read
+}
+
+func (NameValidator) Validate(key string, value []byte) (err error) {
+	var rec message.NameRecord
+	err = msgpack.Unmarshal(value, &rec)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal name record: %w", err)
+	}
+
+	if key != NameKey(rec.Name) {
+		return errors.New("name record stored under a different key")
+	}
+	return VerifyNameRecord(&rec)
+}
+
+// Valid record of the key stored by the DHT
+func (v NameValidator) stored(key string) (rec *message.NameRecord, found bool) {
+	if v.Datastore == nil {
+		return nil, false
+	}
+
+	ctx, cancel := utils.NewContext()
+	defer cancel()
+
+	// Same encoding kad-dht uses for the keys of its datastore
+	buf, err := v.Datastore.Get(ctx, datastore.NewKey(base32.RawStdEncoding.EncodeToString([]byte(key))))
+	if err != nil {
+		return nil, false
+	}
+
+	var stored recpb.Record
+	err = proto.Unmarshal(buf, &stored)
+	if err != nil || v.Validate(key, stored.GetValue()) != nil {
+		return nil, false
+	}
+
+	rec = &message.NameRecord{}
+	msgpack.Unmarshal(stored.GetValue(), rec)
+	return rec, true
+}
+
+// First come, first served. The earliest registration wins.
+// Between records of the same address the renewal with the latest expiry is selected.
+// Registrations are only trusted to be old when renewing the stored record.
+// Records of other addresses should have been registered within the clock skew
+func (v NameValidator) Select(key string, values [][]byte) (index int, err error) {
+	stored, found := v.stored(key)
+	backdated := time.Now().Add(-nameClockSkew).Unix()
+
+	index = -1
+	var selected message.NameRecord
+	for i, value := range values {
+		if v.Validate(key, value) != nil {
+			continue
+		}
+
+		var rec message.NameRecord
+		msgpack.Unmarshal(value, &rec)
+		if found && rec.Address != stored.Address && rec.Registered < backdated {
+			continue
+		}
+
+		switch {
+		case index == -1,
+			rec.Address == selected.Address && rec.Expiry > selected.Expiry,
+			rec.Address != selected.Address && rec.Registered < selected.Registered:
+			index, selected = i, rec
+		}
+	}
+
+	if index == -1 {
+		return 0, errors.New("no valid name record found")
+	}
+	return index, nil
+}
+
+var _ record.Validator = NameValidator{}
@@ -1,7 +1,9 @@
 package onion
 
 import (
+	"errors"
 	"fmt"
+	"math/rand/v2"
 
 	"github.com/RogueTeam/onion/set"
 	"github.com/RogueTeam/onion/utils"
@@ -49,9 +51,66 @@ func (s *Service) ListPeers() (peers []*Peer, err error) {
 		entry.Modes.Add(ExitNodeP2PCid)
 	}
 
+	mailboxMode, err := s.DHT.FindProviders(ctx, MailboxNodeP2PCid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find mailbox mode peers: %w", err)
+	}
+	for _, info := range mailboxMode {
+		entry, found := ref[info.ID]
+		if !found {
+			continue
+		}
+		entry.Modes.Add(MailboxNodeP2PCid)
+	}
+
+	recordsMode, err := s.DHT.FindProviders(ctx, RecordsNodeP2PCid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find records mode peers: %w", err)
+	}
+	for _, info := range recordsMode {
+		entry, found := ref[info.ID]
+		if !found {
+			continue
+		}
+		entry.Modes.Add(RecordsNodeP2PCid)
+	}
+
 	peers = make([]*Peer, 0, len(ref))
 	for _, entry := range ref {
 		peers = append(peers, entry)
 	}
 	return peers, nil
 }
+
+// Circuit ending at a random node storing names and directory listings.
+// The next node is tried when the circuit can't be built
+func (s *Service) recordsCircuit() (c *Circuit, err error) {
+	peers, err := s.ListPeers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peers: %w", err)
+	}
+
+	var relays []peer.ID
+	for _, p := range peers {
+		if p.Info.ID != s.ID && p.Modes.Has(RecordsNodeP2PCid) {
+			relays = append(relays, p.Info.ID)
+		}
+	}
+	if len(relays) == 0 {
+		return nil, errors.New("no records relays found")
+	}
+	rand.Shuffle(len(relays), func(i, j int) {
+		relays[i], relays[j] = relays[j], relays[i]
+	})
+
+	var errs []error
+	for _, relay := range relays {
+		c, err = s.RandomCircuit(s.Hops, relay)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", relay, err))
+			continue
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("failed to prepare circuit: %w", errors.Join(errs...))
+}
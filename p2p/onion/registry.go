@@ -0,0 +1,150 @@
+package onion
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Maximum number of hidden services a relay hosts by default
+const DefaultMaxHiddenServices = 1024
+
+var ErrTooManyHiddenServices = errors.New("too many hidden services bound")
+
+// Hidden service bound at this relay
+type HiddenServiceEntry struct {
+	Address peer.ID
+	// Time the bind was accepted
+	BoundAt time.Time
+	// Peer the bind arrived from. The previous hop of the service circuit
+	Peer peer.ID
+	// Connection holding the bind
+	Connection *Connection
+	// Session used for reaching the hidden service
+	Session *yamux.Session
+	// DHT advertisement of the service
+	Advertisement *Advertisement
+
+	activeStreams atomic.Int64
+	bytesRelayed  atomic.Uint64
+}
+
+// Number of client streams currently piped to the service
+func (e *HiddenServiceEntry) ActiveStreams() (streams int64) {
+	return e.activeStreams.Load()
+}
+
+// Bytes piped between clients and the service in both directions
+func (e *HiddenServiceEntry) BytesRelayed() (bytes uint64) {
+	return e.bytesRelayed.Load()
+}
+
+// Snapshot of a hidden service entry for operators
+type HiddenServiceInfo struct {
+	Address       peer.ID
+	BoundAt       time.Time
+	Peer          peer.ID
+	ActiveStreams int64
+	BytesRelayed  uint64
+	NonAnonymous  bool
+	Advertisement AdvertisementStatus
+}
+
+func (e *HiddenServiceEntry) Info() (info HiddenServiceInfo) {
+	return HiddenServiceInfo{
+		Address:       e.Address,
+		BoundAt:       e.BoundAt,
+		Peer:          e.Peer,
+		ActiveStreams: e.ActiveStreams(),
+		BytesRelayed:  e.BytesRelayed(),
+		NonAnonymous:  e.Advertisement.NonAnonymous,
+		Advertisement: e.Advertisement.Status(),
+	}
+}
+
+// Hidden services hosted by the relay.
+// Binding an already hosted address replaces the previous entry, closing its session. The latest bind always wins
+type HiddenServiceRegistry struct {
+	// Maximum number of services bound at the same time. Zero or negative means unlimited
+	MaxServices int
+
+	mutex   sync.RWMutex
+	entries map[peer.ID]*HiddenServiceEntry
+}
+
+func NewHiddenServiceRegistry(maxServices int) (r *HiddenServiceRegistry) {
+	return &HiddenServiceRegistry{
+		MaxServices: maxServices,
+		entries:     make(map[peer.ID]*HiddenServiceEntry),
+	}
+}
+
+// Registers the entry. Rebinds of the same address close the session of the replaced entry
+func (r *HiddenServiceRegistry) Register(entry *HiddenServiceEntry) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	old, found := r.entries[entry.Address]
+	if !found && r.MaxServices > 0 && len(r.entries) >= r.MaxServices {
+		return ErrTooManyHiddenServices
+	}
+
+	r.entries[entry.Address] = entry
+	if found {
+		old.Session.Close()
+	}
+	return nil
+}
+
+// Removes the entry only if it wasn't replaced by a rebind
+func (r *HiddenServiceRegistry) Unregister(entry *HiddenServiceEntry) (deleted bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.entries[entry.Address] != entry {
+		return false
+	}
+	delete(r.entries, entry.Address)
+	return true
+}
+
+func (r *HiddenServiceRegistry) Load(address peer.ID) (entry *HiddenServiceEntry, found bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entry, found = r.entries[address]
+	return entry, found
+}
+
+func (r *HiddenServiceRegistry) Len() (length int) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.entries)
+}
+
+// Snapshot of every hosted service sorted by address
+func (r *HiddenServiceRegistry) List() (infos []HiddenServiceInfo) {
+	r.mutex.RLock()
+	entries := make([]*HiddenServiceEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	r.mutex.RUnlock()
+
+	slices.SortFunc(entries, func(a, b *HiddenServiceEntry) int {
+		return strings.Compare(string(a.Address), string(b.Address))
+	})
+
+	infos = make([]HiddenServiceInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, entry.Info())
+	}
+	return infos
+}
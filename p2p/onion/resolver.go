@@ -0,0 +1,238 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const (
+	// Longest time resolved addresses are cached by exit nodes
+	DefaultResolveTTL = time.Minute
+	// Maximum number of cached hosts
+	MaxResolveEntries = 4096
+)
+
+type resolvedHost struct {
+	IPs    []net.IP
+	Expiry time.Time
+}
+
+// Caching resolver used by exit nodes.
+// Addresses are cached for the lowest TTL of their records, up to TTL
+type Resolver struct {
+	// Resolves the hosts the DNS servers don't answer, cached for TTL. Nil uses net.DefaultResolver
+	Resolver *net.Resolver
+	// DNS servers queried for the records of the hosts, in host:port form
+	Servers []string
+	// Longest time addresses are cached
+	TTL time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]resolvedHost
+}
+
+func NewResolver(ttl time.Duration) (r *Resolver) {
+	if ttl == 0 {
+		ttl = DefaultResolveTTL
+	}
+	return &Resolver{
+		Servers: systemDNSServers(),
+		TTL:     ttl,
+		entries: make(map[string]resolvedHost),
+	}
+}
+
+// DNS servers of the system. Nil when they can't be read
+func systemDNSServers() (servers []string) {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	return servers
+}
+
+// Resolves the host. Network is ip, ip4 or ip6
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) (ips []net.IP, err error) {
+	ips, _, err = r.Lookup(ctx, network, host)
+	return ips, err
+}
+
+// Same as LookupIP but also returns the time the addresses remain cached
+func (r *Resolver) Lookup(ctx context.Context, network, host string) (ips []net.IP, ttl time.Duration, err error) {
+	key := network + "/" + host
+
+	r.mutex.Lock()
+	entry, found := r.entries[key]
+	r.mutex.Unlock()
+	if found {
+		ttl = time.Until(entry.Expiry)
+		if ttl > 0 {
+			return entry.IPs, ttl, nil
+		}
+	}
+
+	ips, ttl, err = r.lookup(ctx, network, host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.entries) >= MaxResolveEntries {
+		r.expire()
+	}
+	if len(r.entries) < MaxResolveEntries {
+		r.entries[key] = resolvedHost{IPs: ips, Expiry: time.Now().Add(ttl)}
+	}
+	return ips, ttl, nil
+}
+
+// Resolves the host with the DNS servers. Hosts they don't answer, like those of the hosts file,
+// are resolved by Resolver
+func (r *Resolver) lookup(ctx context.Context, network, host string) (ips []net.IP, ttl time.Duration, err error) {
+	if net.ParseIP(host) == nil && len(r.Servers) > 0 {
+		ips, ttl, err = r.exchange(ctx, network, host)
+		if err == nil {
+			return ips, ttl, nil
+		}
+	}
+
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err = resolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to resolve host: %w", err)
+	}
+	return ips, r.TTL, nil
+}
+
+// Queries the address records of the host. Returns the lowest TTL of the answers, up to TTL
+func (r *Resolver) exchange(ctx context.Context, network, host string) (ips []net.IP, ttl time.Duration, err error) {
+	var types []uint16
+	switch network {
+	case "ip4":
+		types = []uint16{dns.TypeA}
+	case "ip6":
+		types = []uint16{dns.TypeAAAA}
+	default:
+		types = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+
+	ttl = r.TTL
+	for _, qtype := range types {
+		res, err := r.query(ctx, new(dns.Msg).SetQuestion(dns.Fqdn(host), qtype))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, rr := range res.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			default:
+				continue
+			}
+			ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no addresses found: %s", host)
+	}
+	return ips, ttl, nil
+}
+
+// Sends the request to the servers until one answers it. Truncated answers are queried again over TCP
+func (r *Resolver) query(ctx context.Context, req *dns.Msg) (res *dns.Msg, err error) {
+	var errs []error
+	for _, server := range r.Servers {
+		res, _, err = (&dns.Client{}).ExchangeContext(ctx, req, server)
+		if err == nil && res.Truncated {
+			res, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, req, server)
+		}
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case res.Rcode != dns.RcodeSuccess:
+			errs = append(errs, fmt.Errorf("%s answered %s", server, dns.RcodeToString[res.Rcode]))
+		default:
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to query dns servers: %w", errors.Join(errs...))
+}
+
+// Drops expired entries. The mutex should be held by the caller
+func (r *Resolver) expire() {
+	now := time.Now()
+	for key, entry := range r.entries {
+		if now.After(entry.Expiry) {
+			delete(r.entries, key)
+		}
+	}
+}
+
+// Network of the DNS multiaddr protocol
+func dnsNetwork(code int) (network string, found bool) {
+	switch code {
+	case multiaddr.P_DNS:
+		return "ip", true
+	case multiaddr.P_DNS4:
+		return "ip4", true
+	case multiaddr.P_DNS6:
+		return "ip6", true
+	default:
+		return "", false
+	}
+}
+
+// Checks if the multiaddr starts with a DNS protocol
+func isDNSMultiaddr(maddr multiaddr.Multiaddr) (isDNS bool) {
+	first, _ := multiaddr.SplitFirst(maddr)
+	if first == nil {
+		return false
+	}
+	_, isDNS = dnsNetwork(first.Code())
+	return isDNS
+}
+
+// Replaces the DNS component of the multiaddr by each resolved address
+func (r *Resolver) ResolveMultiaddr(ctx context.Context, maddr multiaddr.Multiaddr) (resolved []multiaddr.Multiaddr, err error) {
+	first, rest := multiaddr.SplitFirst(maddr)
+	if first == nil {
+		return nil, errors.New("empty multiaddr")
+	}
+	network, found := dnsNetwork(first.Code())
+	if !found {
+		return []multiaddr.Multiaddr{maddr}, nil
+	}
+
+	ips, err := r.LookupIP(ctx, network, first.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		ipAddr, err := manet.FromIP(ip)
+		if err != nil {
+			continue
+		}
+		resolved = append(resolved, ipAddr.Encapsulate(rest))
+	}
+	return resolved, nil
+}
@@ -1,16 +1,18 @@
 package onion
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/RogueTeam/onion/p2p/dhtutils"
+	"github.com/RogueTeam/onion/p2p/onion/exitpolicy"
 	"github.com/RogueTeam/onion/p2p/onion/message"
 	"github.com/RogueTeam/onion/pow/hashcash"
 	"github.com/RogueTeam/onion/utils"
-	"github.com/hashicorp/yamux"
 	"github.com/ipfs/go-cid"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/crypto"
@@ -28,10 +30,14 @@ import (
 var DefaultMuxerUpgrader = []upgrader.StreamMuxer{{ID: ProtocolId, Muxer: yamuxp2p.DefaultTransport}}
 
 func HiddenAddressFromPrivKey(priv crypto.PrivKey) (address peer.ID, err error) {
-	return peer.IDFromPrivateKey(priv)
+	return HiddenAddressFromPubKey(priv.GetPublic())
 }
 
+// Hidden addresses are derived from Ed25519 keys. Check EncodeAddress for their string form
 func HiddenAddressFromPubKey(pub crypto.PubKey) (address peer.ID, err error) {
+	if pub.Type() != crypto.Ed25519 {
+		return "", errors.New("hidden addresses require ed25519 keys")
+	}
 	return peer.IDFromPublicKey(pub)
 }
 
@@ -39,11 +45,14 @@ const (
 	BaseString         = "onionp2p"
 	BasicNodeCidString = BaseString + "-basic"
 	ExitNodeCidString  = BaseString + "-exitnode"
+	// Provided by the nodes storing names and directory listings
+	RecordsNodeCidString = BaseString + "-records"
 )
 
 var (
-	BasicNodeP2PCid cid.Cid = CidFromData(BasicNodeCidString)
-	ExitNodeP2PCid  cid.Cid = CidFromData(ExitNodeCidString)
+	BasicNodeP2PCid   cid.Cid = CidFromData(BasicNodeCidString)
+	ExitNodeP2PCid    cid.Cid = CidFromData(ExitNodeCidString)
+	RecordsNodeP2PCid cid.Cid = CidFromData(RecordsNodeCidString)
 )
 
 func CidFromData[T ~string | ~[]byte](data T) cid.Cid {
@@ -72,8 +81,50 @@ type Service struct {
 	DHT *dht.IpfsDHT
 	// Work in outside mode allowing connections outside the network
 	ExitNode bool
+	// Destinations allowed in outside mode
+	ExitPolicy exitpolicy.Policy
+	// Abuse controls of outside mode. Nil when not an exit node
+	ExitLimits *ExitLimits
+	// Resolver of the hosts requested in outside mode
+	Resolver *Resolver
+	// Idle time after which UDP associations are closed
+	UDPIdleTimeout time.Duration
+	// Limits of the relayed traffic. Nil is unlimited
+	Bandwidth *Bandwidth
+	// Traffic relayed since the service started
+	Traffic Traffic
+	// Quota of relayed traffic. Nil is unlimited
+	Accounting *Accounting
 	// Hidden services the application is serving as proxy
-	HiddenServices *utils.Map[peer.ID, *yamux.Session]
+	HiddenServices *HiddenServiceRegistry
+	// Messages stored for offline hidden services. Nil when the mailbox role is disabled
+	Mailbox *Mailbox
+	// Listings of the public directory published through this node
+	Directory *Directory
+	// Interval between advertisements
+	TTL time.Duration
+	// Number of peers used by the circuits built by the service
+	Hops int
+
+	hiddenMutex sync.Mutex
+	// Sessions opened by DialHidden
+	hiddenConnections map[peer.ID]*HiddenServiceConnection
+
+	exitMutex sync.Mutex
+	// Policies advertised by the exits used by ExitCircuit
+	exitPolicies map[peer.ID]exitpolicy.Policy
+
+	relaysMutex sync.Mutex
+	// Traffic of the circuits passing through the node
+	relays map[*Traffic]struct{}
+
+	namesMutex sync.Mutex
+	// Records resolved by ResolveName
+	names map[string]cachedName
+
+	// Closed to stop the background loops
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 const ProtocolId protocol.ID = "/onionp2p/0.0.1"
@@ -83,10 +134,19 @@ const ProtocolId protocol.ID = "/onionp2p/0.0.1"
 func (s *Service) Settings() (settings *message.Settings) {
 	k := s.Connections.Add(1)
 	diff := hashcash.LogDifficulty(hashcash.DefaultHashAlgorithm(), k)
-	return &message.Settings{
+	settings = &message.Settings{
 		ExitNode:      s.ExitNode,
 		PoWDifficulty: diff,
 	}
+	if s.ExitNode {
+		settings.ExitPolicy = s.ExitPolicy.Strings()
+	}
+	if s.Mailbox != nil {
+		settings.Mailbox = true
+		settings.MailboxDifficulty = s.Mailbox.Config.Difficulty
+		settings.MailboxMessageSize = s.Mailbox.Config.MessageSize
+	}
+	return settings
 }
 
 func PromoteService(cfg *Config) (doContinue bool) {
@@ -108,6 +168,28 @@ func PromoteService(cfg *Config) (doContinue bool) {
 			return false
 		}
 	}
+
+	if cfg.Mailbox != nil {
+		ctx, cancel := utils.NewContext()
+		defer cancel()
+
+		err := cfg.DHT.Provide(ctx, MailboxNodeP2PCid, len(cfg.DHT.RoutingTable().ListPeers()) > 0)
+		if err != nil {
+			log.Printf("failed to provide mailbox node cid: %v", err)
+			return false
+		}
+	}
+
+	if cfg.Records {
+		ctx, cancel := utils.NewContext()
+		defer cancel()
+
+		err := cfg.DHT.Provide(ctx, RecordsNodeP2PCid, len(cfg.DHT.RoutingTable().ListPeers()) > 0)
+		if err != nil {
+			log.Printf("failed to provide records node cid: %v", err)
+			return false
+		}
+	}
 	return true
 }
 
@@ -126,6 +208,27 @@ func New(cfg Config) (s *Service, err error) {
 		}
 	}
 
+	noiseTransport, err := noise.New(
+		ProtocolId,
+		cfg.Host.Peerstore().PrivKey(cfg.Host.ID()),
+		[]upgrader.StreamMuxer{{ID: ProtocolId, Muxer: p2pYamux.DefaultTransport}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare noise transport: %w", err)
+	}
+
+	var accounting *Accounting
+	if cfg.Accounting != nil {
+		accounting, err = NewAccounting(*cfg.Accounting)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare accounting: %w", err)
+		}
+		go accounting.serve(DefaultAccountingSaveInterval)
+	}
+
+	// Nothing fails from here. Background loops run until Close
+	closed := make(chan struct{})
+
 	// Notify to the network the service is available
 	if !cfg.HiddenMode {
 		go func() {
@@ -133,33 +236,74 @@ func New(cfg Config) (s *Service, err error) {
 			defer ticker.Stop()
 
 			for {
-				doContinue := PromoteService(&cfg)
-				if !doContinue {
+				// Hibernating nodes stop advertising until the next accounting period
+				if !accounting.Hibernating() {
+					doContinue := PromoteService(&cfg)
+					if !doContinue {
+						return
+					}
+				}
+
+				select {
+				case <-ticker.C:
+				case <-closed:
 					return
 				}
-				<-ticker.C
 			}
 		}()
 	}
 
 	s = &Service{
 		ExitNode:       cfg.ExitNode,
+		ExitPolicy:     cfg.ExitPolicy,
+		Resolver:       NewResolver(DefaultResolveTTL),
+		UDPIdleTimeout: cfg.UDPIdleTimeout,
 		ID:             cfg.Host.ID(),
 		Host:           cfg.Host,
 		DHT:            cfg.DHT,
-		HiddenServices: new(utils.Map[peer.ID, *yamux.Session]),
+		HiddenServices: NewHiddenServiceRegistry(cfg.MaxHiddenServices),
+		Directory:      NewDirectory(cfg.DHT),
+		TTL:            cfg.TTL,
+		Hops:           cfg.Hops,
+		Accounting:     accounting,
+		Noise:          noiseTransport,
+		closed:         closed,
 	}
+	s.Traffic.Started = time.Now()
+	go s.Directory.serve(cfg.TTL, closed)
 
-	s.Noise, err = noise.New(
-		ProtocolId,
-		cfg.Host.Peerstore().PrivKey(cfg.Host.ID()),
-		[]upgrader.StreamMuxer{{ID: ProtocolId, Muxer: p2pYamux.DefaultTransport}},
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare noise transport: %w", err)
+	if cfg.ExitNode {
+		s.ExitLimits = NewExitLimits(cfg.ExitLimits)
+		s.ExitPolicy = s.ExitPolicy.BlockPorts(s.ExitLimits.Config.BlockedPorts...)
+	}
+
+	if cfg.Bandwidth != nil {
+		s.Bandwidth = NewBandwidth(*cfg.Bandwidth)
+	}
+
+	if cfg.Mailbox != nil {
+		s.Mailbox = NewMailbox(*cfg.Mailbox, cfg.DHT)
+		go s.Mailbox.serve(cfg.TTL, closed)
 	}
 
 	// Register stream handler
 	cfg.Host.SetStreamHandler(ProtocolId, s.StreamHandler)
 	return s, nil
 }
+
+// Stops handling new streams and the background loops, and saves the accounting once more.
+// The host and the DHT are closed by the caller
+func (s *Service) Close() (err error) {
+	s.Host.RemoveStreamHandler(ProtocolId)
+	s.closeOnce.Do(func() {
+		if s.closed != nil {
+			close(s.closed)
+		}
+	})
+
+	err = s.Accounting.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close accounting: %w", err)
+	}
+	return nil
+}
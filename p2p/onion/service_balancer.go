@@ -0,0 +1,230 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// Backends used when no maximum is passed
+	DefaultMaxBackends = 3
+	// Base time a backend is skipped after a failure. Doubles on every consecutive failure
+	DefaultBackendBackoff = time.Second
+	// Maximum time a backend is skipped
+	DefaultBackendMaxBackoff = time.Minute
+)
+
+// Health of a single backend of a balanced hidden service
+type HiddenBackendStatus struct {
+	// Relay hosting the backend
+	Provider peer.ID
+	// Consecutive failures opening streams
+	Failures int
+	// The backend is skipped until this time
+	UnhealthyUntil time.Time
+}
+
+type hiddenBackend struct {
+	HiddenBackendStatus
+	connection *HiddenServiceConnection
+}
+
+// Spreads the streams of a hidden address across the relays hosting it.
+// Useful when multiple instances serve the same key. Check HiddenServiceConfig.Shared
+type HiddenServiceBalancer struct {
+	Address peer.ID
+	Service *Service
+	// Maximum number of backends used at the same time
+	MaxBackends int
+
+	mutex    sync.Mutex
+	backends []*hiddenBackend
+	next     int
+}
+
+// Connects to up to maxBackends relays hosting the hidden address. Zero or less means DefaultMaxBackends
+func (s *Service) DialHiddenBalanced(ctx context.Context, address peer.ID, maxBackends int) (b *HiddenServiceBalancer, err error) {
+	if maxBackends <= 0 {
+		maxBackends = DefaultMaxBackends
+	}
+
+	b = &HiddenServiceBalancer{
+		Address:     address,
+		Service:     s,
+		MaxBackends: maxBackends,
+	}
+
+	err = b.Refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Removes closed backends and connects to new providers of the address until MaxBackends is reached
+func (b *HiddenServiceBalancer) Refresh(ctx context.Context) (err error) {
+	b.mutex.Lock()
+	b.backends = removeClosedBackends(b.backends)
+	var connected []peer.ID
+	for _, backend := range b.backends {
+		connected = append(connected, backend.Provider)
+	}
+	missing := b.MaxBackends - len(b.backends)
+	b.mutex.Unlock()
+
+	if missing <= 0 {
+		return nil
+	}
+
+	providers, err := b.Service.lookupHidden(ctx, b.Address)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, provider := range providers {
+		if missing == 0 {
+			break
+		}
+		if slices.Contains(connected, provider.ID) {
+			continue
+		}
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		connection, err := b.Service.dialHiddenAt(ctx, b.Address, provider.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", provider.ID, err))
+			continue
+		}
+
+		// Concurrent refreshes may have filled the backends in the meantime
+		b.mutex.Lock()
+		full := len(b.backends) >= b.MaxBackends
+		if !full {
+			b.backends = append(b.backends, &hiddenBackend{
+				HiddenBackendStatus: HiddenBackendStatus{Provider: provider.ID},
+				connection:          connection,
+			})
+		}
+		b.mutex.Unlock()
+		if full {
+			connection.Close()
+			break
+		}
+		missing--
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.backends) == 0 {
+		return fmt.Errorf("failed to dial providers: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Opens a new connection to the virtual port using the next healthy backend.
+// Backends failing are skipped with an exponential backoff.
+// If none is available the balancer is refreshed
+func (b *HiddenServiceBalancer) Open(port uint16) (conn net.Conn, err error) {
+	var errs []error
+	for attempt := range 2 {
+		if attempt > 0 {
+			err = b.Refresh(context.TODO())
+			if err != nil {
+				return nil, errors.Join(append(errs, err)...)
+			}
+		}
+
+		for {
+			backend, found := b.pick()
+			if !found {
+				break
+			}
+
+			conn, err = backend.connection.Open(port)
+			b.report(backend, err)
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", backend.Provider, err))
+		}
+	}
+	return nil, fmt.Errorf("no healthy backends: %w", errors.Join(errs...))
+}
+
+// Round robin over the healthy backends
+func (b *HiddenServiceBalancer) pick() (backend *hiddenBackend, found bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.backends = removeClosedBackends(b.backends)
+
+	now := time.Now()
+	for range b.backends {
+		backend = b.backends[b.next%len(b.backends)]
+		b.next++
+		if now.After(backend.UnhealthyUntil) {
+			return backend, true
+		}
+	}
+	return nil, false
+}
+
+func (b *HiddenServiceBalancer) report(backend *hiddenBackend, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err == nil {
+		backend.Failures = 0
+		backend.UnhealthyUntil = time.Time{}
+		return
+	}
+
+	backoff := DefaultBackendBackoff << min(backend.Failures, 16)
+	backend.Failures++
+	backend.UnhealthyUntil = time.Now().Add(min(backoff, DefaultBackendMaxBackoff))
+}
+
+// Health of the current backends
+func (b *HiddenServiceBalancer) Backends() (backends []HiddenBackendStatus) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, backend := range b.backends {
+		backends = append(backends, backend.HiddenBackendStatus)
+	}
+	return backends
+}
+
+func (b *HiddenServiceBalancer) Close() (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var errs []error
+	for _, backend := range b.backends {
+		errs = append(errs, backend.connection.Close())
+	}
+	b.backends = nil
+	return errors.Join(errs...)
+}
+
+func removeClosedBackends(backends []*hiddenBackend) (alive []*hiddenBackend) {
+	for _, backend := range backends {
+		if backend.connection.Session.IsClosed() {
+			continue
+		}
+		alive = append(alive, backend)
+	}
+	return alive
+}
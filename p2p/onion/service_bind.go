@@ -0,0 +1,193 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/identity"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/hashicorp/yamux"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const DefaultRebindInterval = 5 * time.Second
+
+// Configuration of a hidden service supervised by the Service
+type HiddenServiceConfig struct {
+	// Private key of the hidden service. When a certificate is configured this is the certified signing key.
+	// When not set the key is loaded from KeyFile
+	PrivKey crypto.PrivKey
+	// Location of the key of the hidden service. If the file doesn't exist a new key is generated and saved.
+	// This allows long-running services to keep their address between restarts
+	KeyFile string
+	// Certificate issued by the offline master key for the signing key.
+	// When not set and CertificateFile is empty the key is used as the master key
+	Certificate *message.Certificate
+	// Location of the certificate. Together with KeyFile it is reloaded on every rebind,
+	// so signing keys can be rotated before they expire without restarting the service
+	CertificateFile string
+	// Number of peers of the circuits used for binding. Zero uses the Service's Hops
+	Hops int
+	// Single onion mode. The service binds at a one hop circuit, trading its own anonymity for latency.
+	// Clients keep their anonymity and are told the service is non-anonymous
+	SingleOnion bool
+	// Time waited before retrying a failed bind.
+	// Sessions lasting less than it are also followed by the wait, so relays dropping the bind aren't hammered
+	RebindInterval time.Duration
+	// Set when other instances serve the same key for load balancing.
+	// Relays already hosting the address are avoided so every instance is bound at a different relay.
+	// Clients can spread their streams across them with DialHiddenBalanced
+	Shared bool
+}
+
+// Loads the key and the certificate of the hidden service
+func (c *HiddenServiceConfig) credentials() (priv crypto.PrivKey, cert *message.Certificate, err error) {
+	priv = c.PrivKey
+	if priv == nil {
+		if c.KeyFile == "" {
+			return nil, nil, errors.New("no private key nor key file provided")
+		}
+
+		priv, err = identity.LoadIdentity(c.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load hidden service key: %w", err)
+		}
+	}
+
+	cert = c.Certificate
+	if cert == nil && c.CertificateFile != "" {
+		cert, err = LoadCertificate(c.CertificateFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load hidden service certificate: %w", err)
+		}
+	}
+	return priv, cert, nil
+}
+
+func (c HiddenServiceConfig) defaults(s *Service) (cfg HiddenServiceConfig) {
+	if c.SingleOnion {
+		c.Hops = 1
+	}
+	if c.Hops == 0 {
+		c.Hops = s.Hops
+	}
+	if c.RebindInterval == 0 {
+		c.RebindInterval = DefaultRebindInterval
+	}
+	return c
+}
+
+// Binds a supervised hidden service.
+// If the relay hosting the service drops the session, a new circuit to a random relay
+// is built and the same key is bound again. The relay then advertises the service in the DHT.
+// The returned listener keeps serving between rebinds until closed
+func (s *Service) BindHidden(cfg HiddenServiceConfig) (h *HiddenServiceListener, err error) {
+	cfg = cfg.defaults(s)
+
+	priv, cert, err := cfg.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err = newHiddenServiceListener(priv, cert)
+	if err != nil {
+		return nil, err
+	}
+	h.NonAnonymous = cfg.SingleOnion
+
+	session, err := s.bindHidden(&cfg, h)
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to bind: %w", err)
+	}
+	h.setSession(session)
+
+	go s.superviseHidden(&cfg, h, session)
+	return h, nil
+}
+
+// Binds the credentials of the listener at the last peer of a new random circuit
+func (s *Service) bindHidden(cfg *HiddenServiceConfig, h *HiddenServiceListener) (session *yamux.Session, err error) {
+	var avoid []peer.ID
+	if cfg.Shared {
+		// Not found providers just means this is the first instance
+		providers, _ := s.lookupHidden(context.Background(), h.Address)
+		for _, provider := range providers {
+			avoid = append(avoid, provider.ID)
+		}
+	}
+
+	c, err := s.randomCircuit(context.Background(), cfg.Hops, avoid, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+
+	priv, cert, _ := h.credentials()
+	session, err = c.bind(priv, cert, h.NonAnonymous)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-session.CloseChan()
+		c.Close()
+	}()
+	return session, nil
+}
+
+// Serves the hidden service and rebinds every time the session is closed.
+// Returns once the listener is closed
+func (s *Service) superviseHidden(cfg *HiddenServiceConfig, h *HiddenServiceListener, session *yamux.Session) {
+	for {
+		started := time.Now()
+		h.serve(session)
+
+		// Short sessions back off like failed binds
+		if lasted := time.Since(started); lasted < cfg.RebindInterval {
+			select {
+			case <-h.closed:
+				return
+			case <-time.After(cfg.RebindInterval - lasted):
+			}
+		}
+
+		for {
+			select {
+			case <-h.closed:
+				return
+			default:
+			}
+
+			// Pick up rotated signing keys
+			priv, cert, err := cfg.credentials()
+			if err == nil {
+				err = h.setCredentials(priv, cert)
+			}
+			if err != nil {
+				log.Printf("failed to reload hidden service %s credentials: %v", h.Address, err)
+			}
+
+			session, err = s.bindHidden(cfg, h)
+			if err == nil {
+				break
+			}
+			log.Printf("failed to rebind hidden service %s: %v", h.Address, err)
+
+			select {
+			case <-h.closed:
+				return
+			case <-time.After(cfg.RebindInterval):
+			}
+		}
+
+		err := h.setSession(session)
+		if err != nil {
+			return
+		}
+	}
+}
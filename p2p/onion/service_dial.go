@@ -0,0 +1,148 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Connects to a hidden service by its address.
+// Providers of the address are looked up anonymously from the last peer of a random circuit.
+// Then a new circuit ending at one of the providers is built. If a provider fails the next one is tried.
+// Resulting sessions are cached. Following calls for the same address reuse them until closed.
+// When concurrent calls dial the same address the first session stored wins and the others are closed.
+// Registered names are also accepted, for example peer.ID("name.onionp2p"). Check ResolveName
+func (s *Service) DialHidden(ctx context.Context, address peer.ID) (hidden *HiddenServiceConnection, err error) {
+	address, err = s.resolveHidden(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	hidden, found := s.loadHiddenConnection(address)
+	if found {
+		return hidden, nil
+	}
+
+	providers, err := s.lookupHidden(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, provider := range providers {
+		err = ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		hidden, err = s.dialHiddenAt(ctx, address, provider.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", provider.ID, err))
+			continue
+		}
+		return s.storeHiddenConnection(address, hidden), nil
+	}
+	return nil, fmt.Errorf("failed to dial providers: %w", errors.Join(errs...))
+}
+
+// Finds the relays providing the hidden address. Results are shuffled
+func (s *Service) lookupHidden(ctx context.Context, address peer.ID) (providers []peer.AddrInfo, err error) {
+	providers, err = s.lookupProviders(ctx, CidFromData(address))
+	if err != nil {
+		return nil, err
+	}
+	if len(providers) == 0 {
+		return nil, errors.New("no providers found for hidden address")
+	}
+	return providers, nil
+}
+
+// Finds the providers of the cid anonymously from the last peer of a random circuit. Results are shuffled.
+// The circuit is closed if the context is done before the relay answers
+func (s *Service) lookupProviders(ctx context.Context, c cid.Cid) (providers []peer.AddrInfo, err error) {
+	lookup, err := s.randomCircuit(ctx, s.Hops, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare lookup circuit: %w", err)
+	}
+	defer lookup.Close()
+	stop := context.AfterFunc(ctx, func() { lookup.Close() })
+	defer stop()
+
+	providers, err = lookup.HiddenDHT(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find providers: %w", errors.Join(err, ctx.Err()))
+	}
+
+	rand.Shuffle(len(providers), func(i, j int) {
+		providers[i], providers[j] = providers[j], providers[i]
+	})
+	return providers, nil
+}
+
+// Dials the hidden service through a new circuit ending at the provider.
+// The circuit is closed if the context is done before the service answers
+func (s *Service) dialHiddenAt(ctx context.Context, address, provider peer.ID) (hidden *HiddenServiceConnection, err error) {
+	c, err := s.randomCircuit(ctx, s.Hops, nil, []peer.ID{provider})
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer func() {
+		if !stop() && err == nil {
+			hidden.Close()
+			hidden, err = nil, ctx.Err()
+		}
+	}()
+
+	hidden, err = c.Dial(address)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+
+	// Providers not hosting the service close the circuit right away
+	_, err = hidden.Session.Ping()
+	if err != nil {
+		hidden.Close()
+		c.Close()
+		return nil, fmt.Errorf("provider not hosting the service: %w", err)
+	}
+	return hidden, nil
+}
+
+func (s *Service) loadHiddenConnection(address peer.ID) (hidden *HiddenServiceConnection, found bool) {
+	s.hiddenMutex.Lock()
+	defer s.hiddenMutex.Unlock()
+
+	hidden, found = s.hiddenConnections[address]
+	if !found {
+		return nil, false
+	}
+	if hidden.Session.IsClosed() {
+		delete(s.hiddenConnections, address)
+		return nil, false
+	}
+	return hidden, true
+}
+
+// Caches the session unless another open one was stored in the meantime.
+// Then the passed session is closed and the stored one returned
+func (s *Service) storeHiddenConnection(address peer.ID, hidden *HiddenServiceConnection) (stored *HiddenServiceConnection) {
+	s.hiddenMutex.Lock()
+	defer s.hiddenMutex.Unlock()
+
+	if s.hiddenConnections == nil {
+		s.hiddenConnections = make(map[peer.ID]*HiddenServiceConnection)
+	}
+	stored, found := s.hiddenConnections[address]
+	if found && !stored.Session.IsClosed() {
+		hidden.Close()
+		return stored
+	}
+	s.hiddenConnections[address] = hidden
+	return hidden
+}
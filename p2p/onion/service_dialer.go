@@ -0,0 +1,216 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/RogueTeam/onion/p2p/onion/exitpolicy"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Connection through a circuit. Closing it closes the circuit
+type circuitConn struct {
+	net.Conn
+	circuit *Circuit
+}
+
+func (c *circuitConn) Close() (err error) {
+	err = c.Conn.Close()
+	c.circuit.Close()
+	return err
+}
+
+// Dials the address through the network. Signature compatible with net.Dialer.DialContext.
+// Hidden addresses, encoded or in their legacy form, and registered names are dialed with DialHidden using the port as virtual port.
+// Other hosts are dialed through a circuit ending at a random exit node. Hostnames are resolved by the exit.
+// UDP networks open an UDP association at the exit. Hidden services only support TCP
+func (s *Service) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	var udp bool
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		udp = true
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split address: %w", err)
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	hiddenAddress, err := s.resolveHost(ctx, host)
+	if err == nil {
+		if udp {
+			return nil, errors.New("hidden services don't support udp")
+		}
+		hidden, err := s.DialHidden(ctx, hiddenAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial hidden service: %w", err)
+		}
+		return hidden.Open(uint16(port))
+	}
+	if IsHiddenHost(host) {
+		return nil, err
+	}
+
+	maddr, err := externalMultiaddr(network, host, uint16(port))
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.ExitCircuit(ctx, maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if udp {
+		conn, err = c.UDPAssociate(maddr)
+	} else {
+		conn, err = c.External(maddr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &circuitConn{Conn: conn, circuit: c}, nil
+}
+
+// Multiaddr of the host. Hostnames use the DNS protocol of the network so the exit resolves them
+func externalMultiaddr(network, host string, port uint16) (maddr multiaddr.Multiaddr, err error) {
+	transport := "tcp"
+	if strings.HasPrefix(network, "udp") {
+		transport = "udp"
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil {
+		var addr net.Addr = &net.TCPAddr{IP: ip, Port: int(port)}
+		if transport == "udp" {
+			addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+		maddr, err = manet.FromNetAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert address: %w", err)
+		}
+		return maddr, nil
+	}
+
+	dns := "dns"
+	switch network {
+	case "tcp4", "udp4":
+		dns = "dns4"
+	case "tcp6", "udp6":
+		dns = "dns6"
+	}
+	maddr, err = multiaddr.NewMultiaddr(fmt.Sprintf("/%s/%s/%s/%d", dns, host, transport, port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host: %w", err)
+	}
+	return maddr, nil
+}
+
+// Resolves the host anonymously at a random exit node. Network is ip, ip4 or ip6
+func (s *Service) Resolve(ctx context.Context, network, host string) (ips []net.IP, err error) {
+	c, err := s.ExitCircuit(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return c.Resolve(network, host)
+}
+
+// Builds a random circuit ending at an exit node whose policy allows the destination. A nil destination accepts any exit.
+// Policies are learned from the settings of the exits. Exits known to reject the destination are skipped
+// and exits failing to extend the circuit are replaced by other ones
+func (s *Service) ExitCircuit(ctx context.Context, destination multiaddr.Multiaddr) (c *Circuit, err error) {
+	peers, err := s.ListPeers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peers: %w", err)
+	}
+
+	var exits []peer.ID
+	for _, p := range peers {
+		if p.Info.ID == s.ID || !p.Modes.Has(ExitNodeP2PCid) {
+			continue
+		}
+		policy, found := s.loadExitPolicy(p.Info.ID)
+		if found && destination != nil {
+			allowed, _ := policy.AllowsMultiaddr(destination)
+			if !allowed {
+				continue
+			}
+		}
+		exits = append(exits, p.Info.ID)
+	}
+	if len(exits) == 0 {
+		return nil, errors.New("no exit nodes allowing the destination found")
+	}
+	rand.Shuffle(len(exits), func(i, j int) {
+		exits[i], exits[j] = exits[j], exits[i]
+	})
+
+	var errs []error
+	for _, exit := range exits[:min(len(exits), DefaultCircuitAttempts)] {
+		err = ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		c, err = s.RandomCircuit(s.Hops, exit)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", exit, err))
+			continue
+		}
+
+		policy, err := exitpolicy.Parse(c.Settings[exit].ExitPolicy...)
+		if err != nil {
+			c.Close()
+			errs = append(errs, fmt.Errorf("%s: invalid exit policy: %w", exit, err))
+			continue
+		}
+		s.storeExitPolicy(exit, policy)
+		if destination == nil {
+			return c, nil
+		}
+
+		allowed, err := policy.AllowsMultiaddr(destination)
+		if err != nil || !allowed {
+			c.Close()
+			errs = append(errs, fmt.Errorf("%s: destination rejected by the exit policy", exit))
+			continue
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("failed to prepare exit circuit: %w", errors.Join(errs...))
+}
+
+func (s *Service) loadExitPolicy(exit peer.ID) (policy exitpolicy.Policy, found bool) {
+	s.exitMutex.Lock()
+	defer s.exitMutex.Unlock()
+
+	policy, found = s.exitPolicies[exit]
+	return policy, found
+}
+
+func (s *Service) storeExitPolicy(exit peer.ID, policy exitpolicy.Policy) {
+	s.exitMutex.Lock()
+	defer s.exitMutex.Unlock()
+
+	if s.exitPolicies == nil {
+		s.exitPolicies = make(map[peer.ID]exitpolicy.Policy)
+	}
+	s.exitPolicies[exit] = policy
+}
@@ -0,0 +1,97 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Maximum number of directory relays queried by SearchDirectory
+const DefaultDirectoryRelays = 8
+
+// Publishes the signed listing in the public directory through a random circuit. Check NewListing.
+// Listings expire. Services wanting to stay listed should publish again before the expiry
+func (s *Service) PublishListing(ctx context.Context, listing *message.Listing) (err error) {
+	c, err := s.recordsCircuit()
+	if err != nil {
+		return fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+	defer c.Close()
+
+	return c.Publish(listing)
+}
+
+// Looks up the listing of the hidden address anonymously
+func (s *Service) LookupListing(ctx context.Context, address peer.ID) (listing *message.Listing, err error) {
+	c, err := s.recordsCircuit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+	defer c.Close()
+
+	return c.Listing(address)
+}
+
+// Searches the public directory anonymously. An empty search browses every listing.
+// The relays holding listings are found and queried through circuits. Results are sorted by title
+func (s *Service) SearchDirectory(ctx context.Context, search string) (listings []message.Listing, err error) {
+	relays, err := s.lookupProviders(ctx, DirectoryP2PCid)
+	if err != nil {
+		return nil, err
+	}
+	if len(relays) > DefaultDirectoryRelays {
+		relays = relays[:DefaultDirectoryRelays]
+	}
+
+	var (
+		errs   []error
+		latest = make(map[peer.ID]message.Listing)
+	)
+	for _, relay := range relays {
+		err = ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := s.searchAt(relay.ID, search)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", relay.ID, err))
+			continue
+		}
+
+		for _, listing := range found {
+			current, ok := latest[listing.Address]
+			if !ok || listing.Published > current.Published {
+				latest[listing.Address] = listing
+			}
+		}
+	}
+
+	if len(errs) > 0 && len(errs) == len(relays) {
+		return nil, fmt.Errorf("failed to search directory: %w", errors.Join(errs...))
+	}
+
+	listings = make([]message.Listing, 0, len(latest))
+	for _, listing := range latest {
+		listings = append(listings, listing)
+	}
+	slices.SortFunc(listings, func(a, b message.Listing) int {
+		return strings.Compare(a.Title, b.Title)
+	})
+	return listings, nil
+}
+
+func (s *Service) searchAt(relay peer.ID, search string) (listings []message.Listing, err error) {
+	c, err := s.RandomCircuit(s.Hops, relay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+	defer c.Close()
+
+	return c.SearchDirectory(search)
+}
@@ -0,0 +1,137 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Deposits a message for an offline hidden service at a random mailbox relay.
+// The payload is sealed for the owner of the address, so relays only store ciphertext.
+// The relay is reached through a new circuit. If it rejects the message the next one is tried
+func (s *Service) DepositHidden(ctx context.Context, address peer.ID, payload []byte) (err error) {
+	sealed, err := SealMailboxPayload(address, payload)
+	if err != nil {
+		return err
+	}
+
+	peers, err := s.ListPeers()
+	if err != nil {
+		return fmt.Errorf("failed to list peers: %w", err)
+	}
+
+	var relays []peer.ID
+	for _, p := range peers {
+		if p.Info.ID != s.ID && p.Modes.Has(MailboxNodeP2PCid) {
+			relays = append(relays, p.Info.ID)
+		}
+	}
+	if len(relays) == 0 {
+		return errors.New("no mailbox relays found")
+	}
+	rand.Shuffle(len(relays), func(i, j int) {
+		relays[i], relays[j] = relays[j], relays[i]
+	})
+
+	var errs []error
+	for _, relay := range relays {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		err = s.depositAt(relay, address, sealed)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", relay, err))
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to deposit: %w", errors.Join(errs...))
+}
+
+func (s *Service) depositAt(relay, address peer.ID, payload []byte) (err error) {
+	c, err := s.RandomCircuit(s.Hops, relay)
+	if err != nil {
+		return fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+	defer c.Close()
+
+	return c.Deposit(address, payload)
+}
+
+// Fetches and deletes the messages stored for the hidden address of the key from every mailbox relay holding them.
+// Payloads are opened with the master key. Those that can't be opened are dropped.
+// When a certificate is passed the key should be the certified signing key. Payloads are returned sealed then,
+// to be opened with OpenMailboxPayload where the master key is kept.
+// Messages are only deleted from the relays after being received
+func (s *Service) CollectMailbox(ctx context.Context, priv crypto.PrivKey, cert *message.Certificate) (messages []message.MailboxMessage, err error) {
+	address, err := hiddenAddressFromCredentials(priv, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	relays, err := s.lookupProviders(ctx, MailboxCid(address))
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, relay := range relays {
+		err = ctx.Err()
+		if err != nil {
+			return messages, err
+		}
+
+		collected, err := s.collectAt(relay.ID, priv, cert)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", relay.ID, err))
+			continue
+		}
+		if cert != nil {
+			messages = append(messages, collected...)
+			continue
+		}
+		for _, msg := range collected {
+			msg.Payload, err = OpenMailboxPayload(priv, msg.Payload)
+			if err != nil {
+				continue
+			}
+			messages = append(messages, msg)
+		}
+	}
+
+	if len(errs) > 0 && len(errs) == len(relays) {
+		return nil, fmt.Errorf("failed to collect mailbox: %w", errors.Join(errs...))
+	}
+	return messages, nil
+}
+
+func (s *Service) collectAt(relay peer.ID, priv crypto.PrivKey, cert *message.Certificate) (messages []message.MailboxMessage, err error) {
+	c, err := s.RandomCircuit(s.Hops, relay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+	defer c.Close()
+
+	messages, err = c.FetchMailbox(priv, cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch: %w", err)
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.Id)
+	}
+
+	err = c.DeleteMailbox(priv, cert, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete: %w", err)
+	}
+	return messages, nil
+}
@@ -0,0 +1,129 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Registers the name for the hidden address of the key through a random circuit.
+// Names already owned by the address are renewed keeping their registration time.
+// Names owned by other addresses fail with ErrNameTaken. A zero TTL means DefaultNameTTL
+func (s *Service) RegisterName(ctx context.Context, priv crypto.PrivKey, cert *message.Certificate, name string, ttl time.Duration) (rec *message.NameRecord, err error) {
+	address, err := hiddenAddressFromCredentials(priv, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	var registered time.Time
+	current, err := s.lookupName(name)
+	if err == nil {
+		if current.Address != address {
+			return nil, ErrNameTaken
+		}
+		registered = time.Unix(current.Registered, 0)
+	}
+
+	rec, err = NewNameRecord(ctx, priv, cert, name, registered, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.recordsCircuit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+	defer c.Close()
+
+	err = c.RegisterName(rec)
+	if err != nil {
+		return nil, err
+	}
+	s.storeName(rec)
+	return rec, nil
+}
+
+// Resolves the name to its hidden address anonymously. The AddressSuffix is optional.
+// Results are cached until the record expires or the TTL of the service passes
+func (s *Service) ResolveName(ctx context.Context, name string) (address peer.ID, err error) {
+	rec, found := s.loadName(normalizeName(name))
+	if found {
+		return rec.Address, nil
+	}
+
+	rec, err = s.lookupName(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve name: %w", err)
+	}
+	s.storeName(rec)
+	return rec.Address, nil
+}
+
+// Resolves hosts of the network. Encoded and legacy hidden addresses are parsed.
+// Hosts with the AddressSuffix not being addresses are resolved as names
+func (s *Service) resolveHost(ctx context.Context, host string) (address peer.ID, err error) {
+	address, err = ParseAddress(host)
+	if err == nil || !IsHiddenHost(host) {
+		return address, err
+	}
+	return s.ResolveName(ctx, host)
+}
+
+// Resolves the names passed as addresses to DialHidden
+func (s *Service) resolveHidden(ctx context.Context, address peer.ID) (resolved peer.ID, err error) {
+	_, err = address.ExtractPublicKey()
+	if err == nil || ValidateName(normalizeName(string(address))) != nil {
+		return address, nil
+	}
+	return s.ResolveName(ctx, string(address))
+}
+
+func (s *Service) lookupName(name string) (rec *message.NameRecord, err error) {
+	c, err := s.recordsCircuit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare circuit: %w", err)
+	}
+	defer c.Close()
+
+	return c.NameRecord(name)
+}
+
+// Resolved name kept until Until
+type cachedName struct {
+	Record *message.NameRecord
+	Until  time.Time
+}
+
+func (s *Service) loadName(name string) (rec *message.NameRecord, found bool) {
+	s.namesMutex.Lock()
+	defer s.namesMutex.Unlock()
+
+	cached, found := s.names[name]
+	if !found {
+		return nil, false
+	}
+	if time.Now().After(cached.Until) {
+		delete(s.names, name)
+		return nil, false
+	}
+	return cached.Record, true
+}
+
+func (s *Service) storeName(rec *message.NameRecord) {
+	s.namesMutex.Lock()
+	defer s.namesMutex.Unlock()
+
+	until := time.Now().Add(s.TTL)
+	if expiry := time.Unix(rec.Expiry, 0); expiry.Before(until) {
+		until = expiry
+	}
+
+	if s.names == nil {
+		s.names = make(map[string]cachedName)
+	}
+	s.names[rec.Name] = cachedName{Record: rec, Until: until}
+}
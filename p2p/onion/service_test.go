@@ -1,26 +1,44 @@
 package onion_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/RogueTeam/onion/p2p/identity"
 	"github.com/RogueTeam/onion/p2p/onion"
+	"github.com/RogueTeam/onion/p2p/onion/exitpolicy"
+	"github.com/RogueTeam/onion/p2p/onion/message"
+	"github.com/RogueTeam/onion/pow/hashcash"
+	"github.com/hashicorp/yamux"
 	"github.com/ipfs/go-datastore"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/miekg/dns"
 	"github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 func Test_Integration(t *testing.T) {
 	t.Run("Succeed", func(t *testing.T) {
 		const (
 			ServicePeers = 10
+			// Bytes per second of each circuit relayed by the throttled relay
+			RelayRate = 512 * 1024
 		)
 
 		assertions := assert.New(t)
@@ -69,9 +87,11 @@ func Test_Integration(t *testing.T) {
 			peerDht, err := dht.New(
 				context.TODO(),
 				host,
-				dht.Mode(dht.ModeServer),
-				dht.BootstrapPeers(currentAddrs...),
-				dht.Datastore(datastore.NewMapDatastore()),
+				append(
+					onion.DHTOptions(datastore.NewMapDatastore()),
+					dht.Mode(dht.ModeServer),
+					dht.BootstrapPeers(currentAddrs...),
+				)...,
 			)
 			assertions.Nil(err, "failed to prepare DHT")
 			dhts = append(dhts, peerDht)
@@ -81,6 +101,12 @@ func Test_Integration(t *testing.T) {
 				DHT:       peerDht,
 				Bootstrap: index != 0,
 				ExitNode:  true,
+				ExitPolicy: exitpolicy.MustParse(
+					"reject 127.0.0.2:*",
+					"accept *:*",
+				),
+				Mailbox: &onion.MailboxConfig{},
+				Records: true,
 			})
 			assertions.Nil(err, "failed to prepare peer service")
 			svcs = append(svcs, svc)
@@ -141,6 +167,530 @@ func Test_Integration(t *testing.T) {
 					assertions.Equal(payload, received, "payload")
 				},
 			},
+			{
+				Name: "Exit policy",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					c, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer c.Close()
+
+					assertions.Equal([]string{"reject *:25", "reject 127.0.0.2:*", "accept *:*"}, c.Settings[c.Current].ExitPolicy, "expecting advertised policy")
+
+					l, err := net.Listen("tcp", "127.0.0.2:0")
+					if !assertions.Nil(err, "failed to listen") {
+						return
+					}
+					defer l.Close()
+
+					var accepted atomic.Bool
+					go func() {
+						conn, err := l.Accept()
+						if err != nil {
+							return
+						}
+						accepted.Store(true)
+						conn.Close()
+					}()
+
+					maddr, err := manet.FromNetAddr(l.Addr())
+					if !assertions.Nil(err, "failed to convert address") {
+						return
+					}
+
+					conn, err := c.External(maddr)
+					if !assertions.Nil(err, "failed to send external") {
+						return
+					}
+					_, err = conn.Read(make([]byte, 1))
+					assertions.NotNil(err, "expecting circuit closed by the exit")
+					assertions.False(accepted.Load(), "expecting no connection")
+
+					_, err = svc.DialContext(context.TODO(), "tcp", l.Addr().String())
+					assertions.NotNil(err, "expecting no exit allowing the destination")
+					assertions.False(accepted.Load(), "expecting no connection")
+				},
+			},
+			{
+				Name: "Exit limits",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					for _, exit := range svcs {
+						assertions.False(exit.ExitPolicy.Allows(net.ParseIP("1.1.1.1"), 25, "tcp"), "expecting smtp blocked by every exit")
+					}
+
+					limits := onion.NewExitLimits(onion.ExitLimitsConfig{
+						MaxPeerConnections: 2,
+						MaxNewDestinations: 2,
+						DestinationWindow:  time.Second,
+					})
+					remote := targets[0]
+
+					first, err := limits.Acquire(remote, "/ip4/1.1.1.1/tcp/443")
+					if !assertions.Nil(err, "failed to acquire first") {
+						return
+					}
+					second, err := limits.Acquire(remote, "/ip4/1.1.1.1/tcp/443")
+					if !assertions.Nil(err, "failed to acquire second") {
+						return
+					}
+					_, err = limits.Acquire(remote, "/ip4/1.1.1.1/tcp/443")
+					assertions.ErrorIs(err, onion.ErrTooManyConnections, "expecting peer connections exhausted")
+
+					_, err = limits.Acquire(targets[1], "/ip4/1.1.1.1/tcp/443")
+					assertions.Nil(err, "expecting other peers unaffected")
+
+					first()
+					first()
+					second()
+					third, err := limits.Acquire(remote, "/ip4/1.1.1.2/tcp/443")
+					if !assertions.Nil(err, "failed to acquire new destination") {
+						return
+					}
+					third()
+					_, err = limits.Acquire(remote, "/ip4/1.1.1.3/tcp/443")
+					assertions.ErrorIs(err, onion.ErrTooManyDestinations, "expecting new destinations limited")
+
+					time.Sleep(1500 * time.Millisecond)
+					fourth, err := limits.Acquire(remote, "/ip4/1.1.1.3/tcp/443")
+					assertions.Nil(err, "expecting destinations window rolled")
+					if fourth != nil {
+						fourth()
+					}
+
+					// Lookups share the window of the destinations
+					assertions.Nil(limits.Resolve(remote, "example.com"), "failed to resolve first host")
+					assertions.Nil(limits.Resolve(remote, "example.com"), "expecting known hosts resolved again")
+					assertions.ErrorIs(limits.Resolve(remote, "example.org"), onion.ErrTooManyDestinations, "expecting new hosts limited")
+				},
+			},
+			{
+				Name: "Resolver record TTL",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+					if !assertions.Nil(err, "failed to listen dns") {
+						return
+					}
+					server := &dns.Server{
+						PacketConn: packetConn,
+						Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+							res := new(dns.Msg).SetReply(req)
+							question := req.Question[0]
+							if question.Qtype == dns.TypeA {
+								ttl := map[string]uint32{"short.example.": 5, "long.example.": 3600}[question.Name]
+								res.Answer = append(res.Answer, &dns.A{
+									Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+									A:   net.IPv4(192, 0, 2, 1),
+								})
+							}
+							w.WriteMsg(res)
+						}),
+					}
+					go server.ActivateAndServe()
+					defer server.Shutdown()
+
+					resolver := onion.NewResolver(onion.DefaultResolveTTL)
+					resolver.Servers = []string{packetConn.LocalAddr().String()}
+
+					ips, ttl, err := resolver.Lookup(context.TODO(), "ip4", "short.example")
+					if !assertions.Nil(err, "failed to lookup") {
+						return
+					}
+					assertions.True(ips[0].Equal(net.IPv4(192, 0, 2, 1)), "expecting answered address")
+					assertions.Equal(5*time.Second, ttl, "expecting record ttl")
+
+					_, ttl, err = resolver.Lookup(context.TODO(), "ip4", "short.example")
+					assertions.Nil(err, "failed to lookup cached")
+					assertions.LessOrEqual(ttl, 5*time.Second, "expecting cached for the record ttl")
+
+					_, ttl, err = resolver.Lookup(context.TODO(), "ip4", "long.example")
+					assertions.Nil(err, "failed to lookup")
+					assertions.Equal(onion.DefaultResolveTTL, ttl, "expecting ttl clamped")
+				},
+			},
+			{
+				Name: "Exit DNS",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					ips, err := svc.Resolve(context.TODO(), "ip4", "localhost")
+					if !assertions.Nil(err, "failed to resolve") {
+						return
+					}
+					assertions.True(slices.ContainsFunc(ips, func(ip net.IP) bool { return ip.Equal(net.IPv4(127, 0, 0, 1)) }), "expecting loopback")
+
+					l, err := net.Listen("tcp", "127.0.0.1:0")
+					if !assertions.Nil(err, "failed to listen") {
+						return
+					}
+					defer l.Close()
+
+					var payload = []byte("HELLO")
+					go func() {
+						for {
+							conn, err := l.Accept()
+							if err != nil {
+								return
+							}
+							conn.Write(payload)
+							conn.Close()
+						}
+					}()
+					_, port, _ := net.SplitHostPort(l.Addr().String())
+
+					c, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer c.Close()
+
+					conn, err := c.External(multiaddr.StringCast("/dns4/localhost/tcp/" + port))
+					if !assertions.Nil(err, "failed to dial to external") {
+						return
+					}
+					var recv = make([]byte, len(payload))
+					_, err = io.ReadFull(conn, recv)
+					assertions.Nil(err, "failed to read payload")
+					assertions.Equal(payload, recv, "expecting a different payload")
+
+					conn, err = svc.DialContext(context.TODO(), "tcp4", net.JoinHostPort("localhost", port))
+					if !assertions.Nil(err, "failed to dial hostname") {
+						return
+					}
+					defer conn.Close()
+
+					_, err = io.ReadFull(conn, recv)
+					assertions.Nil(err, "failed to read payload")
+					assertions.Equal(payload, recv, "expecting a different payload")
+				},
+			},
+			{
+				Name: "ExitResolver",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					resolver := onion.ExitResolver{Service: svc}
+					defer resolver.Close()
+
+					for range 2 {
+						ips, ttl, err := resolver.Lookup(context.TODO(), "ip4", "localhost")
+						if !assertions.Nil(err, "failed to lookup") {
+							return
+						}
+						assertions.True(slices.ContainsFunc(ips, func(ip net.IP) bool { return ip.Equal(net.IPv4(127, 0, 0, 1)) }), "expecting loopback")
+						assertions.Greater(ttl, time.Duration(0), "expecting ttl")
+					}
+
+					// Concurrent lookups over circuits replaced on every use
+					rotated := onion.ExitResolver{Service: svc, Circuits: 2, Rotation: time.Nanosecond}
+					var wg sync.WaitGroup
+					for range 4 {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							ips, _, err := rotated.Lookup(context.TODO(), "ip4", "localhost")
+							if assertions.Nil(err, "failed to lookup concurrently") {
+								assertions.NotEmpty(ips, "expecting addresses")
+							}
+						}()
+					}
+					wg.Wait()
+
+					assertions.Nil(rotated.Close(), "failed to close resolver")
+					_, _, err := rotated.Lookup(context.TODO(), "ip4", "localhost")
+					assertions.ErrorIs(err, net.ErrClosed, "expecting lookups refused once closed")
+				},
+			},
+			{
+				Name: "Relay bandwidth",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					l, err := net.Listen("tcp", "127.0.0.1:0")
+					if !assertions.Nil(err, "failed to listen") {
+						return
+					}
+					defer l.Close()
+
+					var payload = make([]byte, 2*RelayRate)
+					go func() {
+						conn, err := l.Accept()
+						if err != nil {
+							return
+						}
+						defer conn.Close()
+						conn.Write(payload)
+					}()
+
+					_, port, _ := net.SplitHostPort(l.Addr().String())
+
+					// Throttled relay of its own. The shared relays are left unlimited
+					relayHost, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/0.0.0.0/udp/0/quic-v1"))
+					if !assertions.Nil(err, "failed to prepare host") {
+						return
+					}
+					defer relayHost.Close()
+
+					relayDht, err := dht.New(
+						context.TODO(),
+						relayHost,
+						append(
+							onion.DHTOptions(datastore.NewMapDatastore()),
+							dht.Mode(dht.ModeClient),
+						)...,
+					)
+					if !assertions.Nil(err, "failed to prepare dht") {
+						return
+					}
+					defer relayDht.Close()
+
+					relay, err := onion.New(onion.Config{
+						Host:       relayHost,
+						DHT:        relayDht,
+						HiddenMode: true,
+						Bandwidth:  &onion.BandwidthConfig{CircuitRate: RelayRate},
+					})
+					if !assertions.Nil(err, "failed to prepare relay") {
+						return
+					}
+					defer relay.Close()
+
+					err = svc.Host.Connect(context.TODO(), relayHost.Peerstore().PeerInfo(relayHost.ID()))
+					if !assertions.Nil(err, "failed to connect to relay") {
+						return
+					}
+					err = relayHost.Connect(context.TODO(), svcs[0].Host.Peerstore().PeerInfo(svcs[0].ID))
+					if !assertions.Nil(err, "failed to connect relay to exit") {
+						return
+					}
+
+					c, err := svc.Circuit([]peer.ID{relayHost.ID(), svcs[0].ID})
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer c.Close()
+
+					sentBefore := relay.Traffic.Sent.Load()
+
+					start := time.Now()
+					conn, err := c.External(multiaddr.StringCast("/ip4/127.0.0.1/tcp/" + port))
+					if !assertions.Nil(err, "failed to dial to external") {
+						return
+					}
+					_, err = io.ReadFull(conn, make([]byte, len(payload)))
+					assertions.Nil(err, "failed to read payload")
+					// The first burst is free. The rest is throttled
+					assertions.GreaterOrEqual(time.Since(start), 800*time.Millisecond, "expecting throttled circuit")
+
+					assertions.GreaterOrEqual(relay.Traffic.Sent.Load()-sentBefore, uint64(len(payload)), "expecting relayed bytes counted")
+					assertions.True(slices.ContainsFunc(relay.Relays(), func(stats onion.TrafficStats) bool {
+						return stats.Sent >= uint64(len(payload))
+					}), "expecting traffic of the circuit")
+				},
+			},
+			{
+				Name: "Hibernating relay",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Usage persists across restarts
+					location := filepath.Join(t.TempDir(), "accounting.json")
+					accountingCfg := onion.AccountingConfig{Quota: 1000, Period: time.Hour, Path: location}
+					accounting, err := onion.NewAccounting(accountingCfg)
+					if !assertions.Nil(err, "failed to prepare accounting") {
+						return
+					}
+					accounting.Add(960)
+					assertions.True(accounting.Hibernating(), "expecting quota nearly exhausted")
+					assertions.Nil(accounting.Close(), "failed to save accounting on close")
+
+					accounting, err = onion.NewAccounting(accountingCfg)
+					if !assertions.Nil(err, "failed to load accounting") {
+						return
+					}
+					used, _, _ := accounting.Usage()
+					assertions.Equal(uint64(960), used, "expecting persisted usage")
+
+					// Relay hibernating until its next period
+					ident, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to prepare key") {
+						return
+					}
+					relayHost, err := libp2p.New(
+						libp2p.ListenAddrStrings("/ip4/0.0.0.0/udp/0/quic-v1"),
+						libp2p.Identity(ident),
+					)
+					if !assertions.Nil(err, "failed to prepare host") {
+						return
+					}
+					defer relayHost.Close()
+
+					relayDht, err := dht.New(
+						context.TODO(),
+						relayHost,
+						append(
+							onion.DHTOptions(datastore.NewMapDatastore()),
+							dht.Mode(dht.ModeClient),
+						)...,
+					)
+					if !assertions.Nil(err, "failed to prepare dht") {
+						return
+					}
+					defer relayDht.Close()
+
+					relay, err := onion.New(onion.Config{
+						Host:       relayHost,
+						DHT:        relayDht,
+						HiddenMode: true,
+						Accounting: &onion.AccountingConfig{Quota: 1024 * 1024, Period: 3 * time.Second},
+					})
+					if !assertions.Nil(err, "failed to prepare relay") {
+						return
+					}
+					defer relay.Close()
+					// Starts hibernating early in the period. Leaving time for the refused circuit
+					_, _, end := relay.Accounting.Usage()
+					if time.Until(end) < time.Second {
+						time.Sleep(time.Until(end))
+						_, _, end = relay.Accounting.Usage()
+					}
+					relay.Accounting.Add(relay.Accounting.Config.Quota)
+
+					err = svc.Host.Connect(context.TODO(), relayHost.Peerstore().PeerInfo(relayHost.ID()))
+					if !assertions.Nil(err, "failed to connect to relay") {
+						return
+					}
+
+					_, err = svc.Circuit([]peer.ID{relayHost.ID()})
+					assertions.NotNil(err, "expecting circuits refused while hibernating")
+
+					time.Sleep(time.Until(end))
+					assertions.False(relay.Accounting.Hibernating(), "expecting new period")
+
+					// Open circuits stop relaying once the whole quota is used
+					err = relayHost.Connect(context.TODO(), svcs[0].Host.Peerstore().PeerInfo(svcs[0].ID))
+					if !assertions.Nil(err, "failed to connect relay to exit") {
+						return
+					}
+					c, err := svc.Circuit([]peer.ID{relayHost.ID(), svcs[0].ID})
+					if !assertions.Nil(err, "failed to prepare circuit after hibernation") {
+						return
+					}
+					defer c.Close()
+
+					l, err := net.Listen("tcp", "127.0.0.1:0")
+					if !assertions.Nil(err, "failed to listen") {
+						return
+					}
+					defer l.Close()
+					go func() {
+						conn, err := l.Accept()
+						if err != nil {
+							return
+						}
+						defer conn.Close()
+						io.Copy(conn, conn)
+					}()
+
+					maddr, err := manet.FromNetAddr(l.Addr())
+					if !assertions.Nil(err, "failed to convert address") {
+						return
+					}
+					conn, err := c.External(maddr)
+					if !assertions.Nil(err, "failed to dial external") {
+						return
+					}
+					defer conn.Close()
+
+					var payload = []byte("HELLO")
+					_, err = conn.Write(payload)
+					assertions.Nil(err, "failed to write payload")
+					recv := make([]byte, len(payload))
+					_, err = io.ReadFull(conn, recv)
+					assertions.Nil(err, "failed to read echo")
+
+					relay.Accounting.Add(relay.Accounting.Config.Quota)
+					conn.Write(payload)
+					_, err = io.ReadFull(conn, recv)
+					assertions.NotNil(err, "expecting relaying stopped with the quota exhausted")
+				},
+			},
+			{
+				Name: "Exit UDP",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+					if !assertions.Nil(err, "failed to listen") {
+						return
+					}
+					defer echo.Close()
+
+					go func() {
+						buffer := make([]byte, onion.MaxDatagramSize)
+						for {
+							n, source, err := echo.ReadFromUDP(buffer)
+							if err != nil {
+								return
+							}
+							echo.WriteToUDP(buffer[:n], source)
+						}
+					}()
+
+					conn, err := svc.DialContext(context.TODO(), "udp", echo.LocalAddr().String())
+					if !assertions.Nil(err, "failed to associate") {
+						return
+					}
+					defer conn.Close()
+
+					for _, payload := range [][]byte{[]byte("HELLO"), []byte("WORLD")} {
+						_, err = conn.Write(payload)
+						assertions.Nil(err, "failed to write datagram")
+
+						var recv = make([]byte, onion.MaxDatagramSize)
+						n, err := conn.Read(recv)
+						assertions.Nil(err, "failed to read datagram")
+						assertions.Equal(payload, recv[:n], "expecting a different datagram")
+					}
+				},
+			},
+			{
+				Name: "RandomCircuit",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					c, err := svc.RandomCircuit(svc.Hops, targets[0])
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer c.Close()
+					assertions.Len(c.Settings, svc.Hops, "expecting full length")
+					assertions.Equal(targets[0], c.Current, "expecting final peer last")
+
+					_, err = svc.RandomCircuit(0)
+					assertions.ErrorIs(err, onion.ErrEmptyCircuit, "expecting empty circuit refused")
+
+					_, err = svc.RandomCircuit(ServicePeers + 1)
+					assertions.ErrorIs(err, onion.ErrNotEnoughPeers, "expecting no shorter circuit")
+
+					offline, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+					offlineId, err := peer.IDFromPrivateKey(offline)
+					if !assertions.Nil(err, "failed to get peer id") {
+						return
+					}
+					_, err = svc.RandomCircuit(svc.Hops, offlineId)
+					assertions.NotNil(err, "expecting unreachable final peer to fail")
+				},
+			},
 			{
 				Name: "Basic HiddenService",
 				Action: func(t *testing.T, svc *onion.Service) {
@@ -197,7 +747,7 @@ func Test_Integration(t *testing.T) {
 					}()
 
 					var recv = make([]byte, len(payload))
-					conn, err := clientSession.Open()
+					conn, err := clientSession.Open(0)
 					if !assertions.Nil(err, "failed to open client session") {
 						return
 					}
@@ -214,7 +764,7 @@ func Test_Integration(t *testing.T) {
 				},
 			},
 			{
-				Name: "Discover HiddenService",
+				Name: "Introduction effort HiddenService",
 				Action: func(t *testing.T, svc *onion.Service) {
 					assertions := assert.New(t)
 
@@ -237,7 +787,6 @@ func Test_Integration(t *testing.T) {
 					defer svcSession.Close()
 
 					// Prepare client
-					t.Log("Preparing client")
 					clientCircuit, err := svc.Circuit(targets)
 					if !assertions.Nil(err, "failed to prepare circuit") {
 						return
@@ -245,11 +794,1395 @@ func Test_Integration(t *testing.T) {
 					defer clientCircuit.Close()
 
 					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
-					if !assertions.Nil(err, "failed to get address") {
+					if !assertions.Nil(err, "failed to get address from priv key") {
 						return
 					}
 
-					// time.Sleep(5 * time.Second)
+					clientSession, err := clientCircuit.Dial(address)
+					if !assertions.Nil(err, "failed to open client session") {
+						return
+					}
+					defer clientSession.Close()
+
+					// Pays the introduction with the extra bits over the effort suggested by the relay
+					introduce := func(extra uint64) (insecure net.Conn, err error) {
+						insecure, err = clientSession.Session.Open()
+						if err != nil {
+							return nil, err
+						}
+
+						var msg message.Message
+						err = msg.Recv(insecure, onion.DefaultSettings)
+						if err != nil {
+							insecure.Close()
+							return nil, err
+						}
+						if msg.Data.Descriptor == nil {
+							insecure.Close()
+							return nil, errors.New("no descriptor received")
+						}
+
+						var introduction = message.Message{
+							Data: message.Data{
+								Introduction: &message.Introduction{
+									Address: address,
+									Nonce:   msg.Data.Descriptor.Nonce,
+								},
+							},
+						}
+						err = introduction.Send(insecure, &message.Settings{PoWDifficulty: msg.Data.Descriptor.Effort + extra})
+						if err != nil {
+							insecure.Close()
+							return nil, err
+						}
+						return insecure, nil
+					}
+
+					// Introductions still handshaking keep the workers busy until DefaultIntroductionTimeout and the rest waiting
+					var stalled []net.Conn
+					defer func() {
+						for _, conn := range stalled {
+							conn.Close()
+						}
+					}()
+					const Waiting = 6
+					initial := svcSession.Effort()
+					for range onion.DefaultIntroductionWorkers + Waiting {
+						conn, err := introduce(0)
+						if !assertions.Nil(err, "failed to introduce") {
+							return
+						}
+						stalled = append(stalled, conn)
+					}
+					assertions.Eventually(func() bool {
+						return svcSession.Effort() == hashcash.LogDifficulty(hashcash.DefaultHashAlgorithm(), Waiting)
+					}, time.Minute, 100*time.Millisecond, "expecting effort to grow with the waiting introductions")
+					assertions.Greater(svcSession.Effort(), initial, "expecting effort to grow with the waiting introductions")
+
+					// Higher effort introductions are handshaked first
+					low, err := introduce(0)
+					if !assertions.Nil(err, "failed to introduce") {
+						return
+					}
+					defer low.Close()
+					high, err := introduce(4)
+					if !assertions.Nil(err, "failed to introduce") {
+						return
+					}
+					defer high.Close()
+					assertions.Eventually(func() bool {
+						return svcSession.Effort() == hashcash.LogDifficulty(hashcash.DefaultHashAlgorithm(), Waiting+2)
+					}, time.Minute, 100*time.Millisecond, "expecting both introductions waiting")
+
+					upgrade := func(insecure net.Conn, port uint16) {
+						ctx, cancel := context.WithTimeout(context.TODO(), time.Minute)
+						defer cancel()
+
+						secure, err := clientSession.Noise.SecureOutbound(ctx, insecure, address)
+						if err != nil {
+							return
+						}
+						var virtualPort = message.Message{
+							Data: message.Data{
+								VirtualPort: &message.VirtualPort{Port: port},
+							},
+						}
+						virtualPort.Send(secure, onion.DefaultSettings)
+					}
+					const LowPort, HighPort = 1, 2
+					go upgrade(low, LowPort)
+					go upgrade(high, HighPort)
+
+					// Release the workers one at a time
+					accepted := make(chan net.Conn, 1)
+					go func() {
+						conn, err := svcSession.Accept()
+						if err != nil {
+							close(accepted)
+							return
+						}
+						accepted <- conn
+					}()
+					var conn net.Conn
+				release:
+					for _, stall := range stalled {
+						stall.Close()
+						select {
+						case conn = <-accepted:
+							break release
+						case <-time.After(time.Second):
+						}
+					}
+					if assertions.NotNil(conn, "expecting an introduction handshaked") {
+						defer conn.Close()
+						assertions.Equal(uint16(HighPort), conn.LocalAddr().(*onion.Addr).Port, "expecting the higher effort introduction first")
+					}
+
+					// Introductions paying less than the suggested effort are refused by the relay
+					var (
+						insecure   net.Conn
+						descriptor *message.Descriptor
+					)
+					suggested := assertions.Eventually(func() bool {
+						if insecure != nil {
+							insecure.Close()
+						}
+						insecure, err = clientSession.Session.Open()
+						if err != nil {
+							return false
+						}
+						var msg message.Message
+						err = msg.Recv(insecure, onion.DefaultSettings)
+						if err != nil || msg.Data.Descriptor == nil {
+							return false
+						}
+						descriptor = msg.Data.Descriptor
+						return descriptor.Effort > 0
+					}, time.Minute, 100*time.Millisecond, "expecting relay to suggest an effort")
+					if insecure != nil {
+						defer insecure.Close()
+					}
+					if !suggested {
+						return
+					}
+
+					var underpaid = message.Message{
+						Data: message.Data{
+							Introduction: &message.Introduction{
+								Address: address,
+								Nonce:   descriptor.Nonce,
+							},
+						},
+					}
+					err = underpaid.Send(insecure, &message.Settings{PoWDifficulty: descriptor.Effort - 1})
+					assertions.Nil(err, "failed to send underpaid introduction")
+					_, err = insecure.Read(make([]byte, 1))
+					assertions.NotNil(err, "expecting underpaid introduction refused")
+				},
+			},
+			{
+				Name: "Virtual ports HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Prepare listener
+					serverCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer serverCircuit.Close()
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					svcSession, err := serverCircuit.Bind(hiddenPriv)
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+
+					httpListener, err := svcSession.Listen(80)
+					if !assertions.Nil(err, "failed to listen port") {
+						return
+					}
+					defer httpListener.Close()
+
+					_, err = svcSession.Listen(80)
+					assertions.NotNil(err, "port should be already routed")
+
+					err = svcSession.Handle(22, func(conn net.Conn) {
+						defer conn.Close()
+						conn.Write([]byte("SSH"))
+					})
+					if !assertions.Nil(err, "failed to handle port") {
+						return
+					}
+
+					go func() {
+						conn, err := httpListener.Accept()
+						if !assertions.Nil(err, "failed to accept connection") {
+							return
+						}
+						defer conn.Close()
+						conn.Write([]byte("HTTP"))
+					}()
+
+					// Prepare client
+					clientCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer clientCircuit.Close()
+
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+
+					clientSession, err := clientCircuit.Dial(address)
+					if !assertions.Nil(err, "failed to open client session") {
+						return
+					}
+					defer clientSession.Close()
+
+					for port, expected := range map[uint16]string{80: "HTTP", 22: "SSH"} {
+						conn, err := clientSession.Open(port)
+						if !assertions.Nil(err, "failed to open connection") {
+							return
+						}
+						defer conn.Close()
+
+						var recv = make([]byte, len(expected))
+						_, err = io.ReadFull(conn, recv)
+						if !assertions.Nil(err, "failed to read payload") {
+							return
+						}
+						assertions.Equal(expected, string(recv), "expecting a different service")
+					}
+
+					// Connections never accepted don't hold the introduction workers
+					for range onion.DefaultIntroductionWorkers + onion.DefaultHiddenPortBacklog + 1 {
+						conn, err := clientSession.Open(8080)
+						if !assertions.Nil(err, "failed to open unaccepted connection") {
+							return
+						}
+						defer conn.Close()
+					}
+					conn, err := clientSession.Open(22)
+					if !assertions.Nil(err, "failed to open connection") {
+						return
+					}
+					defer conn.Close()
+					var recv = make([]byte, 3)
+					_, err = io.ReadFull(conn, recv)
+					assertions.Nil(err, "failed to read payload")
+					assertions.Equal("SSH", string(recv), "expecting handled port served")
+				},
+			},
+			{
+				Name: "HTTP HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Prepare listener
+					serverCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer serverCircuit.Close()
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					svcSession, err := serverCircuit.Bind(hiddenPriv)
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+					assertions.Equal(onion.FormatAddress(address), svcSession.Addr().String(), "expecting hidden address")
+
+					httpListener, err := svcSession.Listen(80)
+					if !assertions.Nil(err, "failed to listen port") {
+						return
+					}
+					defer httpListener.Close()
+
+					go http.Serve(httpListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Write([]byte(r.RemoteAddr))
+					}))
+
+					// Prepare client
+					clientCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer clientCircuit.Close()
+
+					clientSession, err := clientCircuit.Dial(address)
+					if !assertions.Nil(err, "failed to open client session") {
+						return
+					}
+					defer clientSession.Close()
+
+					var local net.Addr
+					client := http.Client{
+						Transport: &http.Transport{
+							DialContext: func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+								conn, err = clientSession.Open(80)
+								if err == nil {
+									local = conn.LocalAddr()
+								}
+								return conn, err
+							},
+						},
+					}
+					res, err := client.Get("http://" + address.String())
+					if !assertions.Nil(err, "failed to perform request") {
+						return
+					}
+					defer res.Body.Close()
+
+					body, err := io.ReadAll(res.Body)
+					if !assertions.Nil(err, "failed to read body") {
+						return
+					}
+					assertions.Equal(onion.Network, local.Network(), "expecting onion network")
+					assertions.Equal(local.String(), string(body), "expecting client hidden identity")
+				},
+			},
+			{
+				Name: "DialHidden",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Prepare listener
+					serverCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer serverCircuit.Close()
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					svcSession, err := serverCircuit.Bind(hiddenPriv)
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+
+					var payload = []byte("HELLO")
+					err = svcSession.Handle(80, func(conn net.Conn) {
+						defer conn.Close()
+						conn.Write(payload)
+					})
+					if !assertions.Nil(err, "failed to handle port") {
+						return
+					}
+
+					// Prepare client
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+
+					clientSession, err := svc.DialHidden(context.TODO(), address)
+					if !assertions.Nil(err, "failed to dial hidden service") {
+						return
+					}
+					defer clientSession.Close()
+
+					cached, err := svc.DialHidden(context.TODO(), address)
+					if !assertions.Nil(err, "failed to dial hidden service") {
+						return
+					}
+					assertions.Equal(clientSession, cached, "expecting cached session")
+
+					conn, err := clientSession.Open(80)
+					if !assertions.Nil(err, "failed to open connection") {
+						return
+					}
+					defer conn.Close()
+
+					var recv = make([]byte, len(payload))
+					_, err = io.ReadFull(conn, recv)
+					if !assertions.Nil(err, "failed to read payload") {
+						return
+					}
+					assertions.Equal(payload, recv, "expecting a different payload")
+				},
+			},
+			{
+				Name: "DialContext HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Prepare listener
+					serverCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer serverCircuit.Close()
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					svcSession, err := serverCircuit.Bind(hiddenPriv)
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+
+					var payload = []byte("HELLO")
+					err = svcSession.Handle(80, func(conn net.Conn) {
+						defer conn.Close()
+						conn.Write(payload)
+					})
+					if !assertions.Nil(err, "failed to handle port") {
+						return
+					}
+
+					// Encoding
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+
+					encoded, err := onion.EncodeAddress(address)
+					if !assertions.Nil(err, "failed to encode address") {
+						return
+					}
+					assertions.True(strings.HasSuffix(encoded, onion.AddressSuffix), "expecting suffix")
+					assertions.Equal(encoded, svcSession.Addr().String(), "expecting encoded address")
+
+					for _, s := range []string{encoded, strings.ToUpper(encoded), address.String()} {
+						parsed, err := onion.ParseAddress(s)
+						assertions.Nil(err, "failed to parse address")
+						assertions.Equal(address, parsed, "expecting same address")
+					}
+
+					tampered := []byte(encoded)
+					tampered[0] = map[bool]byte{true: 'b', false: 'a'}[tampered[0] == 'a']
+					_, err = onion.ParseAddress(string(tampered))
+					assertions.NotNil(err, "expecting checksum mismatch")
+
+					// Done contexts abort the dial
+					canceled, cancel := context.WithCancel(context.TODO())
+					cancel()
+					_, err = svc.DialHidden(canceled, address)
+					assertions.ErrorIs(err, context.Canceled, "expecting canceled dial")
+
+					// Concurrent dials share the cached session
+					var (
+						wg       sync.WaitGroup
+						sessions [2]*onion.HiddenServiceConnection
+					)
+					for i := range sessions {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							sessions[i], _ = svc.DialHidden(context.TODO(), address)
+						}()
+					}
+					wg.Wait()
+					if !assertions.NotNil(sessions[0], "failed to dial hidden service") {
+						return
+					}
+					assertions.Same(sessions[0], sessions[1], "expecting a single session")
+
+					// Hidden service
+					conn, err := svc.DialContext(context.TODO(), "tcp", net.JoinHostPort(encoded, "80"))
+					if !assertions.Nil(err, "failed to dial hidden service") {
+						return
+					}
+					defer conn.Close()
+
+					var recv = make([]byte, len(payload))
+					_, err = io.ReadFull(conn, recv)
+					if !assertions.Nil(err, "failed to read payload") {
+						return
+					}
+					assertions.Equal(payload, recv, "expecting a different payload")
+
+					// External
+					l, err := net.Listen("tcp", "127.0.0.1:0")
+					if !assertions.Nil(err, "failed to listen") {
+						return
+					}
+					defer l.Close()
+
+					go func() {
+						conn, err := l.Accept()
+						if !assertions.Nil(err, "failed to accept connection") {
+							return
+						}
+						defer conn.Close()
+						conn.Write(payload)
+					}()
+
+					external, err := svc.DialContext(context.TODO(), "tcp", l.Addr().String())
+					if !assertions.Nil(err, "failed to dial external") {
+						return
+					}
+					defer external.Close()
+
+					_, err = io.ReadFull(external, recv)
+					if !assertions.Nil(err, "failed to read external payload") {
+						return
+					}
+					assertions.Equal(payload, recv, "expecting a different payload")
+				},
+			},
+			{
+				Name: "Supervised HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					keyFile := filepath.Join(t.TempDir(), "hidden.key")
+
+					// Prepare listener
+					svcSession, err := svc.BindHidden(onion.HiddenServiceConfig{
+						KeyFile:        keyFile,
+						RebindInterval: time.Second,
+					})
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+
+					hiddenPriv, err := identity.LoadIdentity(keyFile)
+					if !assertions.Nil(err, "failed to load persisted key") {
+						return
+					}
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+					assertions.Equal(address, svcSession.Address, "expecting persisted key address")
+
+					var payload = []byte("HELLO")
+					err = svcSession.Handle(80, func(conn net.Conn) {
+						defer conn.Close()
+						conn.Write(payload)
+					})
+					if !assertions.Nil(err, "failed to handle port") {
+						return
+					}
+
+					// Simulate the lost of the relay session
+					oldSession := svcSession.Session()
+					oldSession.Close()
+					assertions.Eventually(func() bool {
+						return svcSession.Session() != oldSession
+					}, time.Minute, 100*time.Millisecond, "expecting service rebind")
+
+					for range 3 {
+						clientSession, err := svc.DialHidden(context.TODO(), address)
+						if !assertions.Nil(err, "failed to dial hidden service") {
+							return
+						}
+						defer clientSession.Close()
+
+						conn, err := clientSession.Open(80)
+						if err != nil {
+							// Cached session of the previous relay
+							clientSession.Close()
+							continue
+						}
+						defer conn.Close()
+
+						var recv = make([]byte, len(payload))
+						_, err = io.ReadFull(conn, recv)
+						if err != nil {
+							clientSession.Close()
+							continue
+						}
+						assertions.Equal(payload, recv, "expecting a different payload")
+						return
+					}
+					assertions.Fail("failed to reach rebound hidden service")
+				},
+			},
+			{
+				Name: "Advertisement HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Last peer of targets hosts the service
+					relay := svcs[0]
+
+					serverCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer serverCircuit.Close()
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					svcSession, err := serverCircuit.Bind(hiddenPriv)
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+
+					assertions.Eventually(func() bool {
+						status, found := relay.AdvertisementStatus(svcSession.Address)
+						return found && status.Provides >= 1 && status.LastError == nil
+					}, time.Minute, 100*time.Millisecond, "expecting service advertised")
+
+					svcSession.Close()
+					assertions.Eventually(func() bool {
+						_, found := relay.AdvertisementStatus(svcSession.Address)
+						return !found
+					}, time.Minute, 100*time.Millisecond, "expecting service withdrawn")
+				},
+			},
+			{
+				Name: "Registry HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Last peer of targets hosts the service
+					relay := svcs[0]
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					bind := func() (svcSession *onion.HiddenServiceListener, ok bool) {
+						serverCircuit, err := svc.Circuit(targets)
+						if !assertions.Nil(err, "failed to prepare circuit") {
+							return nil, false
+						}
+
+						svcSession, err = serverCircuit.Bind(hiddenPriv)
+						if !assertions.Nil(err, "failed to bind hidden service") {
+							serverCircuit.Close()
+							return nil, false
+						}
+						go func() {
+							<-svcSession.Session().CloseChan()
+							serverCircuit.Close()
+						}()
+						return svcSession, true
+					}
+
+					svcSession, ok := bind()
+					if !ok {
+						return
+					}
+					defer svcSession.Close()
+
+					var payload = []byte("HELLO")
+					err = svcSession.Handle(80, func(conn net.Conn) {
+						defer conn.Close()
+						conn.Write(payload)
+					})
+					if !assertions.Nil(err, "failed to handle port") {
+						return
+					}
+
+					var entry *onion.HiddenServiceEntry
+					assertions.Eventually(func() bool {
+						entry, ok = relay.HiddenServices.Load(svcSession.Address)
+						return ok
+					}, time.Minute, 100*time.Millisecond, "expecting service registered")
+					if entry == nil {
+						return
+					}
+					assertions.False(entry.BoundAt.IsZero(), "expecting bind time")
+					assertions.Contains(relay.HiddenServices.List(), entry.Info(), "expecting service listed")
+
+					clientCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer clientCircuit.Close()
+
+					clientSession, err := clientCircuit.Dial(svcSession.Address)
+					if !assertions.Nil(err, "failed to open client session") {
+						return
+					}
+					defer clientSession.Close()
+
+					conn, err := clientSession.Open(80)
+					if !assertions.Nil(err, "failed to open connection") {
+						return
+					}
+					var recv = make([]byte, len(payload))
+					_, err = io.ReadFull(conn, recv)
+					conn.Close()
+					if !assertions.Nil(err, "failed to read payload") {
+						return
+					}
+					assertions.Eventually(func() bool {
+						return entry.BytesRelayed() >= uint64(len(payload))
+					}, time.Minute, 100*time.Millisecond, "expecting relayed bytes accounted")
+
+					// Rebinding the same address replaces the previous bind
+					rebound, ok := bind()
+					if !ok {
+						return
+					}
+					defer rebound.Close()
+
+					assertions.Eventually(func() bool {
+						return svcSession.Session().IsClosed()
+					}, time.Minute, 100*time.Millisecond, "expecting previous bind closed")
+
+					current, found := relay.HiddenServices.Load(svcSession.Address)
+					assertions.True(found, "expecting service still registered")
+					assertions.NotEqual(entry, current, "expecting latest bind to win")
+				},
+			},
+			{
+				Name: "Registry limit HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					newEntry := func(address peer.ID) (entry *onion.HiddenServiceEntry, ok bool) {
+						local, remote := net.Pipe()
+						defer remote.Close()
+						session, err := yamux.Client(local, nil)
+						if !assertions.Nil(err, "failed to prepare session") {
+							return nil, false
+						}
+						return &onion.HiddenServiceEntry{Address: address, Session: session}, true
+					}
+
+					registry := onion.NewHiddenServiceRegistry(1)
+					first, ok := newEntry(targets[0])
+					if !ok {
+						return
+					}
+					defer first.Session.Close()
+					assertions.Nil(registry.Register(first), "failed to register first service")
+
+					other, ok := newEntry(targets[1])
+					if !ok {
+						return
+					}
+					defer other.Session.Close()
+					assertions.ErrorIs(registry.Register(other), onion.ErrTooManyHiddenServices, "expecting new addresses refused")
+
+					// Rebinds are accepted at the limit. The latest wins and the old session is closed
+					rebound, ok := newEntry(targets[0])
+					if !ok {
+						return
+					}
+					defer rebound.Session.Close()
+					assertions.Nil(registry.Register(rebound), "expecting rebind accepted")
+					assertions.True(first.Session.IsClosed(), "expecting replaced session closed")
+					current, found := registry.Load(targets[0])
+					assertions.True(found, "expecting service registered")
+					assertions.Equal(rebound, current, "expecting latest bind to win")
+					assertions.Equal(1, registry.Len(), "expecting a single service")
+
+					assertions.False(registry.Unregister(first), "expecting replaced entry kept")
+					assertions.True(registry.Unregister(rebound), "expecting entry removed")
+					assertions.Nil(registry.Register(other), "expecting room for new addresses")
+				},
+			},
+			{
+				Name: "Balanced HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+
+					advertised := func() (count int) {
+						for _, relay := range svcs {
+							status, found := relay.AdvertisementStatus(address)
+							if found && status.Provides > 0 {
+								count++
+							}
+						}
+						return count
+					}
+
+					// Prepare instances
+					for index, payload := range []string{"A", "B"} {
+						instance, err := svc.BindHidden(onion.HiddenServiceConfig{
+							PrivKey: hiddenPriv,
+							Shared:  true,
+						})
+						if !assertions.Nil(err, "failed to bind hidden service") {
+							return
+						}
+						defer instance.Close()
+
+						err = instance.Handle(80, func(conn net.Conn) {
+							defer conn.Close()
+							conn.Write([]byte(payload))
+						})
+						if !assertions.Nil(err, "failed to handle port") {
+							return
+						}
+
+						assertions.Eventually(func() bool {
+							return advertised() == index+1
+						}, time.Minute, 100*time.Millisecond, "expecting instance advertised by its own relay")
+					}
+
+					// Prepare client
+					balancer, err := svc.DialHiddenBalanced(context.TODO(), address, 2)
+					if !assertions.Nil(err, "failed to dial hidden service") {
+						return
+					}
+					defer balancer.Close()
+					assertions.Len(balancer.Backends(), 2, "expecting both instances")
+
+					var received = make(map[string]int)
+					for range 4 {
+						conn, err := balancer.Open(80)
+						if !assertions.Nil(err, "failed to open connection") {
+							return
+						}
+
+						var recv = make([]byte, 1)
+						_, err = io.ReadFull(conn, recv)
+						conn.Close()
+						if !assertions.Nil(err, "failed to read payload") {
+							return
+						}
+						received[string(recv)]++
+					}
+					assertions.Equal(map[string]int{"A": 2, "B": 2}, received, "expecting streams spread across instances")
+
+					// Zero uses the default maximum
+					defaulted, err := svc.DialHiddenBalanced(context.TODO(), address, 0)
+					if !assertions.Nil(err, "failed to dial hidden service") {
+						return
+					}
+					defer defaulted.Close()
+					assertions.Equal(onion.DefaultMaxBackends, defaulted.MaxBackends, "expecting default maximum")
+					assertions.Len(defaulted.Backends(), 2, "expecting both instances")
+
+					// Concurrent refreshes never exceed the maximum
+					single := &onion.HiddenServiceBalancer{Address: address, Service: svc, MaxBackends: 1}
+					defer single.Close()
+					var wg sync.WaitGroup
+					for range 4 {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							single.Refresh(context.TODO())
+						}()
+					}
+					wg.Wait()
+					assertions.Len(single.Backends(), 1, "expecting a single backend")
+				},
+			},
+			{
+				Name: "Certified HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Master key stays offline. Only the signing key and its certificate are used by the service
+					masterPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate master key") {
+						return
+					}
+					address, err := onion.HiddenAddressFromPrivKey(masterPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+
+					signingPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate signing key") {
+						return
+					}
+
+					expired, err := onion.NewCertificate(masterPriv, signingPriv.GetPublic(), time.Now().Add(-time.Minute))
+					if !assertions.Nil(err, "failed to issue expired certificate") {
+						return
+					}
+					_, err = svc.BindHidden(onion.HiddenServiceConfig{PrivKey: signingPriv, Certificate: expired})
+					assertions.NotNil(err, "expecting expired certificate to be rejected")
+
+					cert, err := onion.NewCertificate(masterPriv, signingPriv.GetPublic(), time.Now().Add(time.Hour))
+					if !assertions.Nil(err, "failed to issue certificate") {
+						return
+					}
+
+					certFile := filepath.Join(t.TempDir(), "hidden.cert")
+					err = onion.SaveCertificate(certFile, cert)
+					if !assertions.Nil(err, "failed to save certificate") {
+						return
+					}
+
+					svcSession, err := svc.BindHidden(onion.HiddenServiceConfig{
+						PrivKey:         signingPriv,
+						CertificateFile: certFile,
+					})
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+					assertions.Equal(address, svcSession.Address, "expecting master key address")
+
+					var payload = []byte("HELLO")
+					err = svcSession.Handle(80, func(conn net.Conn) {
+						defer conn.Close()
+						conn.Write(payload)
+					})
+					if !assertions.Nil(err, "failed to handle port") {
+						return
+					}
+
+					clientSession, err := svc.DialHidden(context.TODO(), address)
+					if !assertions.Nil(err, "failed to dial hidden service") {
+						return
+					}
+					defer clientSession.Close()
+
+					conn, err := clientSession.Open(80)
+					if !assertions.Nil(err, "failed to open connection") {
+						return
+					}
+					defer conn.Close()
+
+					var recv = make([]byte, len(payload))
+					_, err = io.ReadFull(conn, recv)
+					if !assertions.Nil(err, "failed to read payload") {
+						return
+					}
+					assertions.Equal(payload, recv, "expecting a different payload")
+				},
+			},
+			{
+				Name: "Single onion HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					svcSession, err := svc.BindHidden(onion.HiddenServiceConfig{
+						PrivKey:     hiddenPriv,
+						SingleOnion: true,
+					})
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+
+					var payload = []byte("HELLO")
+					err = svcSession.Handle(80, func(conn net.Conn) {
+						defer conn.Close()
+						conn.Write(payload)
+					})
+					if !assertions.Nil(err, "failed to handle port") {
+						return
+					}
+
+					clientSession, err := svc.DialHidden(context.TODO(), svcSession.Address)
+					if !assertions.Nil(err, "failed to dial hidden service") {
+						return
+					}
+					defer clientSession.Close()
+
+					conn, err := clientSession.Open(80)
+					if !assertions.Nil(err, "failed to open connection") {
+						return
+					}
+					defer conn.Close()
+					assertions.True(conn.(*onion.HiddenConn).NonAnonymous, "expecting service flagged as non-anonymous")
+
+					var recv = make([]byte, len(payload))
+					_, err = io.ReadFull(conn, recv)
+					if !assertions.Nil(err, "failed to read payload") {
+						return
+					}
+					assertions.Equal(payload, recv, "expecting a different payload")
+				},
+			},
+			{
+				Name: "Mailbox HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Service currently offline
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+
+					var payloads = [][]byte{[]byte("HELLO"), []byte("WORLD")}
+					for _, payload := range payloads {
+						err = svc.DepositHidden(context.TODO(), address, payload)
+						if !assertions.Nil(err, "failed to deposit message") {
+							return
+						}
+					}
+
+					err = svc.DepositHidden(context.TODO(), address, make([]byte, onion.DefaultMailboxMessageSize+1))
+					assertions.NotNil(err, "expecting oversized message to be rejected")
+
+					// Relays only hold ciphertext
+					var stored int
+					for _, relay := range svcs {
+						for _, msg := range relay.Mailbox.Fetch(address) {
+							stored++
+							for _, payload := range payloads {
+								assertions.False(bytes.Contains(msg.Payload, payload), "expecting sealed payload")
+							}
+						}
+					}
+					assertions.Equal(len(payloads), stored, "expecting deposited messages stored")
+
+					var received [][]byte
+					assertions.Eventually(func() bool {
+						messages, err := svc.CollectMailbox(context.TODO(), hiddenPriv, nil)
+						if err != nil {
+							return false
+						}
+						for _, msg := range messages {
+							received = append(received, msg.Payload)
+						}
+						return len(received) >= len(payloads)
+					}, time.Minute, 100*time.Millisecond, "expecting messages collected")
+					assertions.ElementsMatch(payloads, received, "expecting deposited messages")
+
+					messages, err := svc.CollectMailbox(context.TODO(), hiddenPriv, nil)
+					assertions.Nil(err, "failed to collect mailbox")
+					assertions.Empty(messages, "expecting collected messages deleted")
+
+					// Other keys can't read the mailbox
+					otherPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+					relay := svcs[0]
+					c, err := svc.RandomCircuit(svc.Hops, relay.ID)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer c.Close()
+					err = c.Deposit(address, []byte("SECRET"))
+					if !assertions.Nil(err, "failed to deposit message") {
+						return
+					}
+					messages, err = c.FetchMailbox(otherPriv, nil)
+					assertions.Nil(err, "failed to fetch mailbox")
+					assertions.Empty(messages, "expecting no messages for a different address")
+					assertions.Len(relay.Mailbox.Fetch(address), 1, "expecting message kept")
+
+					// Solved deposits are accepted once
+					deposit, err := onion.NewDeposit(relay.ID, address, []byte("REPLAY"), c.Settings[c.Current].MailboxDifficulty)
+					if !assertions.Nil(err, "failed to prepare deposit") {
+						return
+					}
+					var req = message.Message{
+						Data: message.Data{
+							Deposit: deposit,
+						},
+					}
+					err = req.Send(c.Active, c.Settings[c.Current])
+					assertions.Nil(err, "failed to send deposit")
+					var res message.Message
+					err = res.Recv(c.Active, onion.DefaultSettings)
+					if assertions.Nil(err, "failed to receive response") && assertions.NotNil(res.Data.MailboxResponse, "expecting mailbox response") {
+						assertions.Empty(res.Data.MailboxResponse.Error, "expecting deposit stored")
+					}
+					err = req.Send(c.Active, c.Settings[c.Current])
+					assertions.Nil(err, "failed to send replayed deposit")
+					_, err = c.Active.Read(make([]byte, 1))
+					assertions.NotNil(err, "expecting replayed deposit refused")
+					assertions.Len(relay.Mailbox.Fetch(address), 2, "expecting replayed deposit not stored")
+				},
+			},
+			{
+				Name: "Directory HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					peers, err := svc.ListPeers()
+					if !assertions.Nil(err, "failed to list peers") {
+						return
+					}
+					var records int
+					for _, p := range peers {
+						if p.Modes.Has(onion.RecordsNodeP2PCid) {
+							records++
+						}
+					}
+					assertions.Equal(len(svcs), records, "expecting every relay storing records")
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					listing, err := onion.NewListing(hiddenPriv, nil, message.Listing{
+						Title:       "Library",
+						Description: "Books served over onion",
+						Tags:        []string{"books", "reading"},
+						Contact:     "librarian@example.com",
+					})
+					if !assertions.Nil(err, "failed to sign listing") {
+						return
+					}
+
+					tampered := *listing
+					tampered.Title = "Tampered"
+					err = svc.PublishListing(context.TODO(), &tampered)
+					assertions.NotNil(err, "expecting tampered listing to be rejected")
+
+					err = svc.PublishListing(context.TODO(), listing)
+					if !assertions.Nil(err, "failed to publish listing") {
+						return
+					}
+
+					found, err := svc.LookupListing(context.TODO(), listing.Address)
+					if !assertions.Nil(err, "failed to lookup listing") {
+						return
+					}
+					assertions.Equal(listing.Title, found.Title, "expecting published listing")
+
+					listed := func(listings []message.Listing) bool {
+						return slices.ContainsFunc(listings, func(l message.Listing) bool {
+							return l.Address == listing.Address
+						})
+					}
+
+					assertions.Eventually(func() bool {
+						listings, err := svc.SearchDirectory(context.TODO(), "BOOKS")
+						return err == nil && listed(listings)
+					}, time.Minute, 100*time.Millisecond, "expecting listing found by tag")
+
+					listings, err := svc.SearchDirectory(context.TODO(), "no listing matches this")
+					assertions.Nil(err, "failed to search directory")
+					assertions.False(listed(listings), "expecting listing filtered")
+
+					c, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer c.Close()
+
+					unpaid := message.Message{
+						Data: message.Data{
+							Publish: &message.Publish{Listing: *listing},
+						},
+					}
+					err = unpaid.Send(c.Active, c.Settings[c.Current])
+					assertions.Nil(err, "failed to send unpaid publication")
+					_, err = c.Active.Read(make([]byte, 1))
+					assertions.NotNil(err, "expecting publication without proof of work refused")
+
+					otherPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+					other, err := onion.NewListing(otherPriv, nil, message.Listing{Title: "Other"})
+					if !assertions.Nil(err, "failed to sign listing") {
+						return
+					}
+
+					directory := onion.NewDirectory(nil)
+					directory.MaxListings = 1
+					_, err = directory.Store(listing)
+					assertions.Nil(err, "failed to store listing")
+					_, err = directory.Store(other)
+					assertions.ErrorIs(err, onion.ErrDirectoryFull, "expecting new addresses refused")
+					_, err = directory.Store(listing)
+					assertions.Nil(err, "expecting stored addresses updated")
+
+					// Listings can't occupy the directories forever
+					lasting, err := onion.NewListing(otherPriv, nil, message.Listing{
+						Title:  "Lasting",
+						Expiry: time.Now().Add(onion.MaxListingTTL + time.Hour).Unix(),
+					})
+					if !assertions.Nil(err, "failed to sign listing") {
+						return
+					}
+					assertions.NotNil(onion.VerifyListing(lasting), "expecting expiry too far refused")
+				},
+			},
+			{
+				Name: "Names HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Prepare listener
+					serverCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer serverCircuit.Close()
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					svcSession, err := serverCircuit.Bind(hiddenPriv)
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+
+					var payload = []byte("HELLO")
+					err = svcSession.Handle(80, func(conn net.Conn) {
+						defer conn.Close()
+						conn.Write(payload)
+					})
+					if !assertions.Nil(err, "failed to handle port") {
+						return
+					}
+
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+
+					// Registration
+					registered, err := svc.RegisterName(context.TODO(), hiddenPriv, nil, "shop", 0)
+					if !assertions.Nil(err, "failed to register name") {
+						return
+					}
+					assertions.Equal(address, registered.Address, "expecting hidden address")
+
+					resolved, err := svc.ResolveName(context.TODO(), "shop"+onion.AddressSuffix)
+					if !assertions.Nil(err, "failed to resolve name") {
+						return
+					}
+					assertions.Equal(address, resolved, "expecting hidden address")
+
+					// First come, first served
+					otherPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+					_, err = svc.RegisterName(context.TODO(), otherPriv, nil, "shop", 0)
+					assertions.ErrorIs(err, onion.ErrNameTaken, "expecting name taken")
+
+					squatter, err := onion.NewNameRecord(context.TODO(), otherPriv, nil, "shop", time.Now(), 0)
+					if !assertions.Nil(err, "failed to prepare record") {
+						return
+					}
+					c, err := svc.RandomCircuit(3)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer c.Close()
+					assertions.NotNil(c.RegisterName(squatter), "expecting relay to refuse the record")
+
+					// Backdated registrations of other keys can't take over the name
+					backdated, err := onion.NewNameRecord(context.TODO(), otherPriv, nil, "shop", time.Unix(1, 0), 0)
+					if !assertions.Nil(err, "failed to prepare record") {
+						return
+					}
+					assertions.Equal(backdated.Expiry-int64(onion.MaxNameTTL/time.Second), backdated.Registered, "expecting registration bounded by the expiry")
+					assertions.NotNil(c.RegisterName(backdated), "expecting relay to refuse the backdated record")
+
+					owned, err := msgpack.Marshal(registered)
+					assertions.Nil(err, "failed to marshal record")
+					stolen, err := msgpack.Marshal(backdated)
+					assertions.Nil(err, "failed to marshal record")
+
+					store := datastore.NewMapDatastore()
+					validator := onion.NameValidator{Datastore: store}
+
+					storeHost, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/0.0.0.0/udp/0/quic-v1"))
+					if !assertions.Nil(err, "failed to prepare host") {
+						return
+					}
+					defer storeHost.Close()
+					storeDht, err := dht.New(context.TODO(), storeHost, append(onion.DHTOptions(store), dht.Mode(dht.ModeServer))...)
+					if !assertions.Nil(err, "failed to prepare dht") {
+						return
+					}
+					defer storeDht.Close()
+					// Stored locally even without peers to replicate it to
+					storeDht.PutValue(context.TODO(), onion.NameKey("shop"), owned)
+
+					for _, values := range [][][]byte{{stolen, owned}, {owned, stolen}} {
+						index, err := validator.Select(onion.NameKey("shop"), values)
+						assertions.Nil(err, "failed to select")
+						assertions.Equal(owned, values[index], "expecting backdated record of another key to lose")
+					}
+
+					// Renewal
+					renewed, err := svc.RegisterName(context.TODO(), hiddenPriv, nil, "shop", 2*onion.DefaultNameTTL)
+					if !assertions.Nil(err, "failed to renew name") {
+						return
+					}
+					assertions.Equal(registered.Registered, renewed.Registered, "expecting registration time kept")
+					assertions.Greater(renewed.Expiry, registered.Expiry, "expecting later expiry")
+
+					// Dial by name
+					conn, err := svc.DialContext(context.TODO(), "tcp", net.JoinHostPort("shop"+onion.AddressSuffix, "80"))
+					if !assertions.Nil(err, "failed to dial hidden service by name") {
+						return
+					}
+					defer conn.Close()
+
+					var recv = make([]byte, len(payload))
+					_, err = io.ReadFull(conn, recv)
+					if !assertions.Nil(err, "failed to read payload") {
+						return
+					}
+					assertions.Equal(payload, recv, "expecting a different payload")
+
+					hidden, err := svc.DialHidden(context.TODO(), peer.ID("shop"))
+					if !assertions.Nil(err, "failed to dial hidden by name") {
+						return
+					}
+					cached, err := svc.DialHidden(context.TODO(), address)
+					if !assertions.Nil(err, "failed to dial hidden service") {
+						return
+					}
+					assertions.Equal(hidden, cached, "expecting same session")
+				},
+			},
+			{
+				Name: "Discover HiddenService",
+				Action: func(t *testing.T, svc *onion.Service) {
+					assertions := assert.New(t)
+
+					// Prepare listener
+					serverCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer serverCircuit.Close()
+
+					hiddenPriv, err := identity.NewKey()
+					if !assertions.Nil(err, "failed to generate identity") {
+						return
+					}
+
+					svcSession, err := serverCircuit.Bind(hiddenPriv)
+					if !assertions.Nil(err, "failed to bind hidden service") {
+						return
+					}
+					defer svcSession.Close()
+
+					// Prepare client
+					t.Log("Preparing client")
+					clientCircuit, err := svc.Circuit(targets)
+					if !assertions.Nil(err, "failed to prepare circuit") {
+						return
+					}
+					defer clientCircuit.Close()
+
+					address, err := onion.HiddenAddressFromPrivKey(hiddenPriv)
+					if !assertions.Nil(err, "failed to get address") {
+						return
+					}
+
+					// time.Sleep(5 * time.Second)
 					peers, err := clientCircuit.HiddenDHT(onion.CidFromData(address))
 					if !assertions.Nil(err, "failed to find peers") {
 						return
@@ -286,18 +2219,21 @@ func Test_Integration(t *testing.T) {
 				clientPeerDht, err := dht.New(
 					context.TODO(),
 					client,
-					dht.Mode(dht.ModeClient),
-					dht.BootstrapPeers(currentAddrs...),
-					dht.Datastore(datastore.NewMapDatastore()),
+					append(
+						onion.DHTOptions(datastore.NewMapDatastore()),
+						dht.Mode(dht.ModeClient),
+						dht.BootstrapPeers(currentAddrs...),
+					)...,
 				)
 				assertions.Nil(err, "failed to prepare client DHT")
 				defer clientPeerDht.Close()
 
-				clientSvc, err := onion.New(
-					onion.DefaultConfig().
-						WithHost(client).
-						WithDHT(clientPeerDht),
-				)
+				clientCfg := onion.DefaultConfig().
+					WithHost(client).
+					WithDHT(clientPeerDht)
+				// Clients use a client only DHT. Prevents closed clients from being picked for circuits
+				clientCfg.HiddenMode = true
+				clientSvc, err := onion.New(clientCfg)
 				assertions.Nil(err, "failed to prepare peer service")
 
 				test.Action(t, clientSvc)
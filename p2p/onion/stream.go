@@ -1,7 +1,9 @@
 package onion
 
 import (
+	"io"
 	"net"
+	"sync/atomic"
 
 	"github.com/libp2p/go-libp2p/core/network"
 )
@@ -11,8 +13,33 @@ type NetConnStream struct {
 	network.Stream
 }
 
-// TODO: Somehow populate this
-func (s *NetConnStream) LocalAddr() net.Addr  { return nil }
-func (s *NetConnStream) RemoteAddr() net.Addr { return nil }
+func (s *NetConnStream) LocalAddr() net.Addr  { return &Addr{Address: s.Conn().LocalPeer()} }
+func (s *NetConnStream) RemoteAddr() net.Addr { return &Addr{Address: s.Conn().RemotePeer()} }
 
 var _ net.Conn = (*NetConnStream)(nil)
+
+// Accounts the bytes written into the counter
+type countingWriter struct {
+	io.Writer
+	Counter *atomic.Uint64
+}
+
+func (w *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = w.Writer.Write(b)
+	w.Counter.Add(uint64(n))
+	return n, err
+}
+
+// Connection with a hidden service. Both ends are identified by their onion addresses
+type HiddenConn struct {
+	net.Conn
+	Local  *Addr
+	Remote *Addr
+	// Set when the hidden service declared itself as a single onion service
+	NonAnonymous bool
+}
+
+func (c *HiddenConn) LocalAddr() net.Addr  { return c.Local }
+func (c *HiddenConn) RemoteAddr() net.Addr { return c.Remote }
+
+var _ net.Conn = (*HiddenConn)(nil)
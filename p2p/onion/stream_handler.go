@@ -10,9 +10,21 @@ import (
 func (s *Service) StreamHandler(stream network.Stream) {
 	defer stream.Close()
 
+	// Hibernating nodes refuse new circuits until the next accounting period
+	if s.Accounting.Hibernating() {
+		stream.Reset()
+		return
+	}
+
 	settings := s.Settings()
 	defer s.Connections.Add(-1)
 
+	remote := stream.Conn().RemotePeer()
+	limiters, release := s.Bandwidth.Acquire(remote)
+	defer release()
+	traffic := s.trackTraffic(remote)
+	defer s.untrackTraffic(traffic)
+
 	conn := Connection{
 		Host:     s.Host,
 		DHT:      s.DHT,
@@ -20,12 +32,23 @@ func (s *Service) StreamHandler(stream network.Stream) {
 		Settings: settings,
 		Stream:   stream,
 		Logger: log.Logger{
-			PeerID: stream.Conn().RemotePeer(),
+			PeerID: remote,
 		},
 		Noise:          s.Noise,
 		Secured:        false,
 		ExitNode:       s.ExitNode,
+		ExitPolicy:     s.ExitPolicy,
+		ExitLimits:     s.ExitLimits,
+		Resolver:       s.Resolver,
+		UDPIdleTimeout: s.UDPIdleTimeout,
+		Limiters:       limiters,
+		Traffic:        traffic,
+		TotalTraffic:   &s.Traffic,
+		Accounting:     s.Accounting,
 		HiddenServices: s.HiddenServices,
+		Mailbox:        s.Mailbox,
+		Directory:      s.Directory,
+		TTL:            s.TTL,
 	}
 
 	err := conn.Handle()
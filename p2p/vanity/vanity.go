@@ -0,0 +1,156 @@
+package vanity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/identity"
+	"github.com/RogueTeam/onion/p2p/onion"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Characters an encoded hidden address is made of
+const Alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+// Longest prefix accepted. Characters past the public key depend on the checksum
+const MaxPrefix = 32 * 8 / 5
+
+type Config struct {
+	// Prefix the encoded hidden address should start with
+	Prefix string
+	// Number of goroutines searching. Zero means runtime.NumCPU
+	Workers int
+}
+
+type Result struct {
+	Key     crypto.PrivKey
+	Address peer.ID
+	// Number of keys generated until finding the result
+	Attempts uint64
+	Elapsed  time.Duration
+}
+
+// Checks the prefix can be found
+func ValidatePrefix(prefix string) (err error) {
+	if len(prefix) > MaxPrefix {
+		return fmt.Errorf("prefix longer than %d characters", MaxPrefix)
+	}
+	for _, r := range prefix {
+		if !strings.ContainsRune(Alphabet, r) {
+			return fmt.Errorf("invalid prefix character %q. Allowed characters: %s", r, Alphabet)
+		}
+	}
+	return nil
+}
+
+// Average number of keys needed to find the prefix
+func ExpectedAttempts(prefix string) (attempts float64) {
+	return math.Pow(float64(len(Alphabet)), float64(len(prefix)))
+}
+
+// Keys per second the workers generate. Measured during d
+func Rate(d time.Duration, workers int) (rate float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	var attempts atomic.Uint64
+	search(ctx, workers, &attempts, func(string) bool { return false })
+	return float64(attempts.Load()) / d.Seconds()
+}
+
+// Estimated time to find the prefix at the passed rate
+func Estimate(prefix string, rate float64) (d time.Duration) {
+	if rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	seconds := ExpectedAttempts(prefix) / rate
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Searches an Ed25519 key whose encoded hidden address starts with the prefix.
+// Runs until found or the context is done
+func Generate(ctx context.Context, cfg Config) (result *Result, err error) {
+	prefix := strings.ToLower(cfg.Prefix)
+	err = ValidatePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		start    = time.Now()
+		attempts atomic.Uint64
+	)
+	result = search(ctx, cfg.Workers, &attempts, func(encoded string) bool {
+		return strings.HasPrefix(encoded, prefix)
+	})
+	if result == nil {
+		err = ctx.Err()
+		if err == nil {
+			err = errors.New("search stopped")
+		}
+		return nil, err
+	}
+
+	result.Attempts = attempts.Load()
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
+
+// Generates keys in every worker until one matches or the context is done
+func search(ctx context.Context, workers int, attempts *atomic.Uint64, match func(encoded string) bool) (result *Result) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		once sync.Once
+		wg   sync.WaitGroup
+	)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for ctx.Err() == nil {
+				key, err := identity.NewKey()
+				if err != nil {
+					continue
+				}
+				attempts.Add(1)
+
+				address, err := onion.HiddenAddressFromPrivKey(key)
+				if err != nil {
+					continue
+				}
+				encoded, err := onion.EncodeAddress(address)
+				if err != nil || !match(encoded) {
+					continue
+				}
+
+				once.Do(func() {
+					result = &Result{Key: key, Address: address}
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	return result
+}
@@ -0,0 +1,63 @@
+package vanity_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RogueTeam/onion/p2p/identity"
+	"github.com/RogueTeam/onion/p2p/onion"
+	"github.com/RogueTeam/onion/p2p/vanity"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Generate(t *testing.T) {
+	t.Run("Succeed", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		result, err := vanity.Generate(context.TODO(), vanity.Config{Prefix: "ab"})
+		if !assertions.Nil(err, "failed to generate key") {
+			return
+		}
+
+		encoded, err := onion.EncodeAddress(result.Address)
+		assertions.Nil(err, "failed to encode address")
+		assertions.True(strings.HasPrefix(encoded, "ab"), "expecting prefix")
+		assertions.NotZero(result.Attempts, "expecting attempts")
+
+		location := filepath.Join(t.TempDir(), "hidden.key")
+		err = identity.SaveIdentity(location, result.Key)
+		assertions.Nil(err, "failed to save key")
+
+		loaded, err := identity.LoadIdentity(location)
+		assertions.Nil(err, "failed to load key")
+		assertions.True(result.Key.Equals(loaded), "expecting same key")
+	})
+	t.Run("Invalid prefix", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		for _, prefix := range []string{"a1", "a-", strings.Repeat("a", vanity.MaxPrefix+1)} {
+			_, err := vanity.Generate(context.TODO(), vanity.Config{Prefix: prefix})
+			assertions.NotNil(err, "expecting invalid prefix")
+		}
+	})
+	t.Run("Cancelled", func(t *testing.T) {
+		assertions := assert.New(t)
+
+		ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err := vanity.Generate(ctx, vanity.Config{Prefix: strings.Repeat("a", vanity.MaxPrefix)})
+		assertions.ErrorIs(err, context.DeadlineExceeded, "expecting deadline")
+	})
+}
+
+func Test_Estimate(t *testing.T) {
+	assertions := assert.New(t)
+
+	assertions.Equal(float64(32*32*32), vanity.ExpectedAttempts("abc"), "expecting 32^3 attempts")
+	assertions.Equal(time.Second, vanity.Estimate("a", 32), "expecting a second")
+	assertions.Greater(vanity.Rate(100*time.Millisecond, 1), float64(0), "expecting positive rate")
+}
@@ -141,6 +141,21 @@ func New(ctx context.Context, h hash.Hash, bits uint64, salt, payload string) (h
 	}
 }
 
+// Returns the number of bits claimed by the hashcash.
+// Use it only on already verified hashcashes
+func Bits(hc string) (bits uint64, err error) {
+	var parts = strings.Split(hc, ":")
+	if len(parts) != 7 {
+		return 0, errors.New("invalid hashcash")
+	}
+
+	bits, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse bits part: %w", err)
+	}
+	return bits, nil
+}
+
 // Verifies a hashcash is valid. Returns nil on valid
 // And error if the hash is invalid
 func Verify(h hash.Hash, hc string) (err error) {
@@ -239,6 +239,10 @@ func Test_Integration(t *testing.T) {
 				// Verify the generated hashcash
 				err = hashcash.Verify(test.Algo, hc)
 				assertions.Nil(err, "failed to verify hashcash for test: %s", test.Name) // Add test name to error message for clarity
+
+				bits, err := hashcash.Bits(hc)
+				assertions.Nil(err, "failed to parse bits for test: %s", test.Name)
+				assertions.Equal(test.Bits, bits, "expecting other bits for test: %s", test.Name)
 			})
 		}
 	})
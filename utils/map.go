@@ -8,7 +8,10 @@ type Map[K, T any] struct {
 
 func (m *Map[K, T]) Load(k K) (v T, found bool) {
 	rawV, found := m.Map.Load(k)
-	return rawV.(T), found
+	if !found {
+		return v, false
+	}
+	return rawV.(T), true
 }
 
 func (m *Map[K, T]) Store(k K, v T) {